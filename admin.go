@@ -0,0 +1,105 @@
+package feo
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// handleSwitchPolicyRequest replaces the offloading policy of an application at
+// runtime. Requests in flight finish under the old offloader, while the queue of
+// the application carries over to the new one.
+func (r *requestHandler) handleSwitchPolicyRequest(w http.ResponseWriter, req *http.Request) {
+	// curl -X PUT http://localhost:9696/api/v1/admin/policy/test -d '{"name": "impedence", "config": {"alpha": 0.3}}'
+	appName := strings.TrimPrefix(req.URL.Path, "/api/v1/admin/policy/")
+	app, ok := r.getApplication(appName)
+	if !ok {
+		http.Error(w, fmt.Sprintf("Application %s does not exist", appName), http.StatusNotFound)
+		return
+	}
+
+	body, err := io.ReadAll(req.Body)
+	if err != nil {
+		http.Error(w, "Failed to read request body", http.StatusInternalServerError)
+		return
+	}
+	var policyConfig PolicyConfig
+	if err := yaml.Unmarshal(body, &policyConfig); err != nil {
+		http.Error(w, fmt.Sprintf("Invalid policy: %s", err.Error()), http.StatusBadRequest)
+		return
+	}
+
+	finfo := app.getOffloader().Base().Finfo
+	offloader, params, err := r.createOffloader(app.spec, policyConfig, finfo)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	oldPolicy, oldParams := app.getPolicy()
+	// the application was removed or replaced since the lookup, swapOffloader closed offloader
+	if app.swapOffloader(offloader, OffloadPolicy(policyConfig.Name), params) == nil {
+		http.Error(w, fmt.Sprintf("Application %s was replaced or removed, retry", appName), http.StatusConflict)
+		return
+	}
+	log.Printf("[INFO] Switched policy of %s from %s to %s", appName, oldPolicy, policyConfig.Name)
+
+	r.logEvent("policy_switch", map[string]any{
+		"app":         appName,
+		"from":        oldPolicy,
+		"from_params": oldParams,
+		"to":          policyConfig.Name,
+		"to_params":   params,
+		"qlen":        offloader.GetSnapshot(req).Qlen,
+	})
+
+	// declared applications keep the policy from the config file as their spec
+	if !app.declared {
+		spec := app.spec
+		spec.Policy = &policyConfig
+		if err := r.store.SaveAction(spec); err != nil {
+			log.Printf("[WARNING] could not persist application %s: %v", appName, err)
+		}
+	}
+}
+
+// handleMembersRequest lists the members known to the failure detector.
+func (r *requestHandler) handleMembersRequest(w http.ResponseWriter, req *http.Request) {
+	// curl http://localhost:9696/api/v1/admin/peers
+	if r.membership == nil {
+		http.Error(w, "membership is disabled", http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(r.membership.Members())
+}
+
+// handleMemberRequest adds a peer with PUT and removes it with DELETE. The
+// change applies to every offloader right away.
+func (r *requestHandler) handleMemberRequest(w http.ResponseWriter, req *http.Request) {
+	// curl -X PUT http://localhost:9696/api/v1/admin/peers/10.10.1.3:9696
+	if r.membership == nil {
+		http.Error(w, "membership is disabled", http.StatusNotFound)
+		return
+	}
+	host := strings.TrimPrefix(req.URL.Path, "/api/v1/admin/peers/")
+	if host == "" || host == r.host {
+		http.Error(w, fmt.Sprintf("Invalid peer %q", host), http.StatusBadRequest)
+		return
+	}
+	switch req.Method {
+	case "PUT":
+		r.membership.Join(host)
+	case "DELETE":
+		if !r.membership.Leave(host) {
+			http.Error(w, fmt.Sprintf("Peer %s does not exist", host), http.StatusNotFound)
+			return
+		}
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,266 @@
+package feo
+
+import (
+	"bytes"
+	"container/list"
+	"crypto/md5"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const OffloadAffinity = "affinity"
+
+func init() {
+	RegisterPolicy(PolicyRegistration{
+		Name:      OffloadAffinity,
+		NewParams: func() PolicyParams { return DefaultAffinityParams() },
+		New: func(base *BaseOffloader, params PolicyParams) OffloaderIntf {
+			return NewAffinityOffloader(base, params.(*AffinityParams))
+		},
+	})
+}
+
+type AffinityParams struct {
+	QlenMax int32 `yaml:"qlen_max" json:"qlen_max"`
+	// The affinity key is taken from the first of these that is set on a
+	// request. key_field is a top-level field of a JSON body.
+	KeyHeader string `yaml:"key_header" json:"key_header"`
+	KeyQuery  string `yaml:"key_query" json:"key_query"`
+	KeyField  string `yaml:"key_field" json:"key_field"`
+	// points per node on the hash ring
+	VirtualNodes int `yaml:"virtual_nodes" json:"virtual_nodes"`
+	// peers whose last known qlen reaches this are skipped on the ring
+	PeerQlenMax float32 `yaml:"peer_qlen_max" json:"peer_qlen_max"`
+	// peer qlens older than this are not trusted anymore
+	LoadTTLMs int `yaml:"load_ttl_ms" json:"load_ttl_ms"`
+}
+
+func DefaultAffinityParams() *AffinityParams {
+	return &AffinityParams{QlenMax: 10, KeyHeader: "X-Affinity-Key", VirtualNodes: 100, PeerQlenMax: 10, LoadTTLMs: 1000}
+}
+
+func (p *AffinityParams) Validate() error {
+	if p.QlenMax <= 0 {
+		return fmt.Errorf("qlen_max must be positive, got %d", p.QlenMax)
+	}
+	if p.KeyHeader == "" && p.KeyQuery == "" && p.KeyField == "" {
+		return fmt.Errorf("one of key_header, key_query or key_field must be set")
+	}
+	if p.VirtualNodes <= 0 {
+		return fmt.Errorf("virtual_nodes must be positive, got %d", p.VirtualNodes)
+	}
+	if p.PeerQlenMax <= 0 {
+		return fmt.Errorf("peer_qlen_max must be positive, got %v", p.PeerQlenMax)
+	}
+	if p.LoadTTLMs <= 0 {
+		return fmt.Errorf("load_ttl_ms must be positive, got %d", p.LoadTTLMs)
+	}
+	return nil
+}
+
+// hashRing is a consistent-hash ring with VirtualNodes points per node.
+type hashRing struct {
+	points []uint32
+	owners map[uint32]string
+	nodes  int
+}
+
+// hashKey uses the first bytes of md5 like ketama. fnv spreads short keys that
+// only differ in their last character badly.
+func hashKey(key string) uint32 {
+	sum := md5.Sum([]byte(key))
+	return binary.BigEndian.Uint32(sum[:4])
+}
+
+func newHashRing(nodes []string, vnodes int) *hashRing {
+	ring := &hashRing{owners: map[uint32]string{}}
+	seen := map[string]bool{}
+	for _, node := range nodes {
+		if seen[node] {
+			continue
+		}
+		seen[node] = true
+		ring.nodes++
+		for i := 0; i < vnodes; i++ {
+			point := hashKey(node + "#" + strconv.Itoa(i))
+			ring.points = append(ring.points, point)
+			ring.owners[point] = node
+		}
+	}
+	sort.Slice(ring.points, func(i, j int) bool { return ring.points[i] < ring.points[j] })
+	return ring
+}
+
+// walk visits the distinct nodes clockwise from the position of key until accept returns true,
+// and returns the accepted node.
+func (ring *hashRing) walk(key string, accept func(node string) bool) (string, bool) {
+	if len(ring.points) == 0 {
+		return "", false
+	}
+	h := hashKey(key)
+	start := sort.Search(len(ring.points), func(i int) bool { return ring.points[i] >= h })
+	visited := map[string]bool{}
+	for i := 0; i < len(ring.points) && len(visited) < ring.nodes; i++ {
+		node := ring.owners[ring.points[(start+i)%len(ring.points)]]
+		if visited[node] {
+			continue
+		}
+		visited[node] = true
+		if accept(node) {
+			return node, true
+		}
+	}
+	return "", false
+}
+
+// AffinityOffloader sends invocations with the same key to the same node of a
+// consistent-hash ring over the peers and this node. A node whose queue is full
+// is skipped, so that affinity gives way to capacity.
+type AffinityOffloader struct {
+	*BaseOffloader
+	params *AffinityParams
+
+	mu    sync.RWMutex
+	ring  *hashRing
+	loads map[string]cachedSnapshot
+}
+
+func NewAffinityOffloader(base *BaseOffloader, params *AffinityParams) *AffinityOffloader {
+	o := &AffinityOffloader{BaseOffloader: base, params: params, loads: map[string]cachedSnapshot{}}
+	o.Qlen_max = params.QlenMax
+	peers := []string{}
+	for _, r := range base.Routers() {
+		peers = append(peers, r.host)
+	}
+	o.UpdatePeers(peers)
+	return o
+}
+
+// UpdatePeers rebuilds the ring when peers join or leave. Keys owned by nodes
+// that did not change keep their owner.
+func (o *AffinityOffloader) UpdatePeers(peers []string) {
+	o.BaseOffloader.UpdatePeers(peers)
+	ring := newHashRing(append([]string{o.Host}, peers...), o.params.VirtualNodes)
+
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.ring = ring
+	keep := map[string]bool{}
+	for _, peer := range peers {
+		keep[peer] = true
+	}
+	for peer := range o.loads {
+		if !keep[peer] {
+			delete(o.loads, peer)
+		}
+	}
+	log.Printf("[INFO] affinity ring has %d nodes\n", ring.nodes)
+}
+
+// affinityKey extracts the key of req. The body is restored if it was read.
+func (o *AffinityOffloader) affinityKey(req *http.Request) (string, bool) {
+	if o.params.KeyHeader != "" {
+		if key := req.Header.Get(o.params.KeyHeader); key != "" {
+			return key, true
+		}
+	}
+	if o.params.KeyQuery != "" {
+		if key := req.URL.Query().Get(o.params.KeyQuery); key != "" {
+			return key, true
+		}
+	}
+	if o.params.KeyField != "" && req.Body != nil {
+		bodyBytes, _ := io.ReadAll(req.Body)
+		req.Body.Close()
+		req.Body = io.NopCloser(bytes.NewBuffer(bodyBytes))
+
+		fields := map[string]any{}
+		if err := json.Unmarshal(bodyBytes, &fields); err == nil {
+			if v, ok := fields[o.params.KeyField]; ok && v != nil {
+				return fmt.Sprint(v), true
+			}
+		}
+	}
+	return "", false
+}
+
+func (o *AffinityOffloader) full(node string) bool {
+	if node == o.Host {
+		return o.Finfo.getSnapshot().Qlen >= int(o.Qlen_max)
+	}
+	o.mu.RLock()
+	defer o.mu.RUnlock()
+	load, ok := o.loads[node]
+	if !ok || o.Clock.Since(load.ts) > time.Duration(o.params.LoadTTLMs)*time.Millisecond {
+		return false
+	}
+	return float32(load.snap.Qlen) >= o.params.PeerQlenMax
+}
+
+// owner returns the first node clockwise from key that is not full and whose
+// circuit is not open, or the host if there is none.
+func (o *AffinityOffloader) owner(key string) string {
+	o.mu.RLock()
+	ring := o.ring
+	o.mu.RUnlock()
+	node, ok := ring.walk(key, func(node string) bool { return o.Available(node) && !o.full(node) })
+	if !ok {
+		return o.Host
+	}
+	return node
+}
+
+func (o *AffinityOffloader) CheckAndEnq(req *http.Request) (*list.Element, bool) {
+	bounded := func(qlen int) bool { return qlen < int(o.Qlen_max) }
+	// offloaded invocations were routed here by the ring of a peer
+	if o.IsOffloaded(req) {
+		return o.enqIf(bounded)
+	}
+	key, ok := o.affinityKey(req)
+	if !ok {
+		return o.BaseOffloader.CheckAndEnq(req)
+	}
+	if o.owner(key) != o.Host {
+		return nil, false
+	}
+	return o.enqIf(bounded)
+}
+
+func (o *AffinityOffloader) GetOffloadCandidate(req *http.Request) string {
+	key, ok := o.affinityKey(req)
+	if !ok {
+		// without a key any node with capacity will do
+		key = strconv.Itoa(o.Rand.Int())
+	}
+	return o.owner(key)
+}
+
+func (o *AffinityOffloader) GetStatusStr() string {
+	snap := o.Finfo.getSnapshot()
+	snap.HasCapacity = snap.Qlen < int(o.Qlen_max)
+	jbytes, err := json.Marshal(snap)
+	if err != nil {
+		log.Println("[WARNING] could not marshall status: ", err)
+	}
+	return string(jbytes)
+}
+
+// PostOffloadUpdate records the load of a peer that rejected an offload. The
+// peer is considered full until load_ttl_ms passed.
+func (o *AffinityOffloader) PostOffloadUpdate(snap Snapshot, target string) {
+	if float32(snap.Qlen) < o.params.PeerQlenMax {
+		snap.Qlen = int(math.Ceil(float64(o.params.PeerQlenMax)))
+	}
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.loads[target] = cachedSnapshot{snap: snap, ts: o.Clock.Now()}
+}
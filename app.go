@@ -1,21 +1,108 @@
-package main
+package feo
 
-import "strconv"
+import (
+	"strconv"
+	"sync"
+)
 
 type Application struct {
 	offloader OffloaderIntf
 	portChan  chan string
+	backend   string
+	spec      ApplicationSpec
+	// declared applications come from the config file and are reconciled on reload
+	declared bool
+	policy   OffloadPolicy
+	params   PolicyParams
+
+	// mu guards the offloader and its policy, which can be swapped at runtime.
+	// inflight counts the requests handled by the current offloader.
+	mu       sync.RWMutex
+	inflight *sync.WaitGroup
+	// retired applications were replaced or removed and take no new requests
+	retired bool
 }
 
-func createApplication(appName string, initPortNumber, numReplicas int, offloader OffloaderIntf) *Application {
-	portChannel := make(chan string, numReplicas)
-	for i := 0; i < numReplicas; i++ {
-		portChannel <- strconv.Itoa(initPortNumber + i)
+func createApplication(spec ApplicationSpec, backend string, offloader OffloaderIntf) *Application {
+	portChannel := make(chan string, spec.NumReplicas)
+	for i := 0; i < spec.NumReplicas; i++ {
+		portChannel <- strconv.Itoa(spec.InitPort + i)
 	}
 
 	app := &Application{
 		offloader: offloader,
 		portChan:  portChannel,
+		backend:   backend,
+		spec:      spec,
+		inflight:  &sync.WaitGroup{},
 	}
 	return app
 }
+
+func (a *Application) getOffloader() OffloaderIntf {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	return a.offloader
+}
+
+// acquire returns the current offloader for a request. The request is handled by
+// this offloader until it calls release, even if the policy is swapped meanwhile.
+// The offloader is nil if the application was retired.
+func (a *Application) acquire() (OffloaderIntf, func()) {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	if a.retired {
+		return nil, func() {}
+	}
+	inflight := a.inflight
+	inflight.Add(1)
+	return a.offloader, inflight.Done
+}
+
+// swapOffloader installs a new offloader. The old one is closed once the requests it is handling finish.
+func (a *Application) swapOffloader(offloader OffloaderIntf, policy OffloadPolicy, params PolicyParams) OffloaderIntf {
+	a.mu.Lock()
+	// the application was removed meanwhile, nothing would use the new offloader
+	if a.retired {
+		a.mu.Unlock()
+		offloader.Close()
+		return nil
+	}
+	old, oldInflight := a.offloader, a.inflight
+	a.offloader = offloader
+	a.policy = policy
+	a.params = params
+	a.inflight = &sync.WaitGroup{}
+	a.mu.Unlock()
+
+	closeWhenIdle(old, oldInflight)
+	return old
+}
+
+// retire stops a replaced or removed application from taking new requests and
+// closes its offloader once the requests it is handling finish.
+func (a *Application) retire() {
+	a.mu.Lock()
+	if a.retired {
+		a.mu.Unlock()
+		return
+	}
+	a.retired = true
+	offloader, inflight := a.offloader, a.inflight
+	a.mu.Unlock()
+
+	closeWhenIdle(offloader, inflight)
+}
+
+func closeWhenIdle(offloader OffloaderIntf, inflight *sync.WaitGroup) {
+	go func() {
+		inflight.Wait()
+		offloader.Close()
+	}()
+}
+
+func (a *Application) getPolicy() (OffloadPolicy, PolicyParams) {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	return a.policy, a.params
+}
@@ -0,0 +1,269 @@
+package feo
+
+import (
+	"container/list"
+	"fmt"
+	"log"
+	"math"
+	"math/rand"
+	"net/http"
+	"sync"
+)
+
+const OffloadBandit = "bandit"
+
+const (
+	BanditUCB1     = "ucb1"
+	BanditThompson = "thompson"
+	// arms whose discounted pulls decayed below this count as untried
+	BANDIT_MIN_PULLS = 1e-3
+)
+
+func init() {
+	RegisterPolicy(PolicyRegistration{
+		Name:      OffloadBandit,
+		NewParams: func() PolicyParams { return DefaultBanditParams() },
+		New: func(base *BaseOffloader, params PolicyParams) OffloaderIntf {
+			return NewBanditOffloader(base, params.(*BanditParams))
+		},
+	})
+}
+
+type BanditParams struct {
+	// ucb1 or thompson
+	Algorithm string `yaml:"algorithm" json:"algorithm"`
+	// weight of the exploration bonus for ucb1. For thompson it widens the
+	// posterior, 1 samples from the plain Beta posterior.
+	Exploration float64 `yaml:"exploration" json:"exploration"`
+	// elapsed time that earns a reward of 0.5, rewards are scale/(scale+elapsed)
+	RewardScaleMs float64 `yaml:"reward_scale_ms" json:"reward_scale_ms"`
+	// weight kept by past rewards on every update. 1 never forgets, lower
+	// values follow changing loads.
+	Discount float64 `yaml:"discount" json:"discount"`
+	// the local arm is not pulled while the queue is this long
+	QlenMax int32 `yaml:"qlen_max" json:"qlen_max"`
+}
+
+func DefaultBanditParams() *BanditParams {
+	return &BanditParams{Algorithm: BanditUCB1, Exploration: 1.0, RewardScaleMs: 100, Discount: 1.0, QlenMax: 10}
+}
+
+func (p *BanditParams) Validate() error {
+	if p.Algorithm != BanditUCB1 && p.Algorithm != BanditThompson {
+		return fmt.Errorf("algorithm must be %s or %s, got %q", BanditUCB1, BanditThompson, p.Algorithm)
+	}
+	if p.Exploration < 0 || (p.Algorithm == BanditThompson && p.Exploration == 0) {
+		return fmt.Errorf("exploration must be positive, got %v", p.Exploration)
+	}
+	if p.RewardScaleMs <= 0 {
+		return fmt.Errorf("reward_scale_ms must be positive, got %v", p.RewardScaleMs)
+	}
+	if err := validateAlpha("discount", p.Discount); err != nil {
+		return err
+	}
+	if p.QlenMax <= 0 {
+		return fmt.Errorf("qlen_max must be positive, got %d", p.QlenMax)
+	}
+	return nil
+}
+
+// BanditArm is what the bandit learned about a peer or local execution. Pulls
+// and Reward are discounted sums.
+type BanditArm struct {
+	Pulls  float64 `json:"pulls"`
+	Reward float64 `json:"reward"`
+	Mean   float64 `json:"mean"`
+	LastMs float64 `json:"last_ms"`
+}
+
+// BanditOffloader treats local execution and every peer as the arms of a
+// multi-armed bandit. Admission pulls an arm among all of them, and runs the
+// invocation locally if the local arm wins; the offload candidate is pulled
+// among the peers only. The reward of an arm is derived from the elapsed time
+// of the invocations it ran, and a peer that rejects an offload earns nothing.
+type BanditOffloader struct {
+	*BaseOffloader
+	params *BanditParams
+
+	mu   sync.Mutex
+	arms map[string]*BanditArm
+}
+
+func NewBanditOffloader(base *BaseOffloader, params *BanditParams) *BanditOffloader {
+	o := &BanditOffloader{BaseOffloader: base, params: params, arms: map[string]*BanditArm{}}
+	o.Qlen_max = params.QlenMax
+	return o
+}
+
+// UpdatePeers forgets the arms of the peers that left.
+func (o *BanditOffloader) UpdatePeers(peers []string) {
+	o.BaseOffloader.UpdatePeers(peers)
+
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	for node := range o.arms {
+		if !o.isMember(node) {
+			delete(o.arms, node)
+		}
+	}
+}
+
+func (o *BanditOffloader) localFull() bool {
+	return o.Finfo.getSnapshot().Qlen >= int(o.Qlen_max)
+}
+
+func (o *BanditOffloader) CheckAndEnq(req *http.Request) (*list.Element, bool) {
+	bounded := func(qlen int) bool { return qlen < int(o.Qlen_max) }
+	if o.IsOffloaded(req) {
+		return o.enqIf(bounded)
+	}
+	if o.localFull() {
+		return nil, false
+	}
+	nodes := []string{o.Host}
+	for _, r := range o.Candidates() {
+		nodes = append(nodes, r.host)
+	}
+	if o.pull(nodes) != o.Host {
+		return nil, false
+	}
+	return o.enqIf(bounded)
+}
+
+func (o *BanditOffloader) GetOffloadCandidate(req *http.Request) string {
+	nodes := []string{}
+	for _, r := range o.Candidates() {
+		if r.host != o.Host {
+			nodes = append(nodes, r.host)
+		}
+	}
+	if len(nodes) == 0 {
+		return o.Host
+	}
+	return o.pull(nodes)
+}
+
+// pull picks one of nodes according to the configured algorithm.
+func (o *BanditOffloader) pull(nodes []string) string {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	// every arm is pulled once before the statistics mean anything
+	untried := []string{}
+	total := 0.0
+	for _, node := range nodes {
+		arm, ok := o.arms[node]
+		if !ok || arm.Pulls < BANDIT_MIN_PULLS {
+			untried = append(untried, node)
+			continue
+		}
+		total += arm.Pulls
+	}
+	if len(untried) != 0 {
+		return untried[o.Rand.Intn(len(untried))]
+	}
+
+	best, bestScore := nodes[0], math.Inf(-1)
+	for _, node := range nodes {
+		arm := o.arms[node]
+		var score float64
+		switch o.params.Algorithm {
+		case BanditUCB1:
+			// discounted pulls can sum to less than 1, whose log is negative
+			score = arm.Mean + o.params.Exploration*math.Sqrt(2*math.Log(math.Max(total, 1))/arm.Pulls)
+		case BanditThompson:
+			e := o.params.Exploration
+			score = sampleBeta(o.Rand, 1+arm.Reward/e, 1+(arm.Pulls-arm.Reward)/e)
+		}
+		if score > bestScore {
+			best, bestScore = node, score
+		}
+	}
+	return best
+}
+
+// observe rewards the arm of node. Every arm is discounted first.
+func (o *BanditOffloader) observe(node string, reward float64, elapsedMs float64) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if !o.isMember(node) {
+		// the peer left while the invocation ran
+		return
+	}
+	if o.params.Discount < 1 {
+		for _, arm := range o.arms {
+			arm.Pulls *= o.params.Discount
+			arm.Reward *= o.params.Discount
+		}
+	}
+	arm, ok := o.arms[node]
+	if !ok {
+		arm = &BanditArm{}
+		o.arms[node] = arm
+	}
+	arm.Pulls++
+	arm.Reward += reward
+	arm.Mean = arm.Reward / arm.Pulls
+	arm.LastMs = elapsedMs
+}
+
+func (o *BanditOffloader) MetricSMAnalyze(ctx *list.Element) {
+	o.BaseOffloader.MetricSMAnalyze(ctx)
+
+	sm := ctx.Value.(*MetricSM)
+	if !sm.finished() {
+		return
+	}
+	// local runs count whether the local arm was pulled or the offload failed,
+	// they tell the same about the local queue
+	elapsedMs := sm.elapsedMs()
+	o.observe(sm.candidate, o.params.RewardScaleMs/(o.params.RewardScaleMs+elapsedMs), elapsedMs)
+}
+
+// PostOffloadUpdate gives a peer that rejected an offload no reward.
+func (o *BanditOffloader) PostOffloadUpdate(snap Snapshot, target string) {
+	log.Printf("[DEBUG] %s rejected the offload, qlen=%d\n", target, snap.Qlen)
+	o.observe(target, 0, 0)
+}
+
+// PolicyState reports every arm, the local one as "local".
+func (o *BanditOffloader) PolicyState() any {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	arms := map[string]BanditArm{}
+	for node, arm := range o.arms {
+		if node == o.Host {
+			node = "local"
+		}
+		arms[node] = *arm
+	}
+	return map[string]any{"algorithm": o.params.Algorithm, "arms": arms}
+}
+
+// sampleBeta draws from Beta(a, b) as X/(X+Y) with X ~ Gamma(a) and Y ~ Gamma(b).
+func sampleBeta(rng *rand.Rand, a, b float64) float64 {
+	x := sampleGamma(rng, a)
+	y := sampleGamma(rng, b)
+	return x / (x + y)
+}
+
+// sampleGamma draws from Gamma(shape, 1) by Marsaglia and Tsang.
+func sampleGamma(rng *rand.Rand, shape float64) float64 {
+	if shape < 1 {
+		return sampleGamma(rng, shape+1) * math.Pow(rng.Float64(), 1/shape)
+	}
+	d := shape - 1.0/3
+	c := 1 / math.Sqrt(9*d)
+	for {
+		x := rng.NormFloat64()
+		v := 1 + c*x
+		if v <= 0 {
+			continue
+		}
+		v = v * v * v
+		u := rng.Float64()
+		if math.Log(u) < 0.5*x*x+d-d*v+d*math.Log(v) {
+			return d * v
+		}
+	}
+}
@@ -0,0 +1,55 @@
+package feo
+
+import (
+	"math"
+	"testing"
+	"time"
+)
+
+func newTestBandit(t *testing.T, discount float64) *BanditOffloader {
+	t.Helper()
+	params := DefaultBanditParams()
+	params.Discount = discount
+	if err := params.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	config := FeoConfig{Host: "local:9696", Peers: []string{"a:9696", "b:9696"}}
+	base := newBaseOffloader(config, nil, NewManualClock(time.Unix(0, 0)), NewRand(1))
+	o := NewBanditOffloader(base, params)
+	t.Cleanup(o.Close)
+	return o
+}
+
+// With discount < 1 the pulls of all arms can sum to less than 1. UCB1 must
+// still rank the arms by their means instead of scoring them NaN.
+func TestBanditUCB1DiscountedTotal(t *testing.T) {
+	o := newTestBandit(t, 0.5)
+	o.arms["a:9696"] = &BanditArm{Pulls: 0.3, Reward: 0.03, Mean: 0.1}
+	o.arms["b:9696"] = &BanditArm{Pulls: 0.4, Reward: 0.36, Mean: 0.9}
+	for i := 0; i < 10; i++ {
+		if got := o.pull([]string{"a:9696", "b:9696"}); got != "b:9696" {
+			t.Fatalf("pull picked %s, want the arm with the higher mean", got)
+		}
+	}
+}
+
+func TestBanditDecayedArmIsUntried(t *testing.T) {
+	o := newTestBandit(t, 0.5)
+	o.observe("b:9696", 1, 10)
+	// b is rewarded over and over while a decays towards 0 pulls
+	o.observe("a:9696", 0, 10)
+	for i := 0; i < 20; i++ {
+		o.observe("b:9696", 1, 10)
+	}
+	if pulls := o.arms["a:9696"].Pulls; pulls >= BANDIT_MIN_PULLS {
+		t.Fatalf("a kept %v pulls", pulls)
+	}
+	if got := o.pull([]string{"a:9696", "b:9696"}); got != "a:9696" {
+		t.Fatalf("pull picked %s, want the decayed arm to be retried", got)
+	}
+	for node, arm := range o.arms {
+		if math.IsNaN(arm.Mean) {
+			t.Fatalf("mean of %s is NaN", node)
+		}
+	}
+}
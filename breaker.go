@@ -0,0 +1,185 @@
+package feo
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const (
+	DEFAULT_BREAKER_FAILURES        = 3
+	DEFAULT_BREAKER_OPEN_MS         = 5000
+	DEFAULT_BREAKER_HALFOPEN_TRIALS = 1
+)
+
+// BreakerConfig enables a circuit breaker per peer on the offload path.
+type BreakerConfig struct {
+	Enabled bool `yaml:"enabled"`
+	// consecutive failed calls that open the circuit of a peer
+	FailureThreshold int `yaml:"failure_threshold"`
+	// how long an open circuit keeps the peer out before a trial call is let through
+	OpenMs int `yaml:"open_ms"`
+	// successful trial calls that close the circuit again
+	HalfOpenTrials int `yaml:"half_open_trials"`
+}
+
+type CircuitState string
+
+const (
+	CircuitClosed   CircuitState = "closed"
+	CircuitOpen     CircuitState = "open"
+	CircuitHalfOpen CircuitState = "half-open"
+)
+
+// Circuit is the breaker of one peer.
+type Circuit struct {
+	State CircuitState `json:"state"`
+	// consecutive failures while closed, successful trials while half-open
+	Count int       `json:"count"`
+	Since time.Time `json:"since"`
+
+	// a half-open circuit lets one trial call through at a time
+	trial bool
+}
+
+var ErrCircuitOpen = errors.New("circuit open")
+
+// Breakers keeps a circuit per peer. Calls to a peer go through Do, which
+// fails fast while the circuit is open. Policies skip peers that are not
+// Available. A nil *Breakers is valid and lets every call through, which is
+// the case when breakers are disabled.
+type Breakers struct {
+	cfg   BreakerConfig
+	clock Clock
+
+	mu       sync.Mutex
+	circuits map[string]*Circuit
+}
+
+func newBreakers(cfg BreakerConfig, clock Clock) *Breakers {
+	if cfg.FailureThreshold <= 0 {
+		cfg.FailureThreshold = DEFAULT_BREAKER_FAILURES
+	}
+	if cfg.OpenMs <= 0 {
+		cfg.OpenMs = DEFAULT_BREAKER_OPEN_MS
+	}
+	if cfg.HalfOpenTrials <= 0 {
+		cfg.HalfOpenTrials = DEFAULT_BREAKER_HALFOPEN_TRIALS
+	}
+	return &Breakers{cfg: cfg, clock: clock, circuits: map[string]*Circuit{}}
+}
+
+// circuit must be called with b.mu held. An open circuit whose open_ms passed
+// turns half-open here.
+func (b *Breakers) circuit(peer string) *Circuit {
+	c, ok := b.circuits[peer]
+	if !ok {
+		c = &Circuit{State: CircuitClosed, Since: b.clock.Now()}
+		b.circuits[peer] = c
+	}
+	if c.State == CircuitOpen && b.clock.Since(c.Since) >= time.Duration(b.cfg.OpenMs)*time.Millisecond {
+		c.State, c.Count, c.Since = CircuitHalfOpen, 0, b.clock.Now()
+		log.Printf("[INFO] circuit of %s is half-open\n", peer)
+	}
+	return c
+}
+
+// Available reports whether a call to peer would be let through.
+func (b *Breakers) Available(peer string) bool {
+	if b == nil {
+		return true
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	c := b.circuit(peer)
+	return c.State == CircuitClosed || (c.State == CircuitHalfOpen && !c.trial)
+}
+
+// allow reserves a call to peer. It must be followed by record.
+func (b *Breakers) allow(peer string) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	c := b.circuit(peer)
+	switch c.State {
+	case CircuitClosed:
+		return true
+	case CircuitHalfOpen:
+		if c.trial {
+			return false
+		}
+		c.trial = true
+		return true
+	}
+	return false
+}
+
+func (b *Breakers) record(peer string, err error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	c := b.circuit(peer)
+	wasTrial := c.trial
+	c.trial = false
+	if err == nil {
+		switch c.State {
+		case CircuitClosed:
+			c.Count = 0
+		case CircuitHalfOpen:
+			c.Count++
+			if c.Count >= b.cfg.HalfOpenTrials {
+				log.Printf("[INFO] circuit of %s is closed\n", peer)
+				c.State, c.Count, c.Since = CircuitClosed, 0, b.clock.Now()
+			}
+		}
+		return
+	}
+
+	switch {
+	case c.State == CircuitClosed:
+		c.Count++
+		if c.Count < b.cfg.FailureThreshold {
+			return
+		}
+	case c.State == CircuitHalfOpen && wasTrial:
+	default:
+		// a call that started before the circuit opened
+		return
+	}
+	log.Printf("[WARNING] circuit of %s is open: %v\n", peer, err)
+	c.State, c.Count, c.Since = CircuitOpen, 0, b.clock.Now()
+}
+
+// Do sends req to peer unless its circuit is open. Transport errors and 5xx
+// replies count as failures, rejected offloads and replies that ask for a
+// retry (RetryHeader) do not.
+func (b *Breakers) Do(client *http.Client, peer string, req *http.Request) (*http.Response, error) {
+	if b == nil {
+		return client.Do(req)
+	}
+	if !b.allow(peer) {
+		return nil, fmt.Errorf("%s: %w", peer, ErrCircuitOpen)
+	}
+	resp, err := client.Do(req)
+	if err == nil && resp.StatusCode >= http.StatusInternalServerError && resp.Header.Get(RetryHeader) == "" {
+		b.record(peer, fmt.Errorf("%s", resp.Status))
+	} else {
+		b.record(peer, err)
+	}
+	return resp, err
+}
+
+// Table returns a copy of the circuit of every peer that was called.
+func (b *Breakers) Table() map[string]Circuit {
+	if b == nil {
+		return nil
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	table := make(map[string]Circuit, len(b.circuits))
+	for peer := range b.circuits {
+		table[peer] = *b.circuit(peer)
+	}
+	return table
+}
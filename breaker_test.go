@@ -0,0 +1,58 @@
+package feo
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestBreakerOpensAndRecovers(t *testing.T) {
+	clock := NewManualClock(time.Unix(0, 0))
+	b := newBreakers(BreakerConfig{Enabled: true, FailureThreshold: 2, OpenMs: 1000, HalfOpenTrials: 1}, clock)
+	fail := errors.New("503 Service Unavailable")
+
+	for i := 0; i < 2; i++ {
+		if !b.allow("a:9696") {
+			t.Fatalf("call %d was refused by a closed circuit", i)
+		}
+		b.record("a:9696", fail)
+	}
+	if b.Available("a:9696") || b.allow("a:9696") {
+		t.Fatal("circuit must be open after failure_threshold failures")
+	}
+
+	clock.Advance(999 * time.Millisecond)
+	if b.Available("a:9696") {
+		t.Fatal("circuit must stay open for open_ms")
+	}
+	clock.Advance(time.Millisecond)
+	if !b.Available("a:9696") {
+		t.Fatal("circuit must be half-open after open_ms")
+	}
+	if !b.allow("a:9696") {
+		t.Fatal("half-open circuit must let a trial call through")
+	}
+	if b.allow("a:9696") {
+		t.Fatal("half-open circuit must let one trial call through at a time")
+	}
+	b.record("a:9696", nil)
+	if c := b.Table()["a:9696"]; c.State != CircuitClosed {
+		t.Fatalf("circuit must close after a successful trial, got %s", c.State)
+	}
+}
+
+func TestBreakerFailedTrialReopens(t *testing.T) {
+	clock := NewManualClock(time.Unix(0, 0))
+	b := newBreakers(BreakerConfig{Enabled: true, FailureThreshold: 1, OpenMs: 1000}, clock)
+
+	b.allow("a:9696")
+	b.record("a:9696", errors.New("refused"))
+	clock.Advance(time.Second)
+	if !b.allow("a:9696") {
+		t.Fatal("half-open circuit must let a trial call through")
+	}
+	b.record("a:9696", errors.New("refused"))
+	if c := b.Table()["a:9696"]; c.State != CircuitOpen || !c.Since.Equal(clock.Now()) {
+		t.Fatalf("failed trial must open the circuit again, got %+v", c)
+	}
+}
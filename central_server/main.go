@@ -0,0 +1,9 @@
+package main
+
+import (
+	"github.gatech.edu/faasedge/feo/controller"
+)
+
+func main() {
+	controller.Main()
+}
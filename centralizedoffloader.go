@@ -1,19 +1,30 @@
-package main
+package feo
 
 import (
 	"container/list"
 	"net/http"
-	"time"
 )
 
+const OffloadCentral = "central"
+
+func init() {
+	RegisterPolicy(PolicyRegistration{
+		Name:      OffloadCentral,
+		NewParams: func() PolicyParams { return DefaultHybridParams() },
+		New: func(base *BaseOffloader, params PolicyParams) OffloaderIntf {
+			return NewCentralizedOffloader(base, params.(*HybridParams))
+		},
+	})
+}
+
 type CentralizedOffloader struct {
 	*HybridOffloader
 }
 
-func NewCentralizedOffloader(base *BaseOffloader) *CentralizedOffloader {
+func NewCentralizedOffloader(base *BaseOffloader, params *HybridParams) *CentralizedOffloader {
 
 	fed := &CentralizedOffloader{}
-	fed.HybridOffloader = NewHybridOffloader(base)
+	fed.HybridOffloader = NewHybridOffloader(base, params)
 	return fed
 }
 
@@ -27,16 +38,3 @@ func (o *CentralizedOffloader) CheckAndEnq(req *http.Request) (*list.Element, bo
 	}
 	return ele, status
 }
-
-func (o *CentralizedOffloader) MetricSMAnalyze(ctx *list.Element) {
-
-	var timeElapsed time.Duration
-	if (ctx.Value.(*MetricSM).state == FinalState) && (ctx.Value.(*MetricSM).candidate != "default") {
-		if ctx.Value.(*MetricSM).local {
-			timeElapsed = ctx.Value.(*MetricSM).postLocal.Sub(ctx.Value.(*MetricSM).preLocal)
-		} else {
-			timeElapsed = ctx.Value.(*MetricSM).postOffload.Sub(ctx.Value.(*MetricSM).preOffload)
-		}
-		ctx.Value.(*MetricSM).elapsed = timeElapsed
-	}
-}
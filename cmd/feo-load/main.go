@@ -0,0 +1,10 @@
+// feo-load sends open-loop load to feo nodes, see feo.LoadMain.
+package main
+
+import (
+	"github.gatech.edu/faasedge/feo"
+)
+
+func main() {
+	feo.LoadMain()
+}
@@ -0,0 +1,10 @@
+// feo-sim runs the offload policies against a simulated cluster, see feo.SimMain.
+package main
+
+import (
+	"github.gatech.edu/faasedge/feo"
+)
+
+func main() {
+	feo.SimMain()
+}
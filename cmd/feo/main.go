@@ -0,0 +1,10 @@
+// Based on documentation at https://pkg.go.dev/net/http#ListenAndServe
+package main
+
+import (
+	"github.gatech.edu/faasedge/feo"
+)
+
+func main() {
+	feo.Main()
+}
@@ -0,0 +1,174 @@
+package feo
+
+import (
+	"container/list"
+	"fmt"
+	"net/http"
+)
+
+const OffloadComposed = "composed"
+
+func init() {
+	RegisterPolicy(PolicyRegistration{
+		Name:      OffloadComposed,
+		NewParams: func() PolicyParams { return DefaultComposedParams() },
+		New: func(base *BaseOffloader, params PolicyParams) OffloaderIntf {
+			return NewComposedOffloader(base, params.(*ComposedParams))
+		},
+	})
+}
+
+// ComposedParams picks the stages of the composed policy, e.g.
+//
+//	policy:
+//	  name: "composed"
+//	  config:
+//	    admission: "predicted_wait"
+//	    selector: "latency"
+//	    feedback: ["latency"]
+//	    max_wait_ms: 200
+//
+// The remaining fields are read by the stages that need them.
+type ComposedParams struct {
+	Admission string   `yaml:"admission" json:"admission"`
+	Selector  string   `yaml:"selector" json:"selector"`
+	Feedback  []string `yaml:"feedback" json:"feedback"`
+
+	QlenMax int32 `yaml:"qlen_max" json:"qlen_max"`
+	// weighted: peers whose last known qlen exceeds this are not offloaded to
+	PeerQlenMax float32 `yaml:"peer_qlen_max" json:"peer_qlen_max"`
+	// predicted_wait: invocations predicted to wait longer than this are offloaded
+	MaxWaitMs float64 `yaml:"max_wait_ms" json:"max_wait_ms"`
+	// latency: weight of the latest latency sample in the EWMA
+	Alpha float64 `yaml:"alpha" json:"alpha"`
+	// controller: period of the state updates sent to the controller
+	GapMs int `yaml:"gap_ms" json:"gap_ms"`
+}
+
+// DefaultComposedParams behaves like the federated policy.
+func DefaultComposedParams() *ComposedParams {
+	return &ComposedParams{
+		Admission:   AdmitHistoricQlen,
+		Selector:    SelectWeighted,
+		Feedback:    []string{FeedbackQlen},
+		QlenMax:     10,
+		PeerQlenMax: 10,
+		MaxWaitMs:   500,
+		Alpha:       0.2,
+		GapMs:       1000,
+	}
+}
+
+func (p *ComposedParams) Validate() error {
+	if p.QlenMax <= 0 {
+		return fmt.Errorf("qlen_max must be positive, got %d", p.QlenMax)
+	}
+	if p.PeerQlenMax <= 0 {
+		return fmt.Errorf("peer_qlen_max must be positive, got %v", p.PeerQlenMax)
+	}
+	if p.MaxWaitMs <= 0 {
+		return fmt.Errorf("max_wait_ms must be positive, got %v", p.MaxWaitMs)
+	}
+	if p.GapMs <= 0 {
+		return fmt.Errorf("gap_ms must be positive, got %d", p.GapMs)
+	}
+	if err := validateAlpha("alpha", p.Alpha); err != nil {
+		return err
+	}
+
+	feedback := map[string]bool{}
+	for _, name := range p.Feedback {
+		if _, err := feedbackStages.lookup(name); err != nil {
+			return err
+		}
+		if feedback[name] {
+			return fmt.Errorf("feedback stage %s listed twice", name)
+		}
+		feedback[name] = true
+	}
+	admission, err := admissionStages.lookup(p.Admission)
+	if err != nil {
+		return err
+	}
+	selector, err := selectorStages.lookup(p.Selector)
+	if err != nil {
+		return err
+	}
+	for stage, requires := range map[string]string{"admission " + admission.Name: admission.Requires, "selector " + selector.Name: selector.Requires} {
+		if requires != "" && !feedback[requires] {
+			return fmt.Errorf("%s needs the %s feedback", stage, requires)
+		}
+	}
+	return nil
+}
+
+// ComposedOffloader runs the admission, selection and feedback stages named
+// in its ComposedParams.
+type ComposedOffloader struct {
+	*BaseOffloader
+	params    *ComposedParams
+	stats     *PeerStats
+	admission AdmissionStage
+	selector  CandidateSelector
+	feedback  []FeedbackUpdater
+}
+
+func NewComposedOffloader(base *BaseOffloader, params *ComposedParams) *ComposedOffloader {
+	o := &ComposedOffloader{BaseOffloader: base, params: params, stats: newPeerStats(params.Alpha)}
+	o.Qlen_max = params.QlenMax
+
+	// the names were checked by Validate
+	admission, _ := admissionStages.lookup(params.Admission)
+	o.admission = admission.New(base, params, o.stats)
+	selector, _ := selectorStages.lookup(params.Selector)
+	o.selector = selector.New(base, params, o.stats)
+	for _, name := range params.Feedback {
+		feedback, _ := feedbackStages.lookup(name)
+		o.feedback = append(o.feedback, feedback.New(base, params, o.stats))
+	}
+	return o
+}
+
+func (o *ComposedOffloader) CheckAndEnq(req *http.Request) (*list.Element, bool) {
+	if r, ok := o.selector.(interface{ recordInvocation() }); ok {
+		r.recordInvocation()
+	}
+	return o.admission.Admit(o.BaseOffloader, req)
+}
+
+func (o *ComposedOffloader) GetOffloadCandidate(req *http.Request) string {
+	return o.selector.Select(o.BaseOffloader, req)
+}
+
+func (o *ComposedOffloader) PostOffloadUpdate(snap Snapshot, target string) {
+	for _, f := range o.feedback {
+		f.PostOffloadUpdate(snap, target)
+	}
+}
+
+func (o *ComposedOffloader) MetricSMAnalyze(ctx *list.Element) {
+	o.BaseOffloader.MetricSMAnalyze(ctx)
+
+	sm := ctx.Value.(*MetricSM)
+	if !sm.finished() {
+		return
+	}
+	s := Sample{Candidate: sm.candidate, Elapsed: sm.elapsed, Local: sm.local, Chosen: sm.chosen()}
+	for _, f := range o.feedback {
+		f.Observe(o.BaseOffloader, s)
+	}
+}
+
+func (o *ComposedOffloader) Close() {
+	for _, stage := range []any{o.admission, o.selector} {
+		if c, ok := stage.(interface{ Close() }); ok {
+			c.Close()
+		}
+	}
+	for _, f := range o.feedback {
+		if c, ok := f.(interface{ Close() }); ok {
+			c.Close()
+		}
+	}
+	o.BaseOffloader.Close()
+}
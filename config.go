@@ -1,12 +1,75 @@
-package main
+package feo
+
+import (
+	"os"
+
+	"gopkg.in/yaml.v3"
+)
+
+type PolicyConfig struct {
+	Name   string          `yaml:"name" json:"name"`
+	Config RawPolicyParams `yaml:"config" json:"config,omitempty"`
+}
+
+type ApplicationLimits struct {
+	// MaxQlen overrides the queue length threshold, which defaults to the number of replicas.
+	MaxQlen int32 `yaml:"max_qlen" json:"max_qlen,omitempty"`
+	// SloMs is the latency target of an invocation, end to end. 0 means none.
+	SloMs int `yaml:"slo_ms" json:"slo_ms,omitempty"`
+}
+
+// ApplicationSpec describes an application, either declared in the config file
+// or registered over HTTP.
+type ApplicationSpec struct {
+	Name string `yaml:"name" json:"name"`
+	// Backend is the host running the replicas. Defaults to the feo host.
+	Backend     string `yaml:"backend" json:"backend,omitempty"`
+	InitPort    int    `yaml:"init_port" json:"init_port"`
+	NumReplicas int    `yaml:"num_replicas" json:"num_replicas"`
+	// Policy overrides the node-wide policy for this application.
+	Policy *PolicyConfig     `yaml:"policy" json:"policy,omitempty"`
+	Limits ApplicationLimits `yaml:"limits" json:"limits"`
+	// Qlen picks how queue lengths are smoothed. Defaults to EWMAs.
+	Qlen QlenConfig `yaml:"qlen" json:"qlen,omitempty"`
+}
+
+type DagConfig struct {
+	// Manifest is the path to a DAG manifest, relative to the config file.
+	Manifest string `yaml:"manifest"`
+}
 
 type FeoConfig struct {
-	Controller string `yaml:"controller"`
-	Scheme     string `yaml:"scheme"`
-	Host       string `yaml:"host"`
-	Policy     struct {
-		Name   string `yaml:"name"`
-		Config string `yaml:"config"`
-	} `yaml:"policy"`
-	Peers []string `yaml:"peers"`
+	Controller string       `yaml:"controller"`
+	Scheme     string       `yaml:"scheme"`
+	Host       string       `yaml:"host"`
+	Policy     PolicyConfig `yaml:"policy"`
+	Peers      []string     `yaml:"peers"`
+	// DataDir keeps registrations and offloader state across restarts. Nothing is persisted if empty.
+	DataDir string `yaml:"data_dir"`
+	Steal   struct {
+		Enabled    bool `yaml:"enabled"`
+		IntervalMs int  `yaml:"interval_ms"`
+	} `yaml:"steal"`
+	Probe       ProbeConfig       `yaml:"probe"`
+	Gossip      GossipConfig      `yaml:"gossip"`
+	Membership  MembershipConfig  `yaml:"membership"`
+	Breaker     BreakerConfig     `yaml:"breaker"`
+	Tiering     TieringConfig     `yaml:"tiering"`
+	DecisionLog DecisionLogConfig `yaml:"decision_log"`
+	// Costs of running on every node, keyed by host
+	Costs        map[string]NodeCost `yaml:"costs"`
+	Applications []ApplicationSpec   `yaml:"applications"`
+	Dags         []DagConfig         `yaml:"dags"`
+	// Seed makes the random choices of the policies reproducible, 0 seeds from the clock
+	Seed int64 `yaml:"seed"`
+}
+
+func loadConfig(path string) (FeoConfig, error) {
+	var config FeoConfig
+	f, err := os.ReadFile(path)
+	if err != nil {
+		return config, err
+	}
+	err = yaml.Unmarshal(f, &config)
+	return config, err
 }
@@ -1,4 +1,6 @@
-package main
+// Package controller is the central state hub of the hybrid, epoch and
+// centralized policies. The central_server command runs it.
+package controller
 
 import (
 	"context"
@@ -13,14 +15,11 @@ import (
 	"google.golang.org/grpc"
 )
 
-var (
-	port = flag.Int("port", 50051, "The server port")
-)
-
 const (
 	//10 seconds old data is pruned from invocation history
-	HISTORY_WINDOW = 10 * 1e9  // unit : ns
-	FNSVCTIME      = 0.1 * 1e9 // unit : ns
+	HISTORY_WINDOW = 10 * 1e9 // unit : ns
+	// assumed until the node reports a measured service time
+	FNSVCTIME = 0.1 * 1e9 // unit : ns
 )
 
 // server is used to implement helloworld.GreeterServer.
@@ -28,7 +27,7 @@ type NodeInfo struct {
 	nodename       string
 	fname          string
 	qlen           float32
-	f_svctime      int64
+	svc            *pb.ServiceTime
 	invoke_history []int64
 	qlen_ctr       []int
 }
@@ -36,7 +35,6 @@ type NodeInfo struct {
 func NewNodeInfo(nodename, fname string) NodeInfo {
 
 	ni := NodeInfo{nodename: nodename, fname: fname}
-	ni.f_svctime = FNSVCTIME
 	ni.invoke_history = []int64{}
 	ni.qlen_ctr = []int{}
 	return ni
@@ -75,6 +73,23 @@ type server struct {
 // 	return qlen
 // }
 
+// update_svctime keeps the service time the node measured, which GetState
+// hands to the other nodes.
+func (ni *NodeInfo) update_svctime(svc *pb.ServiceTime) {
+	if svc.GetSamples() == 0 {
+		return
+	}
+	ni.svc = svc
+}
+
+// svctime is the measured service time in ns, FNSVCTIME until there is one.
+func (ni *NodeInfo) svctime() int64 {
+	if ni.svc.GetSamples() == 0 {
+		return FNSVCTIME
+	}
+	return int64(float64(ni.svc.GetEwmaMs()) * 1e6)
+}
+
 func (ni *NodeInfo) update_history(new_invoke_history []int64) {
 
 	// prune older than HISTORY_WINDOW data points
@@ -98,8 +113,9 @@ func (ni *NodeInfo) update_history(new_invoke_history []int64) {
 	cur := len(ni.invoke_history)
 	ni.invoke_history = append(ni.invoke_history, new_invoke_history...)
 
+	svctime := ni.svctime()
 	for start = cur; start > 0; start-- {
-		if ni.invoke_history[cur]-ni.invoke_history[start] > ni.f_svctime {
+		if ni.invoke_history[cur]-ni.invoke_history[start] > svctime {
 			start++
 			break
 		}
@@ -109,7 +125,7 @@ func (ni *NodeInfo) update_history(new_invoke_history []int64) {
 	for ; cur < len(ni.invoke_history); cur++ {
 
 		for ; start <= cur; start++ {
-			if ni.invoke_history[cur]-ni.invoke_history[start] <= ni.f_svctime {
+			if ni.invoke_history[cur]-ni.invoke_history[start] <= svctime {
 				break
 			} else {
 				ctr--
@@ -145,10 +161,11 @@ func (s *server) UpdateState(ctx context.Context, in *pb.NodeState) (*pb.UpdateS
 	if ok {
 		//val.update_history(finfo.InvokeHistory)
 		val.qlen = finfo.Qlen
-		s.nodemap[nodename] = val
 	} else {
-		s.nodemap[nodename] = NewNodeInfo(nodename, finfo.FunctionName)
+		val = NewNodeInfo(nodename, finfo.FunctionName)
 	}
+	val.update_svctime(finfo.GetSvcTime())
+	s.nodemap[nodename] = val
 
 	return &pb.UpdateStateResponse{Success: true}, nil
 }
@@ -160,7 +177,7 @@ func (s *server) GetState(ctx context.Context, in *pb.StateQuery) (*pb.StateResp
 
 	for node, info := range s.nodemap {
 		ni := &pb.NodeState{}
-		ni.FinfoList = []*pb.FunctionInfo{{FunctionName: info.fname, Qlen: info.qlen}}
+		ni.FinfoList = []*pb.FunctionInfo{{FunctionName: info.fname, Qlen: info.qlen, SvcTime: info.svc}}
 		ni.Name = node
 
 		resp.Nodes = append(resp.Nodes, ni)
@@ -190,14 +207,21 @@ func (s *server) GetCandidate(ctx context.Context, in *pb.CandidateQuery) (*pb.C
 	return resp, nil
 }
 
-func main() {
+// Register adds a new controller to s.
+func Register(s *grpc.Server) {
+	pb.RegisterOffloadStateHubServer(s, &server{nodemap: make(map[string]NodeInfo)})
+}
+
+// Main runs the controller on the port given by the -port flag.
+func Main() {
+	var port = flag.Int("port", 50051, "The server port")
 	flag.Parse()
 	lis, err := net.Listen("tcp", fmt.Sprintf(":%d", *port))
 	if err != nil {
 		log.Fatalf("failed to listen: %v", err)
 	}
 	s := grpc.NewServer()
-	pb.RegisterOffloadStateHubServer(s, &server{nodemap: make(map[string]NodeInfo)})
+	Register(s)
 	log.Printf("server listening at %v", lis.Addr())
 	if err := s.Serve(lis); err != nil {
 		log.Fatalf("failed to serve: %v", err)
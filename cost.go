@@ -0,0 +1,88 @@
+package feo
+
+import (
+	"fmt"
+	"time"
+)
+
+// NodeCost is what running an invocation on a node costs, and how much the
+// node can run. Nodes are keyed by host in FeoConfig.Costs, this host
+// included; nodes without an entry are free and have a capacity of 1.
+type NodeCost struct {
+	PerInvocation float64 `yaml:"per_invocation" json:"per_invocation"`
+	// billed for the elapsed time of the invocation, as seen by the node it arrived at
+	PerSecond float64 `yaml:"per_second" json:"per_second"`
+	// Capacity weighs the replicas of the node against the ones of this node,
+	// 2 runs twice as many invocations at once. 0 means 1.
+	Capacity float64 `yaml:"capacity" json:"capacity"`
+}
+
+func (c NodeCost) capacity() float64 {
+	if c.Capacity <= 0 {
+		return 1
+	}
+	return c.Capacity
+}
+
+// invocationCost is the cost of an invocation that took d.
+func (c NodeCost) invocationCost(d time.Duration) float64 {
+	return c.PerInvocation + c.PerSecond*d.Seconds()
+}
+
+func validateCosts(costs map[string]NodeCost) error {
+	for host, c := range costs {
+		if c.PerInvocation < 0 || c.PerSecond < 0 || c.Capacity < 0 {
+			return fmt.Errorf("costs of %s must not be negative", host)
+		}
+	}
+	return nil
+}
+
+// Cost returns the cost of running on node.
+func (o *BaseOffloader) Cost(node string) NodeCost {
+	return o.config.Costs[node]
+}
+
+// CostStats is what the invocations of an application that arrived at this node cost.
+type CostStats struct {
+	Total       float64 `json:"total"`
+	Invocations int64   `json:"invocations"`
+	// cost of the invocations that ran on every node
+	Nodes map[string]float64 `json:"nodes"`
+}
+
+// costAccount sums up the cost of an application. The zero value is ready to use.
+type costAccount struct {
+	stats CostStats
+}
+
+func (a *costAccount) add(node string, cost float64) {
+	if a.stats.Nodes == nil {
+		a.stats.Nodes = map[string]float64{}
+	}
+	a.stats.Total += cost
+	a.stats.Invocations++
+	a.stats.Nodes[node] += cost
+}
+
+func (a *costAccount) get() CostStats {
+	stats := a.stats
+	stats.Nodes = map[string]float64{}
+	for node, cost := range a.stats.Nodes {
+		stats.Nodes[node] = cost
+	}
+	return stats
+}
+
+// accountCost charges the invocation of sm to the node that ran it.
+// Invocations offloaded here are accounted at the node they arrived at.
+func (o *BaseOffloader) accountCost(sm *MetricSM) {
+	if sm.forwarded {
+		return
+	}
+	node := o.Host
+	if !sm.local {
+		node = sm.candidate
+	}
+	o.Finfo.addCost(node, o.Cost(node).invocationCost(sm.elapsed))
+}
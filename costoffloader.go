@@ -0,0 +1,162 @@
+package feo
+
+import (
+	"container/list"
+	"fmt"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const OffloadCost = "cost"
+
+func init() {
+	RegisterPolicy(PolicyRegistration{
+		Name:      OffloadCost,
+		NewParams: func() PolicyParams { return DefaultCostParams() },
+		New: func(base *BaseOffloader, params PolicyParams) OffloaderIntf {
+			return NewCostOffloader(base, params.(*CostParams))
+		},
+	})
+}
+
+type CostParams struct {
+	PredictorParams `yaml:",inline"`
+	// latency an invocation may take at most, 0 for the slo_ms of the
+	// application. Without either the cheapest node always wins.
+	LatencyBoundMs int `yaml:"latency_bound_ms" json:"latency_bound_ms"`
+}
+
+func DefaultCostParams() *CostParams {
+	return &CostParams{PredictorParams: DefaultPredictorParams()}
+}
+
+func (p *CostParams) Validate() error {
+	if p.LatencyBoundMs < 0 {
+		return fmt.Errorf("latency_bound_ms must not be negative, got %d", p.LatencyBoundMs)
+	}
+	return p.PredictorParams.Validate()
+}
+
+// CostDecisions counts where the cost policy sent invocations, and how often
+// no node was predicted to meet the bound.
+type CostDecisions struct {
+	BoundMs int              `json:"bound_ms"`
+	Nodes   map[string]int64 `json:"nodes"`
+	Missed  int64            `json:"missed"`
+}
+
+// CostOffloader runs every invocation on the cheapest node, this one included,
+// that is predicted to complete it within the latency bound. If no node is,
+// it picks the one predicted to complete it first. Nodes cost what is
+// configured in FeoConfig.Costs, see predictor for how completion is predicted.
+type CostOffloader struct {
+	*BaseOffloader
+	params *CostParams
+	pred   *predictor
+
+	mu        sync.Mutex
+	decisions CostDecisions
+}
+
+func NewCostOffloader(base *BaseOffloader, params *CostParams) *CostOffloader {
+	o := &CostOffloader{BaseOffloader: base, params: params}
+	o.Qlen_max = params.QlenMax
+	o.pred = newPredictor(base, params.PredictorParams)
+	o.decisions = CostDecisions{BoundMs: o.bound(), Nodes: map[string]int64{}}
+	return o
+}
+
+// bound is the latency bound of the policy, or the SLO of the application.
+func (o *CostOffloader) bound() int {
+	if o.params.LatencyBoundMs > 0 {
+		return o.params.LatencyBoundMs
+	}
+	return o.SloMs
+}
+
+// choose returns the node req should run on, considering this node only if
+// local is set, and whether it is predicted to meet the bound. It returns ""
+// if no node's load is known.
+func (o *CostOffloader) choose(req *http.Request, local bool) (string, bool) {
+	predictions := map[string]float64{}
+	if local {
+		predictions[o.Host] = o.pred.completionMs(o.Host, o.Finfo.getSnapshot())
+	}
+	for peer, snap := range o.pred.peerSnapshots(req) {
+		predictions[peer] = o.pred.completionMs(peer, snap) + o.pred.networkMs(peer, req)
+	}
+
+	bound := float64(o.bound())
+	cheapest, cheapestCost, fastest := "", 0.0, ""
+	// ties go to the first node by name
+	for _, node := range sortedNodes(predictions) {
+		ms := predictions[node]
+		if fastest == "" || ms < predictions[fastest] {
+			fastest = node
+		}
+		if bound > 0 && ms > bound {
+			continue
+		}
+		// billed for the predicted completion, like accountCost bills the elapsed time
+		cost := o.Cost(node).invocationCost(time.Duration(ms * float64(time.Millisecond)))
+		if cheapest == "" || cost < cheapestCost || (cost == cheapestCost && ms < predictions[cheapest]) {
+			cheapest, cheapestCost = node, cost
+		}
+	}
+	log.Printf("[DEBUG] predicted %v, bound %.0fms, cheapest %q\n", predictions, bound, cheapest)
+	if cheapest == "" {
+		return fastest, false
+	}
+	return cheapest, true
+}
+
+// record counts that an invocation was sent to node.
+func (o *CostOffloader) record(node string, met bool) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.decisions.Nodes[node]++
+	if !met {
+		o.decisions.Missed++
+	}
+}
+
+func (o *CostOffloader) CheckAndEnq(req *http.Request) (*list.Element, bool) {
+	if o.IsOffloaded(req) {
+		return o.enqIf(func(qlen int) bool { return qlen < int(o.Qlen_max) })
+	}
+	// offloaded invocations are recorded once GetOffloadCandidate picked the peer
+	node, met := o.choose(req, true)
+	if node != o.Host {
+		return nil, false
+	}
+	o.record(node, met)
+	return o.enqIf(func(qlen int) bool { return true })
+}
+
+func (o *CostOffloader) GetOffloadCandidate(req *http.Request) string {
+	peer, met := o.choose(req, false)
+	if peer == "" {
+		return o.Host
+	}
+	o.record(peer, met)
+	return peer
+}
+
+// PostOffloadUpdate caches the snapshot piggybacked on an offload reply.
+func (o *CostOffloader) PostOffloadUpdate(snap Snapshot, target string) {
+	o.pred.snapshots.put(target, snap)
+}
+
+// PolicyState reports where invocations were sent.
+func (o *CostOffloader) PolicyState() any {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	decisions := o.decisions
+	decisions.Nodes = map[string]int64{}
+	for node, n := range o.decisions.Nodes {
+		decisions.Nodes[node] = n
+	}
+	return decisions
+}
@@ -1,4 +1,4 @@
-package main
+package feo
 
 import (
 	"bytes"
@@ -119,11 +119,9 @@ func (d *FaasEdgeDag) TraverseDag(rootID string, w http.ResponseWriter, req *htt
 		resp, err := client.Do(invokeReq)
 		if err != nil {
 			log.Printf("looped request for vertex %s returned error: %s", vertexID, err.Error())
-			panic(nil)
 			return nil, fmt.Errorf("looped request for vertex %s returned error: %s", vertexID, err.Error())
 		} else if resp.StatusCode != http.StatusOK {
 			log.Printf("bad http response for vertex %s %d", vertexID, resp.StatusCode)
-			panic(nil)
 			return nil, fmt.Errorf("bad http response for vertex %s %d", vertexID, resp.StatusCode)
 		}
 
@@ -137,7 +135,9 @@ func (d *FaasEdgeDag) TraverseDag(rootID string, w http.ResponseWriter, req *htt
 			return nil, fmt.Errorf("Cannot create io.Reader from functionOutput for %s", vertexID)
 		}
 
-		// Set execution time
+		// Set execution time. Header keys are canonicalized, so the vertex ID
+		// also goes in a value.
+		w.Header().Set(fmt.Sprintf("Invoc-Vertex-%s", vertexID), vertexID)
 		invocTime := resp.Header.Get("Invoc-Time")
 		w.Header().Set(fmt.Sprintf("Invoc-Time-%s", vertexID), invocTime)
 		invocLoc := resp.Header.Get("Invoc-Loc")
@@ -0,0 +1,258 @@
+package feo
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	DEFAULT_DECISIONLOG_PATH   = "decisions.jsonl"
+	DEFAULT_DECISIONLOG_MAX_MB = 64
+	DEFAULT_DECISIONLOG_FILES  = 5
+	DEFAULT_DECISIONLOG_BUFFER = 4096
+)
+
+// DecisionLogConfig enables the decision log, which records why every
+// invocation ran where it did as one JSON line.
+type DecisionLogConfig struct {
+	Enabled bool   `yaml:"enabled"`
+	Path    string `yaml:"path"`
+	// the file is rotated to path.1, path.2, ... once it is this large
+	MaxSizeMB int `yaml:"max_size_mb"`
+	// rotated files that are kept
+	MaxFiles int `yaml:"max_files"`
+	// records waiting to be written; records are dropped while it is full
+	BufferSize int `yaml:"buffer_size"`
+}
+
+// DecisionAttempt is one offload of an invocation.
+type DecisionAttempt struct {
+	Peer string `json:"peer"`
+	Tier string `json:"tier"`
+	// accepted, rejected or failed
+	Outcome string `json:"outcome"`
+	// queue length the peer reported with its reply
+	PeerQlen int     `json:"peer_qlen"`
+	Ms       float64 `json:"ms"`
+}
+
+// Decision records why an invocation ran where it did.
+type Decision struct {
+	Ts     time.Time     `json:"ts"`
+	App    string        `json:"app"`
+	Policy OffloadPolicy `json:"policy"`
+	// the invocation was offloaded here, or stolen from a peer
+	Forwarded bool `json:"forwarded"`
+	Stolen    bool `json:"stolen"`
+	// load when the invocation was admitted, or not
+	Qlen         int     `json:"qlen"`
+	HistoricQlen float32 `json:"historic_qlen"`
+	Admitted     bool    `json:"admitted"`
+	// what the policy knew once it decided, if it reports it
+	Internals any               `json:"internals,omitempty"`
+	Attempts  []DecisionAttempt `json:"attempts"`
+	// node the invocation ran on
+	Candidate string `json:"candidate"`
+	// local, offload, stolen, rejected or error
+	Location string `json:"location"`
+	// when the MetricSM reached every state
+	States    map[MetricSMState]time.Time `json:"states"`
+	ElapsedMs float64                     `json:"elapsed_ms"`
+}
+
+// The methods of a nil *Decision do nothing, so the handler can call them
+// whether the decision log is enabled or not.
+
+func (d *Decision) admit(snap Snapshot, admitted bool) {
+	if d == nil {
+		return
+	}
+	d.Qlen, d.HistoricQlen, d.Admitted = snap.Qlen, snap.HistoricQlen, admitted
+}
+
+func (d *Decision) explain(offloader OffloaderIntf) {
+	if d == nil {
+		return
+	}
+	if reporter, ok := offloader.(PolicyStateReporter); ok {
+		d.Internals = reporter.PolicyState()
+	}
+}
+
+func (d *Decision) attempt(peer string, tier string, outcome string, peerQlen int, took time.Duration) {
+	if d == nil {
+		return
+	}
+	d.Attempts = append(d.Attempts, DecisionAttempt{Peer: peer, Tier: tier, Outcome: outcome, PeerQlen: peerQlen, Ms: float64(took.Microseconds()) / 1000})
+}
+
+func (d *Decision) locate(location string) {
+	if d == nil {
+		return
+	}
+	d.Location = location
+}
+
+// DecisionLog writes decisions to a rotating file in the background. A nil
+// *DecisionLog is valid and drops every decision, which is the case when the
+// decision log is disabled.
+type DecisionLog struct {
+	cfg     DecisionLogConfig
+	records chan *Decision
+	quit    chan bool
+	done    chan bool
+	dropped atomic.Int64
+
+	f    *os.File
+	w    *bufio.Writer
+	size int64
+}
+
+func newDecisionLog(cfg DecisionLogConfig) (*DecisionLog, error) {
+	if cfg.Path == "" {
+		cfg.Path = DEFAULT_DECISIONLOG_PATH
+	}
+	if cfg.MaxSizeMB <= 0 {
+		cfg.MaxSizeMB = DEFAULT_DECISIONLOG_MAX_MB
+	}
+	if cfg.MaxFiles <= 0 {
+		cfg.MaxFiles = DEFAULT_DECISIONLOG_FILES
+	}
+	if cfg.BufferSize <= 0 {
+		cfg.BufferSize = DEFAULT_DECISIONLOG_BUFFER
+	}
+	l := &DecisionLog{cfg: cfg, records: make(chan *Decision, cfg.BufferSize), quit: make(chan bool), done: make(chan bool)}
+	if err := l.open(); err != nil {
+		return nil, fmt.Errorf("decision log: %w", err)
+	}
+	return l, nil
+}
+
+func (l *DecisionLog) start() {
+	go l.writeRoutine()
+}
+
+// Close writes the decisions still queued and closes the file.
+func (l *DecisionLog) Close() {
+	if l == nil {
+		return
+	}
+	close(l.quit)
+	<-l.done
+}
+
+// begin starts the decision of an invocation of app.
+func (l *DecisionLog) begin(app string, policy OffloadPolicy, forwarded bool, stolen bool) *Decision {
+	if l == nil {
+		return nil
+	}
+	return &Decision{Ts: time.Now(), App: app, Policy: policy, Forwarded: forwarded, Stolen: stolen, Attempts: []DecisionAttempt{}}
+}
+
+// finish completes d with the MetricSM of its invocation and queues it. It
+// never blocks the invocation, d is dropped if the queue is full.
+func (l *DecisionLog) finish(d *Decision, sm *MetricSM) {
+	if l == nil || d == nil {
+		return
+	}
+	if sm.candidate != "default" {
+		d.Candidate = sm.candidate
+	}
+	if d.Location == "" {
+		d.Location = "error"
+	}
+	d.States = map[MetricSMState]time.Time{}
+	for state, ts := range map[MetricSMState]time.Time{
+		InitState: sm.init, PreOffloadSearchState: sm.preOffloadSearch, OffloadSearchState: sm.offloadSearch,
+		PreOffloadState: sm.preOffload, PostOffloadState: sm.postOffload, PreLocalState: sm.preLocal,
+		PostLocalState: sm.postLocal, FinalState: sm.final,
+	} {
+		if !ts.IsZero() {
+			d.States[state] = ts
+		}
+	}
+	d.ElapsedMs = float64(sm.elapsed.Microseconds()) / 1000
+
+	select {
+	case <-l.quit:
+	case l.records <- d:
+	default:
+		if n := l.dropped.Add(1); n&(n-1) == 0 {
+			log.Printf("[WARNING] decision log is full, dropped %d decisions\n", n)
+		}
+	}
+}
+
+func (l *DecisionLog) open() error {
+	f, err := os.OpenFile(l.cfg.Path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		return err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	l.f, l.w, l.size = f, bufio.NewWriter(f), info.Size()
+	return nil
+}
+
+// rotate moves path to path.1, path.1 to path.2 and so on, dropping the
+// oldest file, and starts a new path.
+func (l *DecisionLog) rotate() error {
+	l.w.Flush()
+	l.f.Close()
+	for i := l.cfg.MaxFiles - 1; i >= 1; i-- {
+		os.Rename(fmt.Sprintf("%s.%d", l.cfg.Path, i), fmt.Sprintf("%s.%d", l.cfg.Path, i+1))
+	}
+	renameErr := os.Rename(l.cfg.Path, l.cfg.Path+".1")
+	if err := l.open(); err != nil {
+		return err
+	}
+	return renameErr
+}
+
+func (l *DecisionLog) write(d *Decision) {
+	line, err := json.Marshal(d)
+	if err != nil {
+		log.Printf("[WARNING] could not marshal decision: %v\n", err)
+		return
+	}
+	if l.size+int64(len(line))+1 > int64(l.cfg.MaxSizeMB)<<20 && l.size > 0 {
+		if err := l.rotate(); err != nil {
+			log.Printf("[WARNING] could not rotate decision log: %v\n", err)
+		}
+	}
+	n, _ := l.w.Write(append(line, '\n'))
+	l.size += int64(n)
+}
+
+func (l *DecisionLog) writeRoutine() {
+	defer close(l.done)
+	for {
+		select {
+		case <-l.quit:
+			for {
+				select {
+				case d := <-l.records:
+					l.write(d)
+				default:
+					l.w.Flush()
+					l.f.Close()
+					return
+				}
+			}
+		case d := <-l.records:
+			l.write(d)
+			// flush once the queue is drained, so bursts are written together
+			if len(l.records) == 0 {
+				l.w.Flush()
+			}
+		}
+	}
+}
@@ -1,4 +1,4 @@
-package main
+package feo
 
 import (
 	"container/list"
@@ -14,6 +14,43 @@ import (
 	"google.golang.org/grpc/credentials/insecure"
 )
 
+const OffloadEpoch = "epoch"
+
+func init() {
+	RegisterPolicy(PolicyRegistration{
+		Name:      OffloadEpoch,
+		NewParams: func() PolicyParams { return DefaultEpochParams() },
+		New: func(base *BaseOffloader, params PolicyParams) OffloaderIntf {
+			return NewEpochOffloader(base, params.(*EpochParams))
+		},
+	})
+}
+
+type EpochParams struct {
+	QlenMax int32 `yaml:"qlen_max" json:"qlen_max"`
+	// period of the state updates sent to the controller
+	GapMs int `yaml:"gap_ms" json:"gap_ms"`
+	// period of the cluster state syncs from the controller
+	EpochMs int `yaml:"epoch_ms" json:"epoch_ms"`
+}
+
+func DefaultEpochParams() *EpochParams {
+	return &EpochParams{QlenMax: 5, GapMs: 1000, EpochMs: 2000}
+}
+
+func (p *EpochParams) Validate() error {
+	if p.QlenMax <= 0 {
+		return fmt.Errorf("qlen_max must be positive, got %d", p.QlenMax)
+	}
+	if p.GapMs <= 0 {
+		return fmt.Errorf("gap_ms must be positive, got %d", p.GapMs)
+	}
+	if p.EpochMs <= 0 {
+		return fmt.Errorf("epoch_ms must be positive, got %d", p.EpochMs)
+	}
+	return nil
+}
+
 type EpochOffloader struct {
 	*BaseOffloader
 	quit           chan bool
@@ -27,19 +64,22 @@ type EpochOffloader struct {
 	//TODO: update after statemachine is updated
 	invocation_history []int64
 	qlen               float32
+	qlenEst            QlenEstimator
 	qlenMu             sync.RWMutex
 	iHistoryMu         sync.Mutex
 	nodemap            map[string]float32
+	nodemapMu          sync.RWMutex
 }
 
-func NewEpochOffloader(base *BaseOffloader) *EpochOffloader {
+func NewEpochOffloader(base *BaseOffloader, params *EpochParams) *EpochOffloader {
 	fed := &EpochOffloader{BaseOffloader: base}
-	fed.Qlen_max = 5
-	fed.gap_ms = 1000
-	fed.epoch_ms = 2000
+	fed.Qlen_max = params.QlenMax
+	fed.gap_ms = params.GapMs
+	fed.epoch_ms = params.EpochMs
 	fed.quit = make(chan bool)
 	fed.ControllerAddr = fed.config.Controller
 	fed.nodemap = make(map[string]float32)
+	fed.qlenEst = newQlenEstimator(base.ControllerQlen, DefaultControllerQlen)
 
 	//setup connection with controller
 	var err error
@@ -57,7 +97,7 @@ func NewEpochOffloader(base *BaseOffloader) *EpochOffloader {
 func (o *EpochOffloader) CheckAndEnq(req *http.Request) (*list.Element, bool) {
 	//NOTE: only happens at the receive of a request
 	o.iHistoryMu.Lock()
-	o.invocation_history = append(o.invocation_history, int64(time.Now().UnixNano()))
+	o.invocation_history = append(o.invocation_history, o.Clock.Now().UnixNano())
 	o.iHistoryMu.Unlock()
 
 	ele, status := o.BaseOffloader.CheckAndEnq(req)
@@ -71,7 +111,8 @@ func (o *EpochOffloader) update_qlen() {
 	cur_qlen := o.Finfo.getSnapshot().Qlen
 
 	o.qlenMu.Lock()
-	o.qlen = 0.2*o.qlen + 0.8*float32(cur_qlen)
+	o.qlenEst.Observe(float64(cur_qlen), o.Clock.Now())
+	o.qlen = float32(o.qlenEst.Estimate())
 	o.qlenMu.Unlock()
 }
 
@@ -84,8 +125,11 @@ func (o *EpochOffloader) sync_state() {
 	r, err := o.client.GetState(ctx, req)
 	if err != nil {
 		log.Println("[WARNING] coud not sync state", err)
+		return
 	}
 
+	o.nodemapMu.Lock()
+	defer o.nodemapMu.Unlock()
 	for _, ni := range r.Nodes {
 		o.nodemap[ni.Name] = ni.FinfoList[0].Qlen
 	}
@@ -98,7 +142,7 @@ func (o *EpochOffloader) buildAndSendReq() {
 	defer cancel()
 	req := &pb.NodeState{Name: o.Host}
 
-	fi := &pb.FunctionInfo{FunctionName: o.Finfo.name}
+	fi := &pb.FunctionInfo{FunctionName: o.Finfo.getName()}
 
 	o.iHistoryMu.Lock()
 	fi.InvokeHistory = make([]int64, len(o.invocation_history))
@@ -110,6 +154,7 @@ func (o *EpochOffloader) buildAndSendReq() {
 	o.qlenMu.RLock()
 	fi.Qlen = o.qlen
 	o.qlenMu.RUnlock()
+	fi.SvcTime = o.ServiceTime().Proto()
 
 	//TODO: multi-function supported does not exist as of yet
 	req.FinfoList = append(req.FinfoList, fi)
@@ -126,20 +171,23 @@ func (o *EpochOffloader) buildAndSendReq() {
 func (o *EpochOffloader) stateUpdateRoutine() {
 	defer o.wg.Done()
 
-	send_timer := time.NewTicker(time.Duration(o.gap_ms) * time.Millisecond)
-	qlen_timer := time.NewTicker(time.Duration(100) * time.Millisecond)
-	epoch_timer := time.NewTicker(time.Duration(o.epoch_ms) * time.Millisecond)
+	send_timer := o.Clock.NewTicker(time.Duration(o.gap_ms) * time.Millisecond)
+	qlen_timer := o.Clock.NewTicker(time.Duration(100) * time.Millisecond)
+	epoch_timer := o.Clock.NewTicker(time.Duration(o.epoch_ms) * time.Millisecond)
+	defer send_timer.Stop()
+	defer qlen_timer.Stop()
+	defer epoch_timer.Stop()
 	for {
 		select {
 		case <-o.quit:
 			return
-		case <-send_timer.C:
+		case <-send_timer.C():
 			o.wg.Add(1)
 			go o.buildAndSendReq()
-		case <-qlen_timer.C:
+		case <-qlen_timer.C():
 			o.wg.Add(1)
 			go o.update_qlen()
-		case <-epoch_timer.C:
+		case <-epoch_timer.C():
 			o.wg.Add(1)
 			go o.sync_state()
 		}
@@ -150,32 +198,26 @@ func (o *EpochOffloader) Close() {
 	o.conn.Close()
 	close(o.quit)
 	o.wg.Wait()
+	o.BaseOffloader.Close()
 }
 
 func (o *EpochOffloader) GetOffloadCandidate(req *http.Request) string {
 	minv := float32(10000)
 	var candidate string
 	var state string
+	o.nodemapMu.RLock()
 	for k, v := range o.nodemap {
 		state += fmt.Sprintf("(%s,%f),", k, v)
-		if v < minv {
+		if v < minv && o.isMember(k) && o.Available(k) {
 			candidate = k
 			minv = v
 		}
 	}
+	o.nodemapMu.RUnlock()
 	log.Println("[DEBUG] lstate: ", state)
-	return candidate
-}
-
-func (o *EpochOffloader) MetricSMAnalyze(ctx *list.Element) {
-
-	var timeElapsed time.Duration
-	if (ctx.Value.(*MetricSM).state == FinalState) && (ctx.Value.(*MetricSM).candidate != "default") {
-		if ctx.Value.(*MetricSM).local {
-			timeElapsed = ctx.Value.(*MetricSM).postLocal.Sub(ctx.Value.(*MetricSM).preLocal)
-		} else {
-			timeElapsed = ctx.Value.(*MetricSM).postOffload.Sub(ctx.Value.(*MetricSM).preOffload)
-		}
-		ctx.Value.(*MetricSM).elapsed = timeElapsed
+	// every peer is unknown, gone or has an open circuit
+	if candidate == "" {
+		return o.Host
 	}
+	return candidate
 }
@@ -0,0 +1,45 @@
+package feo
+
+import (
+	"encoding/json"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// Events are notable changes at runtime, such as policy switches. They are
+// logged as JSON with an [EVENT] prefix and, if a data directory is configured,
+// appended to <data_dir>/events.jsonl for later analysis.
+type Event struct {
+	Ts     time.Time      `json:"ts"`
+	Host   string         `json:"host"`
+	Kind   string         `json:"kind"`
+	Fields map[string]any `json:"fields"`
+}
+
+var eventMu sync.Mutex
+
+func (r *requestHandler) logEvent(kind string, fields map[string]any) {
+	ev := Event{Ts: time.Now(), Host: r.host, Kind: kind, Fields: fields}
+	data, err := json.Marshal(ev)
+	if err != nil {
+		log.Println("[WARNING] could not marshal event: ", err)
+		return
+	}
+	log.Printf("[EVENT] %s", data)
+
+	if r.store == nil {
+		return
+	}
+	eventMu.Lock()
+	defer eventMu.Unlock()
+	f, err := os.OpenFile(filepath.Join(r.store.dir, "events.jsonl"), os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		log.Println("[WARNING] could not open event log: ", err)
+		return
+	}
+	defer f.Close()
+	f.Write(append(data, '\n'))
+}
@@ -1,38 +1,63 @@
-package main
+package feo
 
 import (
 	"container/list"
 	"encoding/json"
+	"fmt"
 	"log"
 	"net/http"
 	"sync"
-	"time"
-
-	"github.com/mroth/weightedrand"
 )
 
-type QListInfo struct {
-	ts  time.Time
-	len int
+const OffloadFederated = "federated"
+
+func init() {
+	RegisterPolicy(PolicyRegistration{
+		Name:      OffloadFederated,
+		NewParams: func() PolicyParams { return DefaultFederatedParams() },
+		New: func(base *BaseOffloader, params PolicyParams) OffloaderIntf {
+			return NewFederatedOffloader(base, params.(*FederatedParams))
+		},
+	})
+}
+
+type FederatedParams struct {
+	QlenMax int32 `yaml:"qlen_max" json:"qlen_max"`
+	// peers whose last known qlen exceeds this are not offloaded to
+	PeerQlenMax float32 `yaml:"peer_qlen_max" json:"peer_qlen_max"`
+}
+
+func DefaultFederatedParams() *FederatedParams {
+	return &FederatedParams{QlenMax: 10, PeerQlenMax: 10}
+}
+
+func (p *FederatedParams) Validate() error {
+	if p.QlenMax <= 0 {
+		return fmt.Errorf("qlen_max must be positive, got %d", p.QlenMax)
+	}
+	if p.PeerQlenMax <= 0 {
+		return fmt.Errorf("peer_qlen_max must be positive, got %v", p.PeerQlenMax)
+	}
+	return nil
 }
 
 type FederatedOffloader struct {
 	*BaseOffloader
 	cur_idx int
+	params  *FederatedParams
 
 	qlenMap map[string]float32
 	mapMu   sync.Mutex
 	// wg              sync.WaitGroup
 	// quit            chan bool
-	// qlens_over_time []QListInfo
 }
 
-func NewFederatedOffloader(base *BaseOffloader) *FederatedOffloader {
-	fed := &FederatedOffloader{cur_idx: 0, BaseOffloader: base}
-	fed.Qlen_max = 10
+func NewFederatedOffloader(base *BaseOffloader, params *FederatedParams) *FederatedOffloader {
+	fed := &FederatedOffloader{cur_idx: 0, BaseOffloader: base, params: params}
+	fed.Qlen_max = params.QlenMax
 	log.Println("[DEBUG] qlen_max = ", fed.Qlen_max)
 	fed.qlenMap = make(map[string]float32)
-	for _, r := range fed.RouterList {
+	for _, r := range fed.Routers() {
 		fed.qlenMap[r.host] = 0
 	}
 
@@ -47,52 +72,36 @@ func (o *FederatedOffloader) CheckAndEnq(req *http.Request) (*list.Element, bool
 	o.Finfo.mu.Lock()
 	defer o.Finfo.mu.Unlock()
 
-	instantaneous_qlen := o.Finfo.invoke_list.Len()
 	historic_qlen := o.Finfo.historic_qlen
 
 	// appname := extractEntityName(req)
 	// log.Printf("[DEBUG ] %s Instantaneous qlen: %f, historic qlen: %f\n", appname, instantaneous_qlen, historic_qlen)
 
-	cur_time := time.Now()
+	cur_time := o.Clock.Now()
 
-	o.qlen_info_chan <- QListInfo{cur_time, instantaneous_qlen + 1}
 	if historic_qlen < float32(o.Qlen_max) {
-		return o.Finfo.invoke_list.PushBack(cur_time), true
+		return o.Finfo.invoke_list.PushBack(newInvocation(cur_time)), true
 	} else {
 		return nil, false
 	}
 }
 
 func (o *FederatedOffloader) GetOffloadCandidate(req *http.Request) string {
-	var candidate string
-	candidate = o.Host
-
-	wts := []weightedrand.Choice{}
 	o.mapMu.Lock()
+	qlens := make(map[string]float32, len(o.qlenMap))
 	for node, node_qlen := range o.qlenMap {
-		if node == o.Host {
-			continue
+		if o.Available(node) {
+			qlens[node] = node_qlen
 		}
-		if node_qlen > 10 {
-			continue
-		}
-		// the randomized pickers expects nonnegative ints. So bound it to [0,1000]
-		wt := 1000 - uint(node_qlen*100)
-		wts = append(wts, weightedrand.NewChoice(node, wt))
 	}
 	o.mapMu.Unlock()
-	chooser, err := weightedrand.NewChooser(wts...)
-	if err != nil {
-		log.Println("Unable to select chooser: ", err)
-		return candidate
+	// gossiped qlens are fresher than the ones learned from rejected offloads
+	for node, node_qlen := range o.Gossip.Qlens(extractEntityName(req)) {
+		if _, ok := qlens[node]; ok {
+			qlens[node] = node_qlen
+		}
 	}
-	candidate = chooser.Pick().(string)
-	return candidate
-}
-
-func (o *FederatedOffloader) Close() {
-	close(o.quit)
-	o.wg.Wait()
+	return pickByQlen(o.Rand, o.Host, qlens, o.params.PeerQlenMax)
 }
 
 func (o *FederatedOffloader) GetStatusStr() string {
@@ -117,15 +126,49 @@ func (o *FederatedOffloader) PostOffloadUpdate(snap Snapshot, target string) {
 	o.qlenMap[target] = float32(snap.Qlen)
 }
 
-func (o *FederatedOffloader) MetricSMAnalyze(ctx *list.Element) {
+// UpdatePeers starts new peers with an empty queue and forgets the ones that left.
+func (o *FederatedOffloader) UpdatePeers(peers []string) {
+	o.BaseOffloader.UpdatePeers(peers)
+
+	o.mapMu.Lock()
+	defer o.mapMu.Unlock()
+	qlenMap := make(map[string]float32)
+	for _, node := range peers {
+		qlenMap[node] = o.qlenMap[node]
+	}
+	o.qlenMap = qlenMap
+}
+
+func (o *FederatedOffloader) SaveState() ([]byte, error) {
+	o.mapMu.Lock()
+	defer o.mapMu.Unlock()
+	return json.Marshal(o.qlenMap)
+}
 
-	var timeElapsed time.Duration
-	if (ctx.Value.(*MetricSM).state == FinalState) && (ctx.Value.(*MetricSM).candidate != "default") {
-		if ctx.Value.(*MetricSM).local {
-			timeElapsed = ctx.Value.(*MetricSM).postLocal.Sub(ctx.Value.(*MetricSM).preLocal)
-		} else {
-			timeElapsed = ctx.Value.(*MetricSM).postOffload.Sub(ctx.Value.(*MetricSM).preOffload)
+// PolicyState reports the qlens learned from rejected offloads.
+func (o *FederatedOffloader) PolicyState() any {
+	o.mapMu.Lock()
+	defer o.mapMu.Unlock()
+	qlens := make(map[string]float32, len(o.qlenMap))
+	for node, qlen := range o.qlenMap {
+		qlens[node] = qlen
+	}
+	return map[string]any{"qlenMap": qlens}
+}
+
+func (o *FederatedOffloader) LoadState(data []byte) error {
+	qlenMap := map[string]float32{}
+	if err := json.Unmarshal(data, &qlenMap); err != nil {
+		return fmt.Errorf("federated state: %w", err)
+	}
+
+	o.mapMu.Lock()
+	defer o.mapMu.Unlock()
+	// only keep entries for peers that are still configured
+	for node := range o.qlenMap {
+		if qlen, ok := qlenMap[node]; ok {
+			o.qlenMap[node] = qlen
 		}
-		ctx.Value.(*MetricSM).elapsed = timeElapsed
 	}
+	return nil
 }
@@ -3,6 +3,7 @@ module github.gatech.edu/faasedge/feo
 go 1.21.1
 
 require (
+	github.com/heimdalr/dag v1.4.0
 	github.com/montanaflynn/stats v0.7.1
 	google.golang.org/grpc v1.59.0
 	google.golang.org/protobuf v1.31.0
@@ -11,7 +12,6 @@ require (
 require (
 	github.com/emirpasic/gods v1.18.1 // indirect
 	github.com/google/uuid v1.5.0 // indirect
-	github.com/heimdalr/dag v1.4.0 // indirect
 )
 
 require (
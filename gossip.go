@@ -0,0 +1,251 @@
+package feo
+
+import (
+	"bytes"
+	"encoding/json"
+	"log"
+	"math/rand"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const (
+	DEFAULT_GOSSIP_INTERVAL_MS = 500
+	DEFAULT_GOSSIP_FANOUT      = 2
+)
+
+// GossipConfig enables the exchange of load digests between peers, which gives
+// every node a view of the cluster without a controller.
+type GossipConfig struct {
+	Enabled    bool `yaml:"enabled"`
+	IntervalMs int  `yaml:"interval_ms"`
+	// number of random peers contacted per round
+	Fanout int `yaml:"fanout"`
+	// digests not refreshed for this long are ignored, defaults to 5 rounds
+	MaxAgeMs int `yaml:"max_age_ms"`
+}
+
+// NodeDigest is the load of a node as gossiped. Version is increased by the
+// node on every round, so the newer of two digests always wins.
+type NodeDigest struct {
+	Host    string              `json:"host"`
+	Version uint64              `json:"version"`
+	Apps    map[string]Snapshot `json:"apps"`
+
+	// when this node last saw a newer version, not gossiped
+	received time.Time
+}
+
+// Gossiper keeps a versioned view of the load of every node. Each round it
+// refreshes its own digest and exchanges the whole view with Fanout random
+// peers, push-pull, through the gossip endpoint. A nil *Gossiper is valid and
+// has an empty view, which is the case when gossip is disabled.
+type Gossiper struct {
+	host   string
+	cfg    GossipConfig
+	client http.Client
+	// peers and snapshots are read from the handler every round
+	peers     func() []string
+	snapshots func() map[string]Snapshot
+	// rng picks the peers of a round
+	rng *rand.Rand
+
+	mu      sync.RWMutex
+	version uint64
+	view    map[string]NodeDigest
+
+	quit chan bool
+	wg   sync.WaitGroup
+}
+
+func newGossiper(cfg GossipConfig, host string, peers func() []string, snapshots func() map[string]Snapshot, rng *rand.Rand) *Gossiper {
+	if cfg.IntervalMs <= 0 {
+		cfg.IntervalMs = DEFAULT_GOSSIP_INTERVAL_MS
+	}
+	if cfg.Fanout <= 0 {
+		cfg.Fanout = DEFAULT_GOSSIP_FANOUT
+	}
+	if cfg.MaxAgeMs <= 0 {
+		cfg.MaxAgeMs = 5 * cfg.IntervalMs
+	}
+	g := &Gossiper{host: host, cfg: cfg, peers: peers, snapshots: snapshots, view: map[string]NodeDigest{}, quit: make(chan bool), rng: rng}
+	g.client = http.Client{Timeout: time.Duration(cfg.IntervalMs) * time.Millisecond}
+	// versions start at the boot time, so digests of a restarted node replace the old ones
+	g.version = uint64(time.Now().UnixNano())
+	return g
+}
+
+func (g *Gossiper) start() {
+	log.Printf("[INFO] Gossiping with %d peers every %dms\n", g.cfg.Fanout, g.cfg.IntervalMs)
+	g.wg.Add(1)
+	go g.gossipRoutine()
+}
+
+func (g *Gossiper) Close() {
+	if g == nil {
+		return
+	}
+	close(g.quit)
+	g.wg.Wait()
+}
+
+// Qlens returns the queue length of app on every other node whose digest is fresh.
+func (g *Gossiper) Qlens(app string) map[string]float32 {
+	qlens := map[string]float32{}
+	for host, snap := range g.Snapshots(app) {
+		qlens[host] = float32(snap.Qlen)
+	}
+	return qlens
+}
+
+// Snapshots returns the snapshot of app on every other node whose digest is fresh.
+func (g *Gossiper) Snapshots(app string) map[string]Snapshot {
+	if g == nil {
+		return nil
+	}
+	g.mu.RLock()
+	defer g.mu.RUnlock()
+	snaps := map[string]Snapshot{}
+	for host, d := range g.view {
+		if host == g.host || !g.fresh(d) {
+			continue
+		}
+		if snap, ok := d.Apps[app]; ok {
+			snaps[host] = snap
+		}
+	}
+	return snaps
+}
+
+// View returns a copy of the fresh digests, including the one of this node.
+func (g *Gossiper) View() map[string]NodeDigest {
+	if g == nil {
+		return nil
+	}
+	g.mu.RLock()
+	defer g.mu.RUnlock()
+	view := map[string]NodeDigest{}
+	for host, d := range g.view {
+		if g.fresh(d) {
+			view[host] = d
+		}
+	}
+	return view
+}
+
+// fresh must be called with g.mu held.
+func (g *Gossiper) fresh(d NodeDigest) bool {
+	return time.Since(d.received) <= time.Duration(g.cfg.MaxAgeMs)*time.Millisecond
+}
+
+// merge keeps the newer of the known and the received digest of every node and
+// returns the whole view.
+func (g *Gossiper) merge(digests []NodeDigest) []NodeDigest {
+	now := time.Now()
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	for _, d := range digests {
+		if d.Host == g.host {
+			continue
+		}
+		if known, ok := g.view[d.Host]; ok && known.Version >= d.Version {
+			continue
+		}
+		d.received = now
+		g.view[d.Host] = d
+	}
+
+	all := make([]NodeDigest, 0, len(g.view))
+	for _, d := range g.view {
+		if g.fresh(d) {
+			all = append(all, d)
+		}
+	}
+	return all
+}
+
+func (g *Gossiper) gossipRoutine() {
+	defer g.wg.Done()
+
+	gossip_timer := time.NewTicker(time.Duration(g.cfg.IntervalMs) * time.Millisecond)
+	defer gossip_timer.Stop()
+	for {
+		select {
+		case <-g.quit:
+			return
+		case <-gossip_timer.C:
+			g.round()
+		}
+	}
+}
+
+func (g *Gossiper) round() {
+	apps := g.snapshots()
+	g.mu.Lock()
+	g.version++
+	g.view[g.host] = NodeDigest{Host: g.host, Version: g.version, Apps: apps, received: time.Now()}
+	g.mu.Unlock()
+
+	peers := []string{}
+	for _, peer := range g.peers() {
+		if peer != g.host {
+			peers = append(peers, peer)
+		}
+	}
+	g.rng.Shuffle(len(peers), func(i, j int) { peers[i], peers[j] = peers[j], peers[i] })
+	if len(peers) > g.cfg.Fanout {
+		peers = peers[:g.cfg.Fanout]
+	}
+	for _, peer := range peers {
+		if err := g.exchange(peer); err != nil {
+			log.Printf("[DEBUG] gossip with %s failed: %v\n", peer, err)
+		}
+	}
+}
+
+// exchange pushes the view to peer and merges the view it replies with.
+func (g *Gossiper) exchange(peer string) error {
+	body, err := json.Marshal(g.merge(nil))
+	if err != nil {
+		return err
+	}
+	resp, err := g.client.Post("http://"+peer+"/api/v1/namespaces/guest/gossip", "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	digests := []NodeDigest{}
+	if err := json.NewDecoder(resp.Body).Decode(&digests); err != nil {
+		return err
+	}
+	g.merge(digests)
+	return nil
+}
+
+// handleGossipRequest merges the digests of a peer and replies with this node's view.
+func (r *requestHandler) handleGossipRequest(w http.ResponseWriter, req *http.Request) {
+	if r.gossip == nil {
+		http.Error(w, "gossip is disabled", http.StatusNotFound)
+		return
+	}
+	digests := []NodeDigest{}
+	if err := json.NewDecoder(req.Body).Decode(&digests); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(r.gossip.merge(digests))
+}
+
+// localSnapshots is the digest of this node.
+func (r *requestHandler) localSnapshots() map[string]Snapshot {
+	snaps := map[string]Snapshot{}
+	for appName, app := range r.getApplications() {
+		snap := app.getOffloader().GetSnapshot(nil)
+		snap.Name = appName
+		snaps[appName] = snap
+	}
+	return snaps
+}
@@ -0,0 +1,803 @@
+// Package feo implements the FaaS edge orchestrator: a per-node proxy that runs
+// function invocations on local replicas or offloads them to peer nodes.
+package feo
+
+import (
+	"bytes"
+	"container/list"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"math/rand"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"syscall"
+
+	"flag"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+const RETRY_MAX = 1
+
+// TODO: This assumes that feo's endpoint is fixed. A better parser/http framework is needed to avoid this hardcode
+func extractEntityName(req *http.Request) string {
+	return strings.Split(req.URL.Path, "/")[6]
+}
+
+type requestHandler struct {
+	host string
+	// offloader 		OffloaderIntf
+	config         FeoConfig
+	dagMap         map[string]*FaasEdgeDag
+	applicationMap map[string]*Application
+	appMu          sync.RWMutex
+	dagMu          sync.RWMutex
+	store          *registryStore
+	configPath     string
+	// manifests of the DAGs declared in the config file, keyed by DAG name
+	declaredDags map[string][]byte
+	// prober, gossip, membership, breakers and the decision log are nil unless enabled
+	prober      *Prober
+	gossip      *Gossiper
+	membership  *Membership
+	breakers    *Breakers
+	decisionLog *DecisionLog
+	// clock and rng are shared by the offloaders of all applications, the
+	// breakers and the gossiper
+	clock Clock
+	rng   *rand.Rand
+	// client sends offloads and invocations of local replicas over transport,
+	// nil for http.DefaultTransport
+	client    *http.Client
+	transport http.RoundTripper
+	// quit stops the background routines
+	quit chan bool
+	// peers replaces config.Peers, which can change on reload or as members
+	// join, leave and fail
+	peers   []string
+	peersMu sync.RWMutex
+}
+
+func (r *requestHandler) getPeers() []string {
+	r.peersMu.RLock()
+	defer r.peersMu.RUnlock()
+	return append([]string{}, r.peers...)
+}
+
+// setPeers changes the peer set of the node and of every offloader that follows it.
+func (r *requestHandler) setPeers(peers []string) {
+	r.peersMu.Lock()
+	r.peers = append([]string{}, peers...)
+	r.peersMu.Unlock()
+
+	r.prober.SetPeers(peers)
+	for _, app := range r.getApplications() {
+		app.getOffloader().UpdatePeers(peers)
+	}
+	log.Printf("[INFO] peers changed to %v\n", peers)
+}
+
+var local, offload atomic.Int32
+
+// stolenOut counts invocations taken over by idle peers, stolenIn the ones this node took over.
+var stolenOut, stolenIn atomic.Int32
+
+func (o *requestHandler) createProxyReq(originalReq *http.Request, target string, isOffload bool, port string) *http.Request {
+	ODMN_PORT := "9696"
+	// FAAS_PORT := "3233"
+	FAAS_PORT := port
+
+	var newHost string
+	ip := strings.Split(target, ":")[0]
+
+	if isOffload {
+		// peers are configured as host:port, only fall back to the default port when it is missing
+		newHost = target
+		if !strings.Contains(target, ":") {
+			newHost = ip + ":" + ODMN_PORT
+		}
+	} else {
+		newHost = ip + ":" + FAAS_PORT
+	}
+	log.Println("[INFO] created Proxy newHost", newHost)
+
+	url := url.URL{
+		Scheme:   "http",
+		Host:     newHost,
+		Path:     originalReq.URL.Path,
+		RawQuery: originalReq.URL.RawQuery,
+	}
+
+	//NOTE: why do this? Because you can only read the body once, therefore you read it completely and store it in a buffer and repopulate the req body. source: https://stackoverflow.com/questions/43021058/golang-read-request-body-multiple-times
+
+	bodyBytes, _ := io.ReadAll(originalReq.Body)
+	newBody := bytes.NewBuffer(bodyBytes)
+	originalReq.Body.Close() //  must close
+	originalReq.Body = io.NopCloser(bytes.NewBuffer(bodyBytes))
+
+	upstreamReq, err := http.NewRequest(originalReq.Method, url.String(), newBody)
+	upstreamReq.Header = originalReq.Header.Clone()
+	upstreamReq.Header.Set("Content-Length", strconv.Itoa(len(bodyBytes)))
+	upstreamReq.Header.Add("Transfer-Encoding", "identity")
+	upstreamReq.TransferEncoding = []string{"identity"}
+	upstreamReq.ContentLength = originalReq.ContentLength
+
+	if isOffload {
+		upstreamReq.Header.Set("X-Offloaded-For", o.host)
+	}
+
+	if err != nil {
+		//should not happen
+		return nil
+	}
+
+	return upstreamReq
+}
+
+// offloadTo offloads req to candidate. It returns the reply of candidate and
+// whether it accepted the invocation; the reply is nil if the request failed.
+func (r *requestHandler) offloadTo(req *http.Request, offloader OffloaderIntf, metricCtx *list.Element, candidate string) (*http.Response, bool) {
+	decision := metricCtx.Value.(*MetricSM).decision
+	tier := r.config.Tiering.tierOf(candidate)
+	proxyReq := r.createProxyReq(req, candidate, true, "0" /*Doesn't matter in the case of offload*/)
+	offloader.MetricSMAdvance(metricCtx, MetricSMState("PREOFFLOAD"), candidate)
+	start := time.Now()
+	resp, err := r.breakers.Do(r.client, candidate, proxyReq)
+	if err != nil {
+		log.Println("[WARN] offload http request failed: ", err)
+		decision.attempt(candidate, tier, "failed", 0, time.Since(start))
+		return nil, false
+	}
+	success, _ := strconv.ParseBool(resp.Header.Get(OffloadSuccess))
+	jstr := resp.Header.Get(NodeStatus)
+	log.Println("[DEBUG] Successful Offload Request: ", resp.StatusCode, jstr)
+	snap := Snapshot{}
+	// feo always sends its snapshot, error pages and other servers do not
+	if err := json.Unmarshal([]byte(jstr), &snap); err != nil {
+		log.Printf("[WARNING] offload to %s returned %s without a valid node snapshot\n", candidate, resp.Status)
+		resp.Body.Close()
+		decision.attempt(candidate, tier, "failed", 0, time.Since(start))
+		return nil, false
+	}
+	if success {
+		log.Println("[DEBUG] Successful offload execution")
+		offloader.MetricSMAdvance(metricCtx, MetricSMState("POSTOFFLOAD"))
+		decision.attempt(candidate, tier, "accepted", snap.Qlen, time.Since(start))
+		return resp, true
+	}
+	log.Println("[DEBUG] failed offload execution")
+	decision.attempt(candidate, tier, "rejected", snap.Qlen, time.Since(start))
+	resp.Body.Close()
+	offloader.PostOffloadUpdate(snap, candidate)
+	return resp, false
+}
+
+func (r *requestHandler) getApplication(appName string) (*Application, bool) {
+	r.appMu.RLock()
+	defer r.appMu.RUnlock()
+	app, ok := r.applicationMap[appName]
+	return app, ok
+}
+
+// getApplications returns a copy of the application map that is safe to iterate.
+func (r *requestHandler) getApplications() map[string]*Application {
+	r.appMu.RLock()
+	defer r.appMu.RUnlock()
+	apps := make(map[string]*Application, len(r.applicationMap))
+	for name, app := range r.applicationMap {
+		apps[name] = app
+	}
+	return apps
+}
+
+func (r *requestHandler) handleRegisterActionRequest(w http.ResponseWriter, req *http.Request) {
+	// curl -X PUT 'http://localhost:9696/api/v1/namespaces/guest/actions/test?initPort=9000&numReplicas=10'
+	// The policy can be chosen per action, with its parameters as a YAML or JSON body:
+	// curl -X PUT 'http://localhost:9696/api/v1/namespaces/guest/actions/test?initPort=9000&numReplicas=10&policy=impedence' -d '{"alpha": 0.3}'
+	// A latency target in ms can be set with sloMs=500, the qlen estimators with
+	// historicQlen=holt and controllerQlen=percentile.
+	appName := strings.Split(req.URL.Path, "/")[6]
+	log.Printf("Handle register request for %s", appName)
+	if appName == "" {
+		http.Error(w, fmt.Sprintf("appName not present in URL Path: %q", req.URL.Path), http.StatusBadRequest)
+		return
+	}
+
+	queryParams := req.URL.Query()
+	initPortNumberStr := queryParams.Get("initPort")
+	initPortNumber, err := strconv.Atoi(initPortNumberStr)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("initPort %q is not a valid integer", initPortNumberStr), http.StatusBadRequest)
+		return
+	}
+
+	numReplicasStr := queryParams.Get("numReplicas")
+	numReplicas, err := strconv.Atoi(numReplicasStr)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("numReplicas %q is not a valid integer", numReplicasStr), http.StatusBadRequest)
+		return
+	}
+
+	spec := ApplicationSpec{Name: appName, InitPort: initPortNumber, NumReplicas: numReplicas}
+	if sloStr := queryParams.Get("sloMs"); sloStr != "" {
+		if spec.Limits.SloMs, err = strconv.Atoi(sloStr); err != nil {
+			http.Error(w, fmt.Sprintf("sloMs %q is not a valid integer", sloStr), http.StatusBadRequest)
+			return
+		}
+	}
+	spec.Qlen.Historic.Kind = queryParams.Get("historicQlen")
+	spec.Qlen.Controller.Kind = queryParams.Get("controllerQlen")
+	if policyName := queryParams.Get("policy"); policyName != "" {
+		spec.Policy = &PolicyConfig{Name: policyName}
+		body, err := io.ReadAll(req.Body)
+		if err != nil {
+			http.Error(w, "Failed to read request body", http.StatusInternalServerError)
+			return
+		}
+		if err := yaml.Unmarshal(body, &spec.Policy.Config); err != nil {
+			http.Error(w, fmt.Sprintf("Invalid policy parameters: %s", err.Error()), http.StatusBadRequest)
+			return
+		}
+	}
+
+	if err := r.registerApplication(spec, false); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := r.store.SaveAction(spec); err != nil {
+		log.Printf("[WARNING] could not persist application %s: %v", appName, err)
+	}
+}
+
+// createOffloader builds the offloader of an application. finfo is the queue of
+// the offloader being replaced, or nil for a new application.
+func (r *requestHandler) createOffloader(spec ApplicationSpec, policyConfig PolicyConfig, finfo *FunctionInfo) (OffloaderIntf, PolicyParams, error) {
+	policy := OffloadPolicy(policyConfig.Name)
+	params, err := LoadPolicyParams(policy, policyConfig.Config)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if err := spec.Qlen.Validate(); err != nil {
+		return nil, nil, err
+	}
+
+	config := r.config
+	config.Peers = r.getPeers()
+	if finfo == nil {
+		finfo = newFunctionInfo(newQlenEstimator(spec.Qlen.Historic, DefaultHistoricQlen))
+	}
+	base := newBaseOffloader(config, finfo, r.clock, r.rng)
+	base.Prober = r.prober
+	base.Gossip = r.gossip
+	base.Breakers = r.breakers
+	base.Replicas = spec.NumReplicas
+	base.SloMs = spec.Limits.SloMs
+	base.ControllerQlen = spec.Qlen.Controller
+	base.Transport = r.transport
+	offloader, err := newOffloader(spec, policyConfig, params, base)
+	if err != nil {
+		return nil, nil, err
+	}
+	return offloader, params, nil
+}
+
+// newOffloader builds the policy of an application on base, whose node-level
+// services are set, and applies the queue length limits of spec.
+func newOffloader(spec ApplicationSpec, policyConfig PolicyConfig, params PolicyParams, base *BaseOffloader) (OffloaderIntf, error) {
+	policy := OffloadPolicy(policyConfig.Name)
+	offloader, err := OffloadFactory(policy, params, base)
+	if err != nil {
+		return nil, err
+	}
+	// an explicit qlen_max in the policy block takes precedence over the number of replicas
+	if policy != OffloadBase && !policyConfig.Config.Has("qlen_max") {
+		offloader.SetMaxQlen(int32(spec.NumReplicas))
+	}
+	if spec.Limits.MaxQlen > 0 {
+		offloader.SetMaxQlen(spec.Limits.MaxQlen)
+	}
+	return offloader, nil
+}
+
+// policyConfig is the policy of spec, the one of the node unless spec sets its own.
+func (r *requestHandler) policyConfig(spec ApplicationSpec) PolicyConfig {
+	if spec.Policy != nil {
+		return *spec.Policy
+	}
+	return r.config.Policy
+}
+
+// validateApplication checks spec and its policy params without creating an offloader.
+func (r *requestHandler) validateApplication(spec ApplicationSpec) error {
+	policyConfig := r.policyConfig(spec)
+	if _, err := LoadPolicyParams(OffloadPolicy(policyConfig.Name), policyConfig.Config); err != nil {
+		return err
+	}
+	return spec.Qlen.Validate()
+}
+
+func (r *requestHandler) registerApplication(spec ApplicationSpec, declared bool) error {
+	policyConfig := r.policyConfig(spec)
+	offloader, params, err := r.createOffloader(spec, policyConfig, nil)
+	if err != nil {
+		return err
+	}
+	r.restoreOffloaderState(spec.Name, offloader)
+
+	backend := spec.Backend
+	if backend == "" {
+		backend = r.host
+	}
+
+	// Note, calling this request multiple times for the same appName will result in a completely new offloader & portChan created.
+	app := createApplication(spec, backend, offloader)
+	app.declared = declared
+	app.policy = OffloadPolicy(policyConfig.Name)
+	app.params = params
+	r.appMu.Lock()
+	old, replaced := r.applicationMap[spec.Name]
+	r.applicationMap[spec.Name] = app
+	r.appMu.Unlock()
+	if replaced {
+		old.retire()
+	}
+	log.Printf("Created Or Updated application %s", spec.Name)
+	return nil
+}
+
+func (r *requestHandler) handleInvokeActionRequest(w http.ResponseWriter, req *http.Request) {
+
+	var resp *http.Response
+	var ctx *list.Element
+	appName := strings.Split(req.URL.Path, "/")[6]
+	log.Println("Recv req for applicaton", appName)
+	app, ok := r.getApplication(appName)
+	// the app may have been removed by a reload while peers still send to it
+	if !ok || app == nil {
+		http.Error(w, fmt.Sprintf("Application %s does not exist", appName), http.StatusNotFound)
+		return
+	}
+
+	// requests that arrived before a policy switch finish under the old offloader
+	offloader, release := app.acquire()
+	defer release()
+	// the app was replaced or removed after the lookup
+	if offloader == nil {
+		w.Header().Set(RetryHeader, "true")
+		http.Error(w, fmt.Sprintf("Application %s was replaced or removed, retry", appName), http.StatusServiceUnavailable)
+		return
+	}
+
+	metricCtx := offloader.MetricSMInit()
+	sm := metricCtx.Value.(*MetricSM)
+	sm.forwarded = offloader.IsOffloaded(req)
+	policy, _ := app.getPolicy()
+	sm.decision = r.decisionLog.begin(appName, policy, sm.forwarded, isStolen(req))
+	defer r.decisionLog.finish(sm.decision, sm)
+
+	log.Println("Recv req for applicaton", appName)
+	var localExecution bool
+	if isStolen(req) {
+		// The victim already admitted this invocation and we asked for it, so always run it.
+		ctx, localExecution = offloader.ForceEnq(req), true
+		stolenIn.Add(1)
+	} else {
+		ctx, localExecution = offloader.CheckAndEnq(req)
+	}
+	snap := offloader.GetSnapshot(req)
+	sm.decision.admit(snap, localExecution)
+	w.Header().Set("InstQLEN", strconv.FormatInt(int64(snap.Qlen), 10))
+	w.Header().Set("HistQLEN", strconv.FormatFloat(float64(snap.HistoricQlen), 'E', -1, 32))
+
+	if offloader.IsOffloaded(req) {
+		//set offloadee header details
+		w.Header().Set("Content-Type", "application/json")
+		stat := offloader.GetStatusStr()
+		log.Println("[DEBUG] offload status ack=", stat)
+		w.Header().Set(OffloadSuccess, strconv.FormatBool(localExecution))
+		w.Header().Set(NodeStatus, stat)
+		w.WriteHeader(http.StatusOK)
+		fmt.Fprintf(w, "") //empty response
+		// r.offloader.MetricSMAnalyze(metricCtx)
+		// r.offloader.MetricSMDelete(metricCtx)
+	}
+
+	if !localExecution {
+
+		//disallow nested offloads
+		if offloader.IsOffloaded(req) {
+			sm.decision.locate("rejected")
+			return
+		}
+
+		// Begin OFFLOAD Steps
+		hops := newTierHops(r.config.Tiering)
+		tried := map[string]bool{}
+		for retry_count := 0; retry_count < RETRY_MAX; retry_count++ {
+
+			// When do we get out of the loop?
+			// Should we break on a successful offload?
+			offloader.MetricSMAdvance(metricCtx, MetricSMState("PREOFFLOADSEARCH"))
+			candidate := offloader.GetOffloadCandidate(req)
+			offloader.MetricSMAdvance(metricCtx, MetricSMState("OFFLOADSEARCH"))
+
+			getCandidateTime := metricCtx.Value.(*MetricSM).offloadSearch.Sub(metricCtx.Value.(*MetricSM).preOffloadSearch).String()
+			w.Header().Set("Get-Candidate", getCandidateTime)
+
+			if candidate == r.host {
+				localExecution = true
+				break
+			}
+
+			localExecution = false
+			log.Println("[INFO] offload to ", candidate)
+			hops.add(r.config.Tiering.tierOf(candidate))
+			tried[candidate] = true
+			var accepted bool
+			resp, accepted = r.offloadTo(req, offloader, metricCtx, candidate)
+			localExecution = !accepted
+			if accepted {
+				break
+			}
+			if resp != nil {
+				w.Header().Set("OffloadReject", "true")
+			}
+		}
+
+		if localExecution && r.config.Tiering.Escalate {
+			var accepted bool
+			resp, accepted = r.escalate(req, offloader, metricCtx, hops, tried)
+			localExecution = !accepted
+		}
+		if r.config.Tiering.Escalate {
+			w.Header().Set(TierHopsHeader, hops.String())
+		}
+
+		// Cannot find a node to offload. Execute locally
+		if localExecution {
+			ctx = offloader.ForceEnq(req)
+		}
+	}
+	sm.decision.explain(offloader)
+
+	// NOTE: this is not as an "else" block because local execution is possible despite taking the first branch
+	var port string
+	var thief string
+	if localExecution {
+		log.Println("Forwarding to local FaaS Node")
+		// self local processing
+		// conditions: localEnq was successful OR offload failed and forced enq
+
+		// Since in a FaaS Platform, choosing the candidate container would add to the POSTLOCAL-PRELOCAL latency.
+		offloader.MetricSMAdvance(metricCtx, MetricSMState("PRELOCAL"), r.host)
+
+		port, thief = r.waitForReplica(app, offloader, req, ctx)
+		if thief != "" {
+			offloader.Deq(req, ctx)
+			var err error
+			resp, err = r.forwardStolen(req, thief)
+			if err != nil {
+				log.Println("[WARN] forwarding stolen invocation failed: ", err)
+				thief = ""
+				ctx = offloader.ForceEnq(req)
+				port = <-app.portChan
+			}
+		}
+	}
+
+	if localExecution && thief != "" {
+		offloader.MetricSMAdvance(metricCtx, MetricSMState("POSTLOCAL"))
+		w.Header().Set("Invoc-Loc", "Stolen")
+		sm.decision.locate("stolen")
+		w.Header().Set(StolenByHeader, thief)
+		stolenOut.Add(1)
+	} else if localExecution {
+		contentLength := req.Header.Get("Content-Length")
+		proxyReq := r.createProxyReq(req, app.backend, false, port)
+		proxyReq.Header.Add("Content-Length", contentLength)
+		proxyReq.Header.Add("Transfer-Encoding", "identity")
+		proxyReq.TransferEncoding = []string{"identity"}
+		proxyReq.ContentLength = req.ContentLength
+
+		var err error
+		execStart := time.Now()
+		resp, err = r.client.Do(proxyReq)
+
+		if err != nil {
+			//something bad happened
+			log.Printf("%s: local processing returned error %s", appName, err.Error())
+			http.Error(w, err.Error(), http.StatusBadGateway)
+			return
+		} else if resp.StatusCode != http.StatusOK {
+			respmsg, _ := io.ReadAll(resp.Body)
+			log.Println(fmt.Sprintf("%s: Bad http response: %s", appName, string(respmsg)), resp.StatusCode)
+			http.Error(w, fmt.Sprintf("Bad http response: %s", string(respmsg)), resp.StatusCode)
+			dump, _ := httputil.DumpRequestOut(proxyReq, true)
+			log.Println(dump)
+			return
+		} else {
+			// This is in the critical path.
+			offloader.MetricSMAdvance(metricCtx, MetricSMState("POSTLOCAL"))
+			offloader.Base().Finfo.observeServiceTime(time.Since(execStart))
+		}
+
+		offloader.Deq(req, ctx)
+		w.Header().Set("Invoc-Loc", "Local")
+		sm.decision.locate("local")
+		local.Add(1)
+	} else {
+		w.Header().Set("Invoc-Loc", "Offload")
+		sm.decision.locate("offload")
+		offload.Add(1)
+	}
+
+	log.Printf("Local,Offload,StolenOut,StolenIn=%d,%d,%d,%d\n", local.Load(), offload.Load(), stolenOut.Load(), stolenIn.Load())
+
+	offloader.MetricSMAdvance(metricCtx, MetricSMState("FINAL"))
+
+	offloader.MetricSMAnalyze(metricCtx)
+
+	timeElapsedInExec := offloader.MetricSMElapsed(metricCtx)
+	if timeElapsedInExec != "" {
+		w.Header().Set("Invoc-Time", timeElapsedInExec)
+	}
+
+	io.Copy(w, resp.Body)
+	if resp.Body != nil {
+		resp.Body.Close()
+	} else {
+		log.Println("Response is empty!")
+	}
+
+	if localExecution && thief == "" {
+		app.portChan <- port
+	}
+
+	offloader.MetricSMDelete(metricCtx)
+	log.Println("Successfully handle request")
+	return
+}
+
+func (r *requestHandler) handleUploadDagRequest(w http.ResponseWriter, req *http.Request) {
+	// Read the binary data from the request body
+	binaryData, err := io.ReadAll(req.Body)
+	if err != nil {
+		http.Error(w, "Failed to read request body", http.StatusInternalServerError)
+		return
+	}
+
+	// curl -X POST -H "Content-Type: application/x-yaml" --data-binary "@apps/dag/dag_manifest.yml" http://localhost:9696/api/v1/namespaces/guest/dag/test
+	dag, err := r.registerDag(binaryData)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Invalid DAG manifest: %s", err.Error()), http.StatusBadRequest)
+		return
+	}
+	if err := r.store.SaveDag(dag.Name, binaryData); err != nil {
+		log.Printf("[WARNING] could not persist DAG %s: %v", dag.Name, err)
+	}
+}
+
+// parseDagManifest decodes and checks a manifest without registering it.
+func parseDagManifest(manifest []byte) (DagManifest, error) {
+	var newDagManifest DagManifest
+	if err := yaml.Unmarshal(manifest, &newDagManifest); err != nil {
+		return newDagManifest, err
+	}
+	// the name keys the manifest file under data_dir
+	if name := newDagManifest.Name; name == "" || filepath.Base(name) != name || strings.HasPrefix(name, ".") {
+		return newDagManifest, fmt.Errorf("invalid DAG name %q", name)
+	}
+	return newDagManifest, nil
+}
+
+func (r *requestHandler) registerDag(manifest []byte) (*FaasEdgeDag, error) {
+	newDagManifest, err := parseDagManifest(manifest)
+	if err != nil {
+		return nil, err
+	}
+
+	// Process the YAML data as needed
+	log.Printf("Received YAML data: %+v\n", newDagManifest)
+
+	dag := createDag(newDagManifest)
+	r.dagMu.Lock()
+	r.dagMap[dag.Name] = dag
+	r.dagMu.Unlock()
+	return dag, nil
+}
+
+func (r *requestHandler) handleInvokeDagRequest(w http.ResponseWriter, req *http.Request) {
+	// Lookup the DAG from in-memory storage
+	dagName := extractEntityName(req)
+	log.Println("InvokeDAG with name", dagName)
+	r.dagMu.RLock()
+	d, ok := r.dagMap[dagName]
+	r.dagMu.RUnlock()
+	if !ok {
+		http.Error(w, fmt.Sprintf("DAG with name %s does not exist", dagName), http.StatusNotFound)
+		return
+	}
+
+	// Find the root vertex
+	rootList := d.dag.GetRoots()
+	if len(rootList) != 1 {
+		http.Error(w, fmt.Sprintf("The DAG %s has %d roots. For now, we only assume 1 root.", dagName, len(rootList)), http.StatusBadRequest)
+		return
+	}
+	var rootId string
+	for id := range rootList {
+		rootId = id
+	}
+
+	// Traverse the DAG starting from the root vertex
+	traverseResultBytes, err := d.TraverseDag(rootId, w, req)
+	if err != nil {
+		log.Printf("Traversing dag %s failed: %s", dagName, err.Error())
+		http.Error(w, fmt.Sprintf("error while traversing the DAG %s: %s", dagName, err.Error()), http.StatusBadRequest)
+		return
+	}
+
+	// Marshal the results and write reply
+	//log.Printf("Final resp is %s", string(traverseResultBytes))
+	respBody := io.NopCloser(strings.NewReader(string(traverseResultBytes)))
+	io.Copy(w, respBody)
+	if respBody != nil {
+		respBody.Close()
+	} else {
+		log.Println("Response is empty!")
+	}
+}
+
+func (r *requestHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	log.Println("Receive request!")
+	// Check the URL path and call the appropriate function based on the endpoint
+	switch {
+	case strings.HasPrefix(req.URL.Path, "/api/v1/namespaces/guest/actions/"):
+		switch req.Method {
+		case "PUT":
+			r.handleRegisterActionRequest(w, req)
+		case "POST":
+			r.handleInvokeActionRequest(w, req)
+		}
+	case strings.HasPrefix(req.URL.Path, "/api/v1/admin/policy/"):
+		switch req.Method {
+		case "PUT":
+			r.handleSwitchPolicyRequest(w, req)
+		default:
+			http.NotFound(w, req)
+		}
+	case req.URL.Path == "/api/v1/admin/peers":
+		switch req.Method {
+		case "GET":
+			r.handleMembersRequest(w, req)
+		default:
+			http.NotFound(w, req)
+		}
+	case strings.HasPrefix(req.URL.Path, "/api/v1/admin/peers/"):
+		switch req.Method {
+		case "PUT", "DELETE":
+			r.handleMemberRequest(w, req)
+		default:
+			http.NotFound(w, req)
+		}
+	case req.URL.Path == "/api/v1/namespaces/guest/policies":
+		switch req.Method {
+		case "GET":
+			r.handlePoliciesRequest(w, req)
+		default:
+			http.NotFound(w, req)
+		}
+	case req.URL.Path == "/api/v1/namespaces/guest/status":
+		switch req.Method {
+		case "GET":
+			r.handleStatusRequest(w, req)
+		default:
+			http.NotFound(w, req)
+		}
+	case req.URL.Path == "/api/v1/namespaces/guest/ping":
+		switch req.Method {
+		case "GET", "POST":
+			r.handlePingRequest(w, req)
+		default:
+			http.NotFound(w, req)
+		}
+	case req.URL.Path == "/api/v1/namespaces/guest/gossip":
+		switch req.Method {
+		case "POST":
+			r.handleGossipRequest(w, req)
+		default:
+			http.NotFound(w, req)
+		}
+	case strings.HasPrefix(req.URL.Path, "/api/v1/namespaces/guest/snapshot/"):
+		switch req.Method {
+		case "GET":
+			r.handleSnapshotRequest(w, req)
+		default:
+			http.NotFound(w, req)
+		}
+	case strings.HasPrefix(req.URL.Path, "/api/v1/namespaces/guest/steal/"):
+		switch req.Method {
+		case "POST":
+			r.handleStealRequest(w, req)
+		default:
+			http.NotFound(w, req)
+		}
+	case strings.HasPrefix(req.URL.Path, "/api/v1/namespaces/guest/dag/"):
+		switch req.Method {
+		// Best practice would be to use 'POST' to upload/create a dag. However, for now, we use POST for invoking, to match with single action invoke.
+		case "PUT":
+			r.handleUploadDagRequest(w, req)
+		case "POST":
+			r.handleInvokeDagRequest(w, req)
+		default:
+			http.NotFound(w, req)
+		}
+	default:
+		http.NotFound(w, req)
+	}
+}
+
+// Main runs a feo node configured by the -config flag. Programs embedding feo
+// register their own policies with RegisterPolicy before calling Main.
+func Main() {
+	// client := &http.Client{}
+	log.SetFlags(log.LstdFlags | log.Lshortfile)
+	var configstr = flag.String("config", "config.yml", "YML config for faas orchestrator")
+	flag.Parse()
+
+	config, err := loadConfig(*configstr)
+	if err != nil {
+		log.Fatal(err)
+	}
+	//telemetry
+	local.Store(0)
+	offload.Store(0)
+
+	//backendUrl := url.Parse("http://host:3233/api/v1/namespaces/guest/actions/copy?blocking=true&result=true")
+
+	for _, ele := range config.Peers {
+		log.Println(ele)
+	}
+
+	//TODO: use gflags instead of os.Args
+	// policy := OffloadPolicy(config.Policy.Name)
+	// cur_offloader := OffloadFactory(policy, config)
+
+	node, err := NewNode(config, NodeOptions{ConfigPath: *configstr})
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	closed := make(chan bool)
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP)
+	go func() {
+		for sig := range sigs {
+			if sig == syscall.SIGHUP {
+				node.Reload()
+				continue
+			}
+			log.Printf("[INFO] Received %s, shutting down", sig)
+			node.Close()
+			close(closed)
+			return
+		}
+	}()
+
+	if err := node.ListenAndServe(); err != http.ErrServerClosed {
+		log.Fatal(err)
+	}
+	<-closed
+}
@@ -0,0 +1,333 @@
+// Package harness runs a cluster of feo nodes in one process, so that peer
+// offloading can be exercised by a plain go test or benchmark, without
+// machines or OpenWhisk. Every node listens on a loopback port and runs its
+// replicas as fake backends with a configurable service time; the requests
+// between nodes are delayed by the configured RTT.
+//
+//	c, err := harness.Start(harness.Config{
+//		Nodes:  3,
+//		Policy: feo.PolicyConfig{Name: "p2c"},
+//		RttMs:  10,
+//		Apps:   []harness.App{{Name: "copy", Replicas: 2, Service: feo.SimDist{Dist: "exp", MeanMs: 50}}},
+//	})
+//	if err != nil {
+//		t.Fatal(err)
+//	}
+//	defer c.Close()
+//	res, err := c.Invoke(0, "copy", nil)
+//
+// The nodes log to the standard logger, which tests usually discard.
+package harness
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"math/rand"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.gatech.edu/faasedge/feo"
+	"github.gatech.edu/faasedge/feo/controller"
+	"google.golang.org/grpc"
+)
+
+type App struct {
+	Name string
+	// Replicas of the app on every node
+	Replicas int
+	// Service is the time a replica takes for one invocation
+	Service feo.SimDist
+	Limits  feo.ApplicationLimits
+}
+
+// Link sets the RTT between nodes A and B, in both directions.
+type Link struct {
+	A, B  int
+	RttMs float64
+}
+
+type Config struct {
+	Nodes  int
+	Apps   []App
+	Policy feo.PolicyConfig
+	// RttMs between nodes without a link
+	RttMs float64
+	Links []Link
+	// Controller starts a controller for the hybrid, epoch and centralized policies.
+	Controller bool
+	// Seed seeds node i with Seed+i, and the service times. 0 seeds from the clock.
+	Seed int64
+	// Configure edits the config of node i before it starts, e.g. to enable gossip.
+	Configure func(i int, config *feo.FeoConfig)
+}
+
+// Cluster is a running harness.
+type Cluster struct {
+	cfg      Config
+	Nodes    []*feo.Node
+	hosts    []string
+	index    map[string]int
+	backends []*http.Server
+	grpc     *grpc.Server
+	client   http.Client
+	wg       sync.WaitGroup
+}
+
+// Result is the outcome of one invocation.
+type Result struct {
+	Status  int
+	Latency time.Duration
+	// Location is the Invoc-Loc header: Local, Offload or Stolen
+	Location string
+	// InvocTime is the Invoc-Time header, the time feo spent on the invocation
+	InvocTime string
+	Body      []byte
+}
+
+// Start starts the controller if asked, the replicas and the nodes, and
+// returns once all of them accept requests.
+func Start(cfg Config) (*Cluster, error) {
+	if cfg.Nodes <= 0 || len(cfg.Apps) == 0 {
+		return nil, fmt.Errorf("a cluster needs nodes and apps")
+	}
+	for _, app := range cfg.Apps {
+		if app.Replicas <= 0 {
+			return nil, fmt.Errorf("app %s needs at least one replica", app.Name)
+		}
+		if err := app.Service.Validate(); err != nil {
+			return nil, fmt.Errorf("app %s: %w", app.Name, err)
+		}
+	}
+	c := &Cluster{cfg: cfg, index: map[string]int{}}
+	c.client = http.Client{Timeout: 30 * time.Second, Transport: newTransport()}
+
+	controllerAddr := ""
+	if cfg.Controller {
+		lis, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			return nil, err
+		}
+		c.grpc = grpc.NewServer()
+		controller.Register(c.grpc)
+		c.wg.Add(1)
+		go func() {
+			defer c.wg.Done()
+			c.grpc.Serve(lis)
+		}()
+		controllerAddr = lis.Addr().String()
+	}
+
+	// every node must know the hosts of its peers before it starts
+	listeners := make([]net.Listener, cfg.Nodes)
+	for i := range listeners {
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			c.closeListeners(listeners)
+			c.Close()
+			return nil, err
+		}
+		listeners[i] = l
+		c.hosts = append(c.hosts, l.Addr().String())
+		c.index[l.Addr().String()] = i
+	}
+
+	for i := 0; i < cfg.Nodes; i++ {
+		config := feo.FeoConfig{Controller: controllerAddr, Scheme: "http", Host: c.hosts[i], Policy: cfg.Policy}
+		if cfg.Seed != 0 {
+			config.Seed = cfg.Seed + int64(i)
+		}
+		for j, host := range c.hosts {
+			if j != i {
+				config.Peers = append(config.Peers, host)
+			}
+		}
+		rng := feo.NewRand(config.Seed)
+		for _, app := range cfg.Apps {
+			port, err := c.startReplicas(app, rng)
+			if err != nil {
+				c.closeListeners(listeners[i:])
+				c.Close()
+				return nil, err
+			}
+			config.Applications = append(config.Applications, feo.ApplicationSpec{
+				Name: app.Name, Backend: "127.0.0.1", InitPort: port, NumReplicas: app.Replicas, Limits: app.Limits,
+			})
+		}
+		if cfg.Configure != nil {
+			cfg.Configure(i, &config)
+		}
+
+		node, err := feo.NewNode(config, feo.NodeOptions{Transport: &latencyTransport{from: i, c: c, next: newTransport()}})
+		if err != nil {
+			c.closeListeners(listeners[i:])
+			c.Close()
+			return nil, fmt.Errorf("node %d: %w", i, err)
+		}
+		c.Nodes = append(c.Nodes, node)
+		c.wg.Add(1)
+		go func(l net.Listener) {
+			defer c.wg.Done()
+			node.Serve(l)
+		}(listeners[i])
+	}
+	return c, nil
+}
+
+func (c *Cluster) closeListeners(listeners []net.Listener) {
+	for _, l := range listeners {
+		if l != nil {
+			l.Close()
+		}
+	}
+}
+
+// startReplicas runs the replicas of app on consecutive ports, as feo expects
+// them, and returns the first port.
+func (c *Cluster) startReplicas(app App, rng *rand.Rand) (int, error) {
+	listeners, err := listenConsecutive(app.Replicas)
+	if err != nil {
+		return 0, err
+	}
+	for _, l := range listeners {
+		s := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			io.Copy(io.Discard, req.Body)
+			time.Sleep(app.Service.Sample(rng))
+			fmt.Fprintf(w, "{\"app\": %q}", app.Name)
+		})}
+		c.backends = append(c.backends, s)
+		c.wg.Add(1)
+		go func(l net.Listener) {
+			defer c.wg.Done()
+			s.Serve(l)
+		}(l)
+	}
+	return listeners[0].Addr().(*net.TCPAddr).Port, nil
+}
+
+// listenConsecutive listens on n consecutive loopback ports.
+func listenConsecutive(n int) ([]net.Listener, error) {
+	for attempt := 0; attempt < 100; attempt++ {
+		first, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			return nil, err
+		}
+		port := first.Addr().(*net.TCPAddr).Port
+		listeners := []net.Listener{first}
+		for i := 1; i < n; i++ {
+			l, err := net.Listen("tcp", fmt.Sprintf("127.0.0.1:%d", port+i))
+			if err != nil {
+				break
+			}
+			listeners = append(listeners, l)
+		}
+		if len(listeners) == n {
+			return listeners, nil
+		}
+		for _, l := range listeners {
+			l.Close()
+		}
+	}
+	return nil, fmt.Errorf("no %d consecutive free ports", n)
+}
+
+// Host returns the address of node i.
+func (c *Cluster) Host(i int) string {
+	return c.hosts[i]
+}
+
+// URL returns the URL that invokes app at node i.
+func (c *Cluster) URL(i int, app string) string {
+	return fmt.Sprintf("http://%s/api/v1/namespaces/guest/actions/%s?blocking=true&result=true", c.hosts[i], app)
+}
+
+// Invoke invokes app at node i with body and waits for the result.
+func (c *Cluster) Invoke(i int, app string, body []byte) (Result, error) {
+	start := time.Now()
+	resp, err := c.client.Post(c.URL(i, app), "application/json", bytes.NewReader(body))
+	if err != nil {
+		return Result{}, err
+	}
+	defer resp.Body.Close()
+	res := Result{Status: resp.StatusCode, Location: resp.Header.Get("Invoc-Loc"), InvocTime: resp.Header.Get("Invoc-Time")}
+	res.Body, err = io.ReadAll(resp.Body)
+	res.Latency = time.Since(start)
+	return res, err
+}
+
+// Close stops the nodes, their replicas and the controller.
+func (c *Cluster) Close() {
+	for _, node := range c.Nodes {
+		node.Close()
+	}
+	for _, s := range c.backends {
+		s.Close()
+	}
+	if c.grpc != nil {
+		c.grpc.Stop()
+	}
+	c.wg.Wait()
+}
+
+// rtt returns the RTT between nodes a and b.
+func (c *Cluster) rtt(a, b int) time.Duration {
+	ms := c.cfg.RttMs
+	for _, l := range c.cfg.Links {
+		if (l.A == a && l.B == b) || (l.A == b && l.B == a) {
+			ms = l.RttMs
+		}
+	}
+	return time.Duration(ms * float64(time.Millisecond))
+}
+
+func newTransport() *http.Transport {
+	t := http.DefaultTransport.(*http.Transport).Clone()
+	t.MaxIdleConnsPerHost = 64
+	return t
+}
+
+// latencyTransport delays the requests of node from to the other nodes by
+// half the RTT on the way there and half on the way back. Requests to the
+// replicas are not delayed.
+type latencyTransport struct {
+	from int
+	c    *Cluster
+	next http.RoundTripper
+}
+
+func (t *latencyTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	to, ok := t.c.index[req.URL.Host]
+	if !ok || to == t.from {
+		return t.next.RoundTrip(req)
+	}
+	half := t.c.rtt(t.from, to) / 2
+	if err := sleep(req.Context(), half); err != nil {
+		return nil, err
+	}
+	resp, err := t.next.RoundTrip(req)
+	if err != nil {
+		return nil, err
+	}
+	if err := sleep(req.Context(), half); err != nil {
+		resp.Body.Close()
+		return nil, err
+	}
+	return resp, nil
+}
+
+func sleep(ctx context.Context, d time.Duration) error {
+	if d <= 0 {
+		return nil
+	}
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
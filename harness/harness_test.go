@@ -0,0 +1,154 @@
+package harness
+
+import (
+	"io"
+	"log"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"github.gatech.edu/faasedge/feo"
+)
+
+// controllerPolicies exchange state with the controller every gap_ms, which
+// defaults to 1s and is too slow for a short run.
+var controllerPolicies = map[feo.OffloadPolicy]feo.RawPolicyParams{
+	feo.OffloadHybrid:  {"gap_ms": 100},
+	feo.OffloadEpoch:   {"gap_ms": 100, "epoch_ms": 200},
+	feo.OffloadCentral: {"gap_ms": 100},
+}
+
+func TestMain(m *testing.M) {
+	log.SetOutput(io.Discard)
+	os.Exit(m.Run())
+}
+
+func policyConfig(policy feo.OffloadPolicy) (feo.PolicyConfig, bool) {
+	params, controller := controllerPolicies[policy]
+	return feo.PolicyConfig{Name: string(policy), Config: params}, controller
+}
+
+func startCluster(tb testing.TB, policy feo.OffloadPolicy) *Cluster {
+	tb.Helper()
+	pc, controller := policyConfig(policy)
+	c, err := Start(Config{
+		Nodes:      3,
+		Policy:     pc,
+		RttMs:      2,
+		Controller: controller,
+		Seed:       1,
+		Apps:       []App{{Name: "copy", Replicas: 2, Service: feo.SimDist{Dist: "exp", MeanMs: 20}}},
+	})
+	if err != nil {
+		tb.Fatal(err)
+	}
+	return c
+}
+
+// overload keeps workers invocations in flight at node 0 for d, several times
+// what its replicas serve, and returns the results.
+func overload(c *Cluster, workers int, d time.Duration) ([]Result, []error) {
+	var mu sync.Mutex
+	var results []Result
+	var errs []error
+	var wg sync.WaitGroup
+	deadline := time.Now().Add(d)
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for time.Now().Before(deadline) {
+				res, err := c.Invoke(0, "copy", []byte("{}"))
+				mu.Lock()
+				if err != nil {
+					errs = append(errs, err)
+				} else {
+					results = append(results, res)
+				}
+				mu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+	return results, errs
+}
+
+func TestPolicies(t *testing.T) {
+	if testing.Short() {
+		t.Skip("overloads a cluster for every policy")
+	}
+	for _, policy := range feo.RegisteredPolicies() {
+		policy := policy
+		t.Run(string(policy), func(t *testing.T) {
+			c := startCluster(t, policy)
+			defer c.Close()
+			// let the controller policies publish their state once
+			time.Sleep(300 * time.Millisecond)
+
+			results, errs := overload(c, 12, 2*time.Second)
+			if len(errs) > 0 {
+				t.Fatalf("%d invocations failed, first: %v", len(errs), errs[0])
+			}
+			if len(results) == 0 {
+				t.Fatal("no invocation completed")
+			}
+			placed := map[string]int{}
+			for _, res := range results {
+				if res.Status != 200 {
+					t.Fatalf("invocation returned %d: %s", res.Status, res.Body)
+				}
+				switch res.Location {
+				case "Local", "Offload", "Stolen":
+					placed[res.Location]++
+				default:
+					t.Fatalf("unexpected Invoc-Loc %q", res.Location)
+				}
+			}
+			t.Logf("%d invocations, placed %v", len(results), placed)
+
+			if policy == feo.OffloadBase {
+				if placed["Local"] != len(results) {
+					t.Errorf("base must run everything locally, placed %v", placed)
+				}
+			} else if placed["Offload"] == 0 {
+				t.Errorf("nothing was offloaded from an overloaded node, placed %v", placed)
+			}
+		})
+	}
+}
+
+func BenchmarkPolicies(b *testing.B) {
+	for _, policy := range feo.RegisteredPolicies() {
+		policy := policy
+		b.Run(string(policy), func(b *testing.B) {
+			c := startCluster(b, policy)
+			defer c.Close()
+			time.Sleep(300 * time.Millisecond)
+
+			var mu sync.Mutex
+			offloaded := 0
+			b.SetParallelism(4)
+			b.ResetTimer()
+			b.RunParallel(func(pb *testing.PB) {
+				for pb.Next() {
+					res, err := c.Invoke(0, "copy", []byte("{}"))
+					if err != nil {
+						b.Error(err)
+						return
+					}
+					if res.Status != 200 {
+						b.Errorf("invocation returned %d", res.Status)
+						return
+					}
+					if res.Location == "Offload" {
+						mu.Lock()
+						offloaded++
+						mu.Unlock()
+					}
+				}
+			})
+			b.ReportMetric(float64(offloaded)/float64(b.N), "offloaded/op")
+		})
+	}
+}
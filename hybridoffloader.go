@@ -1,8 +1,9 @@
-package main
+package feo
 
 import (
 	"container/list"
 	"context"
+	"fmt"
 	"log"
 	"net/http"
 	"sync"
@@ -13,8 +14,72 @@ import (
 	"google.golang.org/grpc/credentials/insecure"
 )
 
+const OffloadHybrid = "hybrid"
+
+func init() {
+	RegisterPolicy(PolicyRegistration{
+		Name:      OffloadHybrid,
+		NewParams: func() PolicyParams { return DefaultHybridParams() },
+		New: func(base *BaseOffloader, params PolicyParams) OffloaderIntf {
+			return NewHybridOffloader(base, params.(*HybridParams))
+		},
+	})
+}
+
+type HybridParams struct {
+	QlenMax int32 `yaml:"qlen_max" json:"qlen_max"`
+	// period of the state updates sent to the controller
+	GapMs int `yaml:"gap_ms" json:"gap_ms"`
+}
+
+func DefaultHybridParams() *HybridParams {
+	return &HybridParams{QlenMax: 2, GapMs: 1000}
+}
+
+func (p *HybridParams) Validate() error {
+	if p.QlenMax <= 0 {
+		return fmt.Errorf("qlen_max must be positive, got %d", p.QlenMax)
+	}
+	if p.GapMs <= 0 {
+		return fmt.Errorf("gap_ms must be positive, got %d", p.GapMs)
+	}
+	return nil
+}
+
 type HybridOffloader struct {
 	*BaseOffloader
+	ctrl *controllerLink
+}
+
+func NewHybridOffloader(base *BaseOffloader, params *HybridParams) *HybridOffloader {
+	fed := &HybridOffloader{BaseOffloader: base}
+	fed.Qlen_max = params.QlenMax
+	fed.ctrl = newControllerLink(base, params.GapMs)
+	return fed
+}
+
+func (o *HybridOffloader) CheckAndEnq(req *http.Request) (*list.Element, bool) {
+	//NOTE: only happens at the receive of a request
+	o.ctrl.recordInvocation()
+
+	ele, status := o.BaseOffloader.CheckAndEnq(req)
+
+	return ele, status
+}
+
+func (o *HybridOffloader) Close() {
+	o.ctrl.close()
+	o.BaseOffloader.Close()
+}
+
+func (o *HybridOffloader) GetOffloadCandidate(req *http.Request) string {
+	return o.ctrl.getCandidate()
+}
+
+// controllerLink reports the queue of an offloader to the controller every
+// gap_ms and asks the controller for offload candidates.
+type controllerLink struct {
+	base           *BaseOffloader
 	quit           chan bool
 	gap_ms         int
 	wg             sync.WaitGroup
@@ -25,75 +90,72 @@ type HybridOffloader struct {
 	//TODO: update after statemachine is updated
 	invocation_history []int64
 	qlen               float32
+	qlenEst            QlenEstimator
 	qlenMu             sync.RWMutex
 	iHistoryMu         sync.Mutex
 }
 
-func NewHybridOffloader(base *BaseOffloader) *HybridOffloader {
-	fed := &HybridOffloader{BaseOffloader: base}
-	fed.Qlen_max = 2
-	fed.gap_ms = 1000
-	fed.quit = make(chan bool)
-	fed.ControllerAddr = fed.config.Controller
+func newControllerLink(base *BaseOffloader, gapMs int) *controllerLink {
+	l := &controllerLink{base: base, gap_ms: gapMs}
+	l.qlenEst = newQlenEstimator(base.ControllerQlen, DefaultControllerQlen)
+	l.quit = make(chan bool)
+	l.ControllerAddr = base.config.Controller
 
 	//setup connection with controller
 	var err error
-	fed.conn, err = grpc.Dial(fed.ControllerAddr, grpc.WithTransportCredentials(insecure.NewCredentials()))
+	l.conn, err = grpc.Dial(l.ControllerAddr, grpc.WithTransportCredentials(insecure.NewCredentials()))
 	if err != nil {
 		log.Fatalf("did not connect: %v", err)
 	}
-	fed.client = pb.NewOffloadStateHubClient(fed.conn)
+	l.client = pb.NewOffloadStateHubClient(l.conn)
 
-	fed.wg.Add(1)
-	go fed.stateUpdateRoutine()
-	return fed
+	l.wg.Add(1)
+	go l.stateUpdateRoutine()
+	return l
 }
 
-func (o *HybridOffloader) CheckAndEnq(req *http.Request) (*list.Element, bool) {
-	//NOTE: only happens at the receive of a request
-	o.iHistoryMu.Lock()
-	o.invocation_history = append(o.invocation_history, int64(time.Now().UnixNano()))
-	o.iHistoryMu.Unlock()
-
-	ele, status := o.BaseOffloader.CheckAndEnq(req)
-
-	return ele, status
+func (l *controllerLink) recordInvocation() {
+	l.iHistoryMu.Lock()
+	l.invocation_history = append(l.invocation_history, l.base.Clock.Now().UnixNano())
+	l.iHistoryMu.Unlock()
 }
 
-func (o *HybridOffloader) update_qlen() {
-	defer o.wg.Done()
+func (l *controllerLink) update_qlen() {
+	defer l.wg.Done()
 
-	cur_qlen := o.Finfo.getSnapshot().Qlen
+	cur_qlen := l.base.Finfo.getSnapshot().Qlen
 
-	o.qlenMu.Lock()
-	o.qlen = 0.2*o.qlen + 0.8*float32(cur_qlen)
-	o.qlenMu.Unlock()
+	l.qlenMu.Lock()
+	l.qlenEst.Observe(float64(cur_qlen), l.base.Clock.Now())
+	l.qlen = float32(l.qlenEst.Estimate())
+	l.qlenMu.Unlock()
 }
 
-func (o *HybridOffloader) buildAndSendReq() {
-	defer o.wg.Done()
+func (l *controllerLink) buildAndSendReq() {
+	defer l.wg.Done()
 	// Contact the server and print out its response.
 	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
 	defer cancel()
-	req := &pb.NodeState{Name: o.Host}
+	req := &pb.NodeState{Name: l.base.Host}
 
-	fi := &pb.FunctionInfo{FunctionName: o.Finfo.name}
+	fi := &pb.FunctionInfo{FunctionName: l.base.Finfo.getName()}
 
-	o.iHistoryMu.Lock()
-	fi.InvokeHistory = make([]int64, len(o.invocation_history))
-	copy(fi.InvokeHistory, o.invocation_history)
+	l.iHistoryMu.Lock()
+	fi.InvokeHistory = make([]int64, len(l.invocation_history))
+	copy(fi.InvokeHistory, l.invocation_history)
 	//prune invocation history
-	o.invocation_history = []int64{}
-	o.iHistoryMu.Unlock()
+	l.invocation_history = []int64{}
+	l.iHistoryMu.Unlock()
 
-	o.qlenMu.RLock()
-	fi.Qlen = o.qlen
-	o.qlenMu.RUnlock()
+	l.qlenMu.RLock()
+	fi.Qlen = l.qlen
+	l.qlenMu.RUnlock()
+	fi.SvcTime = l.base.ServiceTime().Proto()
 
 	//TODO: multi-function supported does not exist as of yet
 	req.FinfoList = append(req.FinfoList, fi)
 
-	r, err := o.client.UpdateState(ctx, req)
+	r, err := l.client.UpdateState(ctx, req)
 	if err != nil {
 		log.Printf("[WARNING] could not send state: %v", err)
 	}
@@ -102,54 +164,51 @@ func (o *HybridOffloader) buildAndSendReq() {
 	}
 }
 
-func (o *HybridOffloader) stateUpdateRoutine() {
-	defer o.wg.Done()
+func (l *controllerLink) stateUpdateRoutine() {
+	defer l.wg.Done()
 
-	send_timer := time.NewTicker(time.Duration(o.gap_ms) * time.Millisecond)
-	qlen_timer := time.NewTicker(time.Duration(100) * time.Millisecond)
+	send_timer := l.base.Clock.NewTicker(time.Duration(l.gap_ms) * time.Millisecond)
+	qlen_timer := l.base.Clock.NewTicker(time.Duration(100) * time.Millisecond)
+	defer send_timer.Stop()
+	defer qlen_timer.Stop()
 	for {
 		select {
-		case <-o.quit:
+		case <-l.quit:
 			return
-		case <-send_timer.C:
-			o.wg.Add(1)
-			go o.buildAndSendReq()
-		case <-qlen_timer.C:
-			o.wg.Add(1)
-			go o.update_qlen()
+		case <-send_timer.C():
+			l.wg.Add(1)
+			go l.buildAndSendReq()
+		case <-qlen_timer.C():
+			l.wg.Add(1)
+			go l.update_qlen()
 		}
 	}
 }
 
-func (o *HybridOffloader) Close() {
-	o.conn.Close()
-	close(o.quit)
-	o.wg.Wait()
-}
-
-func (o *HybridOffloader) GetOffloadCandidate(req *http.Request) string {
+func (l *controllerLink) getCandidate() string {
 
 	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
 	defer cancel()
-	creq := &pb.CandidateQuery{NodeName: o.Host}
-	r, err := o.client.GetCandidate(ctx, creq)
+	creq := &pb.CandidateQuery{NodeName: l.base.Host}
+	r, err := l.client.GetCandidate(ctx, creq)
 	if err != nil {
 		log.Println("Error requesting candidate")
-		return o.Host
+		return l.base.Host
+	}
+	if !l.base.isMember(r.GetNode()) {
+		log.Println("[DEBUG] controller picked a node that is not a peer:", r.GetNode())
+		return l.base.Host
+	}
+	if !l.base.Available(r.GetNode()) {
+		log.Println("[DEBUG] controller picked a node whose circuit is open:", r.GetNode())
+		return l.base.Host
 	}
 
 	return r.GetNode()
 }
 
-func (o *HybridOffloader) MetricSMAnalyze(ctx *list.Element) {
-
-	var timeElapsed time.Duration
-	if (ctx.Value.(*MetricSM).state == FinalState) && (ctx.Value.(*MetricSM).candidate != "default") {
-		if ctx.Value.(*MetricSM).local {
-			timeElapsed = ctx.Value.(*MetricSM).postLocal.Sub(ctx.Value.(*MetricSM).preLocal)
-		} else {
-			timeElapsed = ctx.Value.(*MetricSM).postOffload.Sub(ctx.Value.(*MetricSM).preOffload)
-		}
-		ctx.Value.(*MetricSM).elapsed = timeElapsed
-	}
+func (l *controllerLink) close() {
+	l.conn.Close()
+	close(l.quit)
+	l.wg.Wait()
 }
@@ -1,7 +1,9 @@
-package main
+package feo
 
 import (
 	"container/list"
+	"encoding/json"
+	"fmt"
 	"log"
 	"math"
 	"net/http"
@@ -9,6 +11,18 @@ import (
 	"time"
 )
 
+const OffloadImpedence = "impedence"
+
+func init() {
+	RegisterPolicy(PolicyRegistration{
+		Name:      OffloadImpedence,
+		NewParams: func() PolicyParams { return DefaultImpedenceParams() },
+		New: func(base *BaseOffloader, params PolicyParams) OffloaderIntf {
+			return NewImpedenceOffloader(base, params.(*ImpedenceParams))
+		},
+	})
+}
+
 type extendRouter struct {
 	routerInfo    router
 	lambdasServed int64
@@ -16,6 +30,19 @@ type extendRouter struct {
 	weight        float64
 }
 
+type ImpedenceParams struct {
+	// weight of the latest latency sample in the EWMA
+	Alpha float64 `yaml:"alpha" json:"alpha"`
+}
+
+func DefaultImpedenceParams() *ImpedenceParams {
+	return &ImpedenceParams{Alpha: 0.2}
+}
+
+func (p *ImpedenceParams) Validate() error {
+	return validateAlpha("alpha", p.Alpha)
+}
+
 type ImpedenceOffloader struct {
 	*BaseOffloader   //hacky embedding, because you cannot override methods of an embedding
 	alpha            float64
@@ -24,33 +51,42 @@ type ImpedenceOffloader struct {
 	ExtendRouterList []extendRouter
 }
 
-func NewImpedenceOffloader(base *BaseOffloader) *ImpedenceOffloader {
-	impedenceOffloader := &ImpedenceOffloader{alpha: 0.2, BaseOffloader: base}
-	impedenceOffloader.candidateToIndex = make(map[string]int)
+func NewImpedenceOffloader(base *BaseOffloader, params *ImpedenceParams) *ImpedenceOffloader {
+	impedenceOffloader := &ImpedenceOffloader{alpha: params.Alpha, BaseOffloader: base}
+	impedenceOffloader.setRouters(base.Routers())
+	return impedenceOffloader
+}
+
+// setRouters rebuilds ExtendRouterList, keeping the weights of the peers that stay. Must be called with o.mu held.
+func (o *ImpedenceOffloader) setRouters(routers []router) {
+	weights := map[string]float64{}
+	for _, er := range o.ExtendRouterList {
+		weights[er.routerInfo.host] = er.weight
+	}
 
-	for idx, router := range base.RouterList {
-		impedenceOffloader.candidateToIndex[router.host] = idx
+	o.candidateToIndex = make(map[string]int)
+	o.ExtendRouterList = nil
+	for idx, router := range routers {
+		o.candidateToIndex[router.host] = idx
 
 		var newExtendRouter extendRouter
-		newExtendRouter.weight = 0.0
+		newExtendRouter.weight = weights[router.host]
 		newExtendRouter.routerInfo = router
 
-		impedenceOffloader.ExtendRouterList = append(impedenceOffloader.ExtendRouterList, newExtendRouter)
+		o.ExtendRouterList = append(o.ExtendRouterList, newExtendRouter)
 	}
+}
 
-	return impedenceOffloader
+func (o *ImpedenceOffloader) UpdatePeers(peers []string) {
+	o.BaseOffloader.UpdatePeers(peers)
+
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.setRouters(o.Routers())
 }
 
 func (o *ImpedenceOffloader) CheckAndEnq(req *http.Request) (*list.Element, bool) {
-	//NOTE: in round robin checkAndEnq returns true AND does a forceenq IF it is an offloaded request.
-	var ctx *list.Element
-	enq_success := false
-	if o.IsOffloaded(req) {
-		log.Println("[INFO] Already offloaded. Force Enq")
-		ctx = o.ForceEnq(req)
-		enq_success = true
-	}
-	return ctx, enq_success
+	return o.enqIfOffloaded(req)
 }
 
 func (o *ImpedenceOffloader) GetOffloadCandidate(req *http.Request) string {
@@ -63,6 +99,9 @@ func (o *ImpedenceOffloader) GetOffloadCandidate(req *http.Request) string {
 	minIndex := -1
 
 	for i := 0; i < total_nodes; i++ {
+		if !o.Available(o.ExtendRouterList[i].routerInfo.host) {
+			continue
+		}
 		if minWeight > o.ExtendRouterList[i].weight {
 			minIndex = i
 			minWeight = o.ExtendRouterList[i].weight
@@ -76,30 +115,64 @@ func (o *ImpedenceOffloader) GetOffloadCandidate(req *http.Request) string {
 	}
 }
 
-func (o *ImpedenceOffloader) MetricSMAnalyze(ctx *list.Element) {
+// SaveState stores the learned weight of every peer.
+func (o *ImpedenceOffloader) SaveState() ([]byte, error) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	weights := map[string]float64{}
+	for _, er := range o.ExtendRouterList {
+		weights[er.routerInfo.host] = er.weight
+	}
+	return json.Marshal(weights)
+}
 
-	var timeElapsed time.Duration
-	if (ctx.Value.(*MetricSM).state == FinalState) && (ctx.Value.(*MetricSM).candidate != "default") {
-		if ctx.Value.(*MetricSM).local {
-			timeElapsed = ctx.Value.(*MetricSM).postLocal.Sub(ctx.Value.(*MetricSM).preLocal)
-		} else {
-			timeElapsed = ctx.Value.(*MetricSM).postOffload.Sub(ctx.Value.(*MetricSM).preOffload)
-		}
-		ctx.Value.(*MetricSM).elapsed = timeElapsed
+// PolicyState reports the latency estimate of every peer.
+func (o *ImpedenceOffloader) PolicyState() any {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	weights := map[string]float64{}
+	for _, er := range o.ExtendRouterList {
+		weights[er.routerInfo.host] = er.weight
+	}
+	return map[string]any{"weights": weights}
+}
 
-		if ctx.Value.(*MetricSM).localAfterFail || ctx.Value.(*MetricSM).localByDefault {
-			log.Println("[DEBUG] Local candidate not chosen by GetOffloadCandidate, no further analysis.")
-			return
+func (o *ImpedenceOffloader) LoadState(data []byte) error {
+	weights := map[string]float64{}
+	if err := json.Unmarshal(data, &weights); err != nil {
+		return fmt.Errorf("impedence state: %w", err)
+	}
+
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	for i := range o.ExtendRouterList {
+		if wt, ok := weights[o.ExtendRouterList[i].routerInfo.host]; ok {
+			o.ExtendRouterList[i].weight = wt
 		}
+	}
+	return nil
+}
+
+func (o *ImpedenceOffloader) MetricSMAnalyze(ctx *list.Element) {
+	o.BaseOffloader.MetricSMAnalyze(ctx)
 
-		if ctx.Value.(*MetricSM).candidate != "default" {
-			candidateIdx := o.candidateToIndex[ctx.Value.(*MetricSM).candidate]
+	sm := ctx.Value.(*MetricSM)
+	if !sm.finished() {
+		return
+	}
+	if !sm.chosen() {
+		log.Println("[DEBUG] Local candidate not chosen by GetOffloadCandidate, no further analysis.")
+		return
+	}
 
-			o.mu.Lock()
-			defer o.mu.Unlock()
+	o.mu.Lock()
+	defer o.mu.Unlock()
 
-			prevRouterWeight := o.ExtendRouterList[candidateIdx].weight
-			o.ExtendRouterList[candidateIdx].weight = prevRouterWeight*(1-o.alpha) + float64(timeElapsed.Microseconds()/1000)*o.alpha
-		}
+	candidateIdx, ok := o.candidateToIndex[sm.candidate]
+	if !ok {
+		// the peer left while the invocation ran
+		return
 	}
+	prevRouterWeight := o.ExtendRouterList[candidateIdx].weight
+	o.ExtendRouterList[candidateIdx].weight = prevRouterWeight*(1-o.alpha) + sm.elapsedMs()*o.alpha
 }
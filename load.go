@@ -0,0 +1,534 @@
+package feo
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"math/rand"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+const (
+	DEFAULT_LOAD_TIMEOUT_MS   = 30000
+	DEFAULT_LOAD_MAX_INFLIGHT = 10000
+)
+
+// LoadConfig describes the workload feo-load sends to feo nodes.
+type LoadConfig struct {
+	Seed      int64   `yaml:"seed"`
+	DurationS float64 `yaml:"duration_s"`
+	TimeoutMs int     `yaml:"timeout_ms"`
+	// invocations in flight at most; arrivals beyond are dropped and counted
+	MaxInflight int          `yaml:"max_inflight"`
+	Streams     []LoadStream `yaml:"streams"`
+	// Trace replaces the streams, see LoadRequest.
+	Trace string `yaml:"trace"`
+}
+
+// LoadStream is an open-loop arrival process of an action or a DAG at one node.
+type LoadStream struct {
+	// host:port of the feo node
+	Target string `yaml:"target"`
+	Action string `yaml:"action"`
+	Dag    string `yaml:"dag"`
+	// poisson, bursty or constant
+	Arrivals string  `yaml:"arrivals"`
+	Rate     float64 `yaml:"rate"`
+	// bursty streams arrive at burst_rate for the first burst_s of every period_s
+	BurstRate float64 `yaml:"burst_rate"`
+	BurstS    float64 `yaml:"burst_s"`
+	PeriodS   float64 `yaml:"period_s"`
+	// request body, "{}" if empty
+	Body string `yaml:"body"`
+}
+
+// LoadRequest is one line of a trace, in the format feo-sim reads. Node is
+// the host:port of the feo node the invocation is sent to, Bytes pads the
+// body and ServiceMs is ignored.
+type LoadRequest struct {
+	SimRequest
+	// Dag invokes this DAG instead of App
+	Dag string `json:"dag"`
+}
+
+// LoadStage is one vertex of a DAG invocation, as reported in the
+// per-vertex headers of the reply. Vertex is the ID from the DAG manifest,
+// or the canonical form of the header key, e.g. Incrementby1 for
+// incrementBy1, if the node does not report it.
+type LoadStage struct {
+	Vertex        string
+	Location      string
+	InvocTimeMs   float64
+	QueueDepth    string
+	HistoricDepth string
+}
+
+// LoadResult is the outcome of one invocation. Times are relative to the
+// start of the run; the latency counts from when the invocation was due, so
+// that a lagging sender does not hide queueing.
+type LoadResult struct {
+	ID          int
+	Target      string
+	Kind        string
+	Name        string
+	ScheduledMs float64
+	SendLagMs   float64
+	LatencyMs   float64
+	Status      int
+	Error       string
+	// Invoc-Loc, Invoc-Time, InstQLEN and HistQLEN of feo
+	Location    string
+	InvocTimeMs float64
+	InstQlen    string
+	HistQlen    string
+	TierHops    string
+	StolenBy    string
+	Stages      []LoadStage
+}
+
+func (s LoadStream) name() string {
+	if s.Dag != "" {
+		return s.Dag
+	}
+	return s.Action
+}
+
+func (s LoadStream) Validate() error {
+	if s.Target == "" || (s.Action == "") == (s.Dag == "") {
+		return fmt.Errorf("a stream needs a target and either an action or a dag")
+	}
+	if s.Rate < 0 {
+		return fmt.Errorf("stream %s: rate must not be negative, got %v", s.name(), s.Rate)
+	}
+	switch s.Arrivals {
+	case "", "poisson", "constant":
+	case "bursty":
+		if s.BurstRate <= 0 || s.BurstS <= 0 || s.BurstS >= s.PeriodS {
+			return fmt.Errorf("stream %s: bursty arrivals need burst_rate > 0 and 0 < burst_s < period_s", s.name())
+		}
+	default:
+		return fmt.Errorf("stream %s: arrivals must be poisson, bursty or constant, got %q", s.name(), s.Arrivals)
+	}
+	return nil
+}
+
+// next returns the first arrival of s after t. ok is false if there is none.
+func (s LoadStream) next(rng *rand.Rand, t time.Duration) (time.Duration, bool) {
+	seconds := func(f float64) time.Duration { return time.Duration(f * float64(time.Second)) }
+	switch s.Arrivals {
+	case "constant":
+		if s.Rate == 0 {
+			return 0, false
+		}
+		return t + seconds(1/s.Rate), true
+	case "bursty":
+		// Poisson within every phase, which is exact since it is memoryless
+		period, burst := seconds(s.PeriodS), seconds(s.BurstS)
+		for {
+			start := t - t%period
+			rate, end := s.Rate, start+period
+			if t-start < burst {
+				rate, end = s.BurstRate, start+burst
+			}
+			if rate > 0 {
+				if at := t + seconds(rng.ExpFloat64()/rate); at < end {
+					return at, true
+				}
+			} else if s.Rate == 0 && s.BurstRate == 0 {
+				return 0, false
+			}
+			t = end
+		}
+	default:
+		if s.Rate == 0 {
+			return 0, false
+		}
+		return t + seconds(rng.ExpFloat64()/s.Rate), true
+	}
+}
+
+type loadJob struct {
+	at   time.Duration
+	req  LoadRequest
+	body []byte
+}
+
+func (j loadJob) url() string {
+	if j.req.Dag != "" {
+		return fmt.Sprintf("http://%s/api/v1/namespaces/guest/dag/%s", j.req.Node, j.req.Dag)
+	}
+	return fmt.Sprintf("http://%s/api/v1/namespaces/guest/actions/%s?blocking=true&result=true", j.req.Node, j.req.App)
+}
+
+// paddedBody is a JSON body of about n bytes.
+func paddedBody(n int64) []byte {
+	if n <= 0 {
+		return []byte("{}")
+	}
+	pad := n - int64(len(`{"payload": ""}`))
+	if pad < 0 {
+		pad = 0
+	}
+	return []byte(`{"payload": "` + strings.Repeat("x", int(pad)) + `"}`)
+}
+
+// loadSchedule returns the invocations of cfg in the order they are due.
+func loadSchedule(cfg LoadConfig) ([]loadJob, error) {
+	jobs := []loadJob{}
+	if cfg.Trace != "" {
+		f, err := os.Open(cfg.Trace)
+		if err != nil {
+			return nil, err
+		}
+		defer f.Close()
+		scanner := bufio.NewScanner(f)
+		for line := 1; scanner.Scan(); line++ {
+			if strings.TrimSpace(scanner.Text()) == "" {
+				continue
+			}
+			var req LoadRequest
+			if err := json.Unmarshal(scanner.Bytes(), &req); err != nil {
+				return nil, fmt.Errorf("%s:%d: %w", cfg.Trace, line, err)
+			}
+			if req.Node == "" || (req.App == "") == (req.Dag == "") {
+				return nil, fmt.Errorf("%s:%d: a request needs a node and either an app or a dag", cfg.Trace, line)
+			}
+			at := time.Duration(req.TsMs * float64(time.Millisecond))
+			jobs = append(jobs, loadJob{at: at, req: req, body: paddedBody(req.Bytes)})
+		}
+		if err := scanner.Err(); err != nil {
+			return nil, err
+		}
+	} else {
+		if cfg.DurationS <= 0 {
+			return nil, fmt.Errorf("duration_s must be positive without a trace")
+		}
+		end := time.Duration(cfg.DurationS * float64(time.Second))
+		rng := NewRand(cfg.Seed)
+		for _, s := range cfg.Streams {
+			if err := s.Validate(); err != nil {
+				return nil, err
+			}
+			body := []byte(s.Body)
+			if s.Body == "" {
+				body = []byte("{}")
+			}
+			req := LoadRequest{SimRequest: SimRequest{Node: s.Target, App: s.Action}, Dag: s.Dag}
+			for at, ok := s.next(rng, 0); ok && at < end; at, ok = s.next(rng, at) {
+				req.TsMs = float64(at.Microseconds()) / 1000
+				jobs = append(jobs, loadJob{at: at, req: req, body: body})
+			}
+		}
+	}
+	sort.SliceStable(jobs, func(i, j int) bool { return jobs[i].at < jobs[j].at })
+	return jobs, nil
+}
+
+// runLoad sends the invocations of jobs when they are due, without waiting for
+// earlier ones, and returns their results in the order of jobs.
+func runLoad(cfg LoadConfig, jobs []loadJob) []LoadResult {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.MaxIdleConnsPerHost = 256
+	client := &http.Client{Timeout: time.Duration(cfg.TimeoutMs) * time.Millisecond, Transport: transport}
+	inflight := make(chan bool, cfg.MaxInflight)
+	results := make([]LoadResult, len(jobs))
+
+	var wg sync.WaitGroup
+	start := time.Now()
+	for i, job := range jobs {
+		if wait := job.at - time.Since(start); wait > 0 {
+			time.Sleep(wait)
+		}
+		select {
+		case inflight <- true:
+		default:
+			results[i] = newLoadResult(i, job)
+			results[i].Error = "dropped"
+			continue
+		}
+		wg.Add(1)
+		go func(i int, job loadJob) {
+			defer wg.Done()
+			defer func() { <-inflight }()
+			results[i] = sendLoad(client, start, i, job)
+		}(i, job)
+	}
+	wg.Wait()
+	return results
+}
+
+func newLoadResult(id int, job loadJob) LoadResult {
+	res := LoadResult{ID: id, Target: job.req.Node, Kind: "action", Name: job.req.App, ScheduledMs: float64(job.at.Microseconds()) / 1000}
+	if job.req.Dag != "" {
+		res.Kind, res.Name = "dag", job.req.Dag
+	}
+	return res
+}
+
+func sendLoad(client *http.Client, start time.Time, id int, job loadJob) (res LoadResult) {
+	res = newLoadResult(id, job)
+	sent := time.Since(start)
+	res.SendLagMs = float64((sent - job.at).Microseconds()) / 1000
+	defer func() { res.LatencyMs = float64((time.Since(start) - job.at).Microseconds()) / 1000 }()
+
+	req, err := http.NewRequest(http.MethodPost, job.url(), bytes.NewReader(job.body))
+	if err != nil {
+		res.Error = err.Error()
+		return res
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := client.Do(req)
+	if err != nil {
+		res.Error = err.Error()
+		return res
+	}
+	io.Copy(io.Discard, resp.Body)
+	resp.Body.Close()
+
+	res.Status = resp.StatusCode
+	parseInvocHeaders(&res, resp.Header)
+	return res
+}
+
+// parseInvocHeaders reads the headers feo sets on the reply of an invocation,
+// and the per-vertex ones of a DAG invocation.
+func parseInvocHeaders(res *LoadResult, h http.Header) {
+	res.Location = h.Get("Invoc-Loc")
+	res.InvocTimeMs = durationHeaderMs(h.Get("Invoc-Time"))
+	res.InstQlen = h.Get("InstQLEN")
+	res.HistQlen = h.Get("HistQLEN")
+	res.TierHops = h.Get(TierHopsHeader)
+	res.StolenBy = h.Get(StolenByHeader)
+
+	stages := map[string]*LoadStage{}
+	stage := func(vertex string) *LoadStage {
+		if stages[vertex] == nil {
+			stages[vertex] = &LoadStage{Vertex: vertex}
+		}
+		return stages[vertex]
+	}
+	for key := range h {
+		switch {
+		case strings.HasPrefix(key, "Invoc-Time-"):
+			stage(strings.TrimPrefix(key, "Invoc-Time-")).InvocTimeMs = durationHeaderMs(h.Get(key))
+		case strings.HasPrefix(key, "Invoc-Loc-"):
+			stage(strings.TrimPrefix(key, "Invoc-Loc-")).Location = h.Get(key)
+		case strings.HasPrefix(key, "Invoc-Queue-Depth-"):
+			stage(strings.TrimPrefix(key, "Invoc-Queue-Depth-")).QueueDepth = h.Get(key)
+		case strings.HasPrefix(key, "Invoc-Historic-Depth-"):
+			stage(strings.TrimPrefix(key, "Invoc-Historic-Depth-")).HistoricDepth = h.Get(key)
+		case strings.HasPrefix(key, "Invoc-Vertex-"):
+			stage(strings.TrimPrefix(key, "Invoc-Vertex-")).Vertex = h.Get(key)
+		}
+	}
+	for _, s := range stages {
+		res.Stages = append(res.Stages, *s)
+	}
+	sort.Slice(res.Stages, func(i, j int) bool { return res.Stages[i].Vertex < res.Stages[j].Vertex })
+}
+
+// durationHeaderMs parses a duration as written by MetricSMElapsed, e.g. "12.5ms".
+func durationHeaderMs(v string) float64 {
+	d, err := time.ParseDuration(v)
+	if err != nil {
+		return 0
+	}
+	return float64(d.Microseconds()) / 1000
+}
+
+// loadSummary aggregates the results of a target and action or DAG.
+type loadSummary struct {
+	target, name                                      string
+	sent, ok, errors, dropped, local, offload, stolen int
+	latencies                                         []float64
+}
+
+func summarizeLoad(results []LoadResult) []*loadSummary {
+	keys := []string{}
+	summaries := map[string]*loadSummary{}
+	all := &loadSummary{target: "all", name: "all"}
+	for _, r := range results {
+		key := r.Target + "/" + r.Name
+		sum, ok := summaries[key]
+		if !ok {
+			sum = &loadSummary{target: r.Target, name: r.Name}
+			summaries[key] = sum
+			keys = append(keys, key)
+		}
+		for _, s := range []*loadSummary{sum, all} {
+			s.add(r)
+		}
+	}
+	sort.Strings(keys)
+	list := []*loadSummary{}
+	for _, key := range keys {
+		list = append(list, summaries[key])
+	}
+	list = append(list, all)
+	for _, s := range list {
+		sort.Float64s(s.latencies)
+	}
+	return list
+}
+
+func (s *loadSummary) add(r LoadResult) {
+	s.sent++
+	switch {
+	case r.Error == "dropped":
+		s.dropped++
+		return
+	case r.Error != "" || r.Status != http.StatusOK:
+		s.errors++
+		return
+	}
+	s.ok++
+	s.latencies = append(s.latencies, r.LatencyMs)
+	switch r.Location {
+	case "Local":
+		s.local++
+	case "Offload":
+		s.offload++
+	case "Stolen":
+		s.stolen++
+	}
+}
+
+var loadSummaryHeader = []string{"target", "name", "sent", "ok", "errors", "dropped", "local", "offload", "stolen", "mean_ms", "p50_ms", "p90_ms", "p95_ms", "p99_ms", "max_ms"}
+
+func (s *loadSummary) row() []string {
+	mean, ps := 0.0, []float64{0, 0, 0, 0, 0}
+	if len(s.latencies) > 0 {
+		for _, l := range s.latencies {
+			mean += l
+		}
+		mean /= float64(len(s.latencies))
+		for i, p := range []float64{50, 90, 95, 99, 100} {
+			ps[i] = percentile(s.latencies, p)
+		}
+	}
+	row := []string{s.target, s.name}
+	for _, n := range []int{s.sent, s.ok, s.errors, s.dropped, s.local, s.offload, s.stolen} {
+		row = append(row, strconv.Itoa(n))
+	}
+	for _, v := range append([]float64{mean}, ps...) {
+		row = append(row, strconv.FormatFloat(v, 'f', 3, 64))
+	}
+	return row
+}
+
+func writeCSV(path string, header []string, rows [][]string) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	w := csv.NewWriter(f)
+	w.Write(header)
+	w.WriteAll(rows)
+	return w.Error()
+}
+
+// writeLoadResults writes requests.csv, stages.csv with the vertices of DAG
+// invocations, and summary.csv to dir.
+func writeLoadResults(dir string, results []LoadResult) error {
+	ftoa := func(v float64) string { return strconv.FormatFloat(v, 'f', 3, 64) }
+	requests, stages := [][]string{}, [][]string{}
+	for _, r := range results {
+		requests = append(requests, []string{
+			strconv.Itoa(r.ID), r.Target, r.Kind, r.Name, ftoa(r.ScheduledMs), ftoa(r.SendLagMs), ftoa(r.LatencyMs),
+			strconv.Itoa(r.Status), r.Error, r.Location, ftoa(r.InvocTimeMs), r.InstQlen, r.HistQlen, r.TierHops, r.StolenBy,
+		})
+		for _, s := range r.Stages {
+			stages = append(stages, []string{strconv.Itoa(r.ID), r.Name, s.Vertex, s.Location, ftoa(s.InvocTimeMs), s.QueueDepth, s.HistoricDepth})
+		}
+	}
+	if err := writeCSV(filepath.Join(dir, "requests.csv"), []string{
+		"id", "target", "kind", "name", "scheduled_ms", "send_lag_ms", "latency_ms", "status", "error",
+		"location", "invoc_time_ms", "inst_qlen", "hist_qlen", "tier_hops", "stolen_by",
+	}, requests); err != nil {
+		return err
+	}
+	if err := writeCSV(filepath.Join(dir, "stages.csv"), []string{"id", "dag", "vertex", "location", "invoc_time_ms", "queue_depth", "historic_depth"}, stages); err != nil {
+		return err
+	}
+	summary := [][]string{}
+	for _, s := range summarizeLoad(results) {
+		summary = append(summary, s.row())
+	}
+	return writeCSV(filepath.Join(dir, "summary.csv"), loadSummaryHeader, summary)
+}
+
+// LoadMain is the entry point of feo-load. The workload is read from -config,
+// or is the single stream given by the other flags.
+func LoadMain() {
+	log.SetFlags(log.LstdFlags | log.Lshortfile)
+	var configPath = flag.String("config", "", "YML description of the workload, replaces the stream flags")
+	var outDir = flag.String("out", ".", "directory the CSVs are written to")
+	var trace = flag.String("trace", "", "JSONL trace to replay instead of the streams")
+	var target = flag.String("target", "127.0.0.1:9696", "feo node to send the stream to")
+	var action = flag.String("action", "", "action to invoke")
+	var dag = flag.String("dag", "", "DAG to invoke instead of an action")
+	var arrivals = flag.String("arrivals", "poisson", "poisson, bursty or constant")
+	var rate = flag.Float64("rate", 10, "invocations per second")
+	var duration = flag.Float64("duration", 10, "seconds to send for")
+	var seed = flag.Int64("seed", 1, "seed of the arrival times, 0 picks one from the clock")
+	flag.Parse()
+
+	cfg := LoadConfig{Seed: *seed, DurationS: *duration}
+	if *configPath != "" {
+		f, err := os.ReadFile(*configPath)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if err := yaml.Unmarshal(f, &cfg); err != nil {
+			log.Fatal(err)
+		}
+		if cfg.Trace != "" && !filepath.IsAbs(cfg.Trace) {
+			cfg.Trace = filepath.Join(filepath.Dir(*configPath), cfg.Trace)
+		}
+	} else if *trace == "" {
+		cfg.Streams = []LoadStream{{Target: *target, Action: *action, Dag: *dag, Arrivals: *arrivals, Rate: *rate}}
+	}
+	if *trace != "" {
+		cfg.Trace = *trace
+	}
+	if cfg.TimeoutMs <= 0 {
+		cfg.TimeoutMs = DEFAULT_LOAD_TIMEOUT_MS
+	}
+	if cfg.MaxInflight <= 0 {
+		cfg.MaxInflight = DEFAULT_LOAD_MAX_INFLIGHT
+	}
+
+	jobs, err := loadSchedule(cfg)
+	if err != nil {
+		log.Fatal(err)
+	}
+	log.Printf("[INFO] sending %d invocations\n", len(jobs))
+	start := time.Now()
+	results := runLoad(cfg, jobs)
+	log.Printf("[INFO] done in %s\n", time.Since(start).Round(time.Millisecond))
+	if err := writeLoadResults(*outDir, results); err != nil {
+		log.Fatal(err)
+	}
+
+	w := csv.NewWriter(os.Stdout)
+	w.Write(loadSummaryHeader)
+	for _, s := range summarizeLoad(results) {
+		w.Write(s.row())
+	}
+	w.Flush()
+}
@@ -0,0 +1,442 @@
+package feo
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"math/rand"
+	"net"
+	"net/http"
+	"net/url"
+	"reflect"
+	"sync"
+	"time"
+)
+
+const (
+	DEFAULT_MEMBERSHIP_INTERVAL_MS = 1000
+	DEFAULT_MEMBERSHIP_TIMEOUT_MS  = 500
+	DEFAULT_INDIRECT_PROBES        = 2
+	DEFAULT_SUSPECT_TIMEOUT_MS     = 3000
+)
+
+// MembershipConfig enables the failure detector. The configured peers become
+// the initial members, others join and leave through the admin API.
+type MembershipConfig struct {
+	Enabled    bool `yaml:"enabled"`
+	IntervalMs int  `yaml:"interval_ms"`
+	TimeoutMs  int  `yaml:"timeout_ms"`
+	// members asked to ping a member that missed a direct ping
+	IndirectProbes int `yaml:"indirect_probes"`
+	// suspect members are declared dead after this long
+	SuspectTimeoutMs int `yaml:"suspect_timeout_ms"`
+	// nodes that probe this one are added as members, if they probe from the
+	// address they claim and it is in one of join_cidrs
+	AutoJoin  bool     `yaml:"auto_join"`
+	JoinCIDRs []string `yaml:"join_cidrs"`
+}
+
+// Validate requires auto_join to be limited to some networks.
+func (c MembershipConfig) Validate() error {
+	if c.AutoJoin && len(c.JoinCIDRs) == 0 {
+		return fmt.Errorf("membership: auto_join needs join_cidrs")
+	}
+	for _, cidr := range c.JoinCIDRs {
+		if _, _, err := net.ParseCIDR(cidr); err != nil {
+			return fmt.Errorf("membership: %w", err)
+		}
+	}
+	return nil
+}
+
+type MemberState string
+
+const (
+	MemberAlive   MemberState = "alive"
+	MemberSuspect MemberState = "suspect"
+	MemberDead    MemberState = "dead"
+	// left members are not probed and not auto-joined again until they join through the API
+	MemberLeft MemberState = "left"
+)
+
+type Member struct {
+	Host  string      `json:"host"`
+	State MemberState `json:"state"`
+	// when the member entered State
+	Since    time.Time `json:"since"`
+	LastSeen time.Time `json:"last_seen"`
+	// config, api or auto
+	Source string `json:"source"`
+}
+
+// Membership tracks the peers of this node SWIM-style. Every member is pinged
+// each round. A member that misses the ping is pinged indirectly through
+// IndirectProbes other members, so that a lossy link alone does not fail it.
+// If that fails too it becomes suspect, and dead once it stayed suspect for
+// SuspectTimeoutMs. Dead members are still pinged and come back as alive.
+// Only alive members are offloaded to; onChange is called with them whenever
+// they change. A nil *Membership is valid and has no members.
+type Membership struct {
+	host   string
+	cfg    MembershipConfig
+	client http.Client
+	// onChange is called with the alive members, in the order they joined
+	onChange func(peers []string)
+	// rng picks the helpers of indirect pings
+	rng *rand.Rand
+
+	mu      sync.RWMutex
+	members map[string]*Member
+	order   []string
+
+	notifyMu sync.Mutex
+	active   []string
+
+	quit chan bool
+	wg   sync.WaitGroup
+}
+
+func newMembership(cfg MembershipConfig, host string, peers []string, onChange func(peers []string), rng *rand.Rand) *Membership {
+	if cfg.IntervalMs <= 0 {
+		cfg.IntervalMs = DEFAULT_MEMBERSHIP_INTERVAL_MS
+	}
+	if cfg.TimeoutMs <= 0 {
+		cfg.TimeoutMs = DEFAULT_MEMBERSHIP_TIMEOUT_MS
+	}
+	if cfg.IndirectProbes < 0 {
+		cfg.IndirectProbes = 0
+	} else if cfg.IndirectProbes == 0 {
+		cfg.IndirectProbes = DEFAULT_INDIRECT_PROBES
+	}
+	if cfg.SuspectTimeoutMs <= 0 {
+		cfg.SuspectTimeoutMs = DEFAULT_SUSPECT_TIMEOUT_MS
+	}
+	m := &Membership{host: host, cfg: cfg, onChange: onChange, rng: rng, members: map[string]*Member{}, quit: make(chan bool)}
+	// pings get their own connections so that they are not queued behind offloads
+	m.client = http.Client{Timeout: time.Duration(cfg.TimeoutMs) * time.Millisecond, Transport: &http.Transport{}}
+	for _, peer := range peers {
+		m.add(peer, "config")
+	}
+	m.active = m.Active()
+	return m
+}
+
+func (m *Membership) start() {
+	log.Printf("[INFO] Checking %d members every %dms\n", len(m.order), m.cfg.IntervalMs)
+	m.wg.Add(1)
+	go m.probeRoutine()
+}
+
+func (m *Membership) Close() {
+	if m == nil {
+		return
+	}
+	close(m.quit)
+	m.wg.Wait()
+}
+
+// add must be called with m.mu held, or before the membership is shared.
+func (m *Membership) add(host string, source string) {
+	now := time.Now()
+	if mem, ok := m.members[host]; ok {
+		mem.State, mem.Since, mem.LastSeen, mem.Source = MemberAlive, now, now, source
+		return
+	}
+	m.members[host] = &Member{Host: host, State: MemberAlive, Since: now, LastSeen: now, Source: source}
+	m.order = append(m.order, host)
+}
+
+// remove must be called with m.mu held.
+func (m *Membership) remove(host string) {
+	delete(m.members, host)
+	for i, h := range m.order {
+		if h == host {
+			m.order = append(m.order[:i:i], m.order[i+1:]...)
+			break
+		}
+	}
+}
+
+// Join adds host as an alive member, also if it left before.
+func (m *Membership) Join(host string) {
+	m.mu.Lock()
+	m.add(host, "api")
+	m.mu.Unlock()
+	log.Printf("[INFO] %s joined\n", host)
+	m.notify()
+}
+
+// Leave stops offloading to and probing host. It returns false if host is not a member.
+func (m *Membership) Leave(host string) bool {
+	m.mu.Lock()
+	mem, ok := m.members[host]
+	if ok {
+		mem.State, mem.Since = MemberLeft, time.Now()
+	}
+	m.mu.Unlock()
+	if !ok {
+		return false
+	}
+	log.Printf("[INFO] %s left\n", host)
+	m.notify()
+	return true
+}
+
+// seen is called when host probed this node from remoteAddr. Unknown hosts
+// are added if they may join, dead or suspect members are alive again.
+func (m *Membership) seen(host string, remoteAddr string) {
+	if m == nil || host == "" || host == m.host {
+		return
+	}
+	m.mu.Lock()
+	mem, ok := m.members[host]
+	changed := false
+	switch {
+	case !ok && m.mayJoin(host, remoteAddr):
+		m.add(host, "auto")
+		log.Printf("[INFO] %s joined\n", host)
+		changed = true
+	case ok && mem.State != MemberLeft:
+		mem.LastSeen = time.Now()
+		if mem.State != MemberAlive {
+			mem.State, mem.Since = MemberAlive, mem.LastSeen
+			changed = true
+		}
+	}
+	m.mu.Unlock()
+	if changed {
+		m.notify()
+	}
+}
+
+// mayJoin reports whether host, probing from remoteAddr, is admitted by auto_join.
+func (m *Membership) mayJoin(host string, remoteAddr string) bool {
+	if !m.cfg.AutoJoin {
+		return false
+	}
+	claimed, _, err := net.SplitHostPort(host)
+	if err != nil {
+		return false
+	}
+	from, _, err := net.SplitHostPort(remoteAddr)
+	if err != nil {
+		return false
+	}
+	ip := net.ParseIP(claimed)
+	if ip == nil || !ip.Equal(net.ParseIP(from)) {
+		return false
+	}
+	for _, cidr := range m.cfg.JoinCIDRs {
+		if _, network, err := net.ParseCIDR(cidr); err == nil && network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// isMember reports whether host is a member that has not left.
+func (m *Membership) isMember(host string) bool {
+	return m != nil && m.state(host) != MemberLeft
+}
+
+// sync applies the peers of a reloaded config. Configured members that are no
+// longer listed are removed, members that joined otherwise are kept.
+func (m *Membership) sync(peers []string) {
+	configured := map[string]bool{}
+	m.mu.Lock()
+	for _, peer := range peers {
+		configured[peer] = true
+		if _, ok := m.members[peer]; !ok {
+			m.add(peer, "config")
+		}
+	}
+	for _, host := range append([]string{}, m.order...) {
+		if m.members[host].Source == "config" && !configured[host] {
+			m.remove(host)
+		}
+	}
+	m.mu.Unlock()
+	m.notify()
+}
+
+// Members returns a copy of every member, including the ones that left.
+func (m *Membership) Members() []Member {
+	if m == nil {
+		return nil
+	}
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	members := make([]Member, 0, len(m.order))
+	for _, host := range m.order {
+		members = append(members, *m.members[host])
+	}
+	return members
+}
+
+// Active returns the alive members.
+func (m *Membership) Active() []string {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	active := []string{}
+	for _, host := range m.order {
+		if m.members[host].State == MemberAlive {
+			active = append(active, host)
+		}
+	}
+	return active
+}
+
+// notify calls onChange if the alive members changed since the last call.
+func (m *Membership) notify() {
+	m.notifyMu.Lock()
+	defer m.notifyMu.Unlock()
+	active := m.Active()
+	if reflect.DeepEqual(active, m.active) {
+		return
+	}
+	m.active = active
+	if m.onChange != nil {
+		m.onChange(active)
+	}
+}
+
+func (m *Membership) probeRoutine() {
+	defer m.wg.Done()
+
+	probe_timer := time.NewTicker(time.Duration(m.cfg.IntervalMs) * time.Millisecond)
+	defer probe_timer.Stop()
+	for {
+		select {
+		case <-m.quit:
+			return
+		case <-probe_timer.C:
+			m.probeAll()
+		}
+	}
+}
+
+func (m *Membership) probeAll() {
+	m.mu.RLock()
+	targets := []string{}
+	for _, host := range m.order {
+		// this node is in the peers of some configs, it is always alive
+		if host != m.host && m.members[host].State != MemberLeft {
+			targets = append(targets, host)
+		}
+	}
+	m.mu.RUnlock()
+
+	var wg sync.WaitGroup
+	for _, host := range targets {
+		wg.Add(1)
+		go func(host string) {
+			defer wg.Done()
+			m.probe(host)
+		}(host)
+	}
+	wg.Wait()
+	m.notify()
+}
+
+func (m *Membership) probe(host string) {
+	err := m.ping(host, "")
+	if err != nil && m.state(host) != MemberDead {
+		err = m.pingIndirect(host)
+	}
+
+	now := time.Now()
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	mem, ok := m.members[host]
+	if !ok || mem.State == MemberLeft {
+		// it left while it was probed
+		return
+	}
+	if err == nil {
+		mem.LastSeen = now
+		if mem.State != MemberAlive {
+			log.Printf("[INFO] member %s is alive\n", host)
+			mem.State, mem.Since = MemberAlive, now
+		}
+		return
+	}
+	switch mem.State {
+	case MemberAlive:
+		log.Printf("[WARNING] member %s is suspect: %v\n", host, err)
+		mem.State, mem.Since = MemberSuspect, now
+	case MemberSuspect:
+		if now.Sub(mem.Since) >= time.Duration(m.cfg.SuspectTimeoutMs)*time.Millisecond {
+			log.Printf("[WARNING] member %s is dead\n", host)
+			mem.State, mem.Since = MemberDead, now
+		}
+	}
+}
+
+func (m *Membership) state(host string) MemberState {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	if mem, ok := m.members[host]; ok {
+		return mem.State
+	}
+	return MemberLeft
+}
+
+// pingIndirect asks up to IndirectProbes random alive members to ping host and
+// succeeds if any of them reached it.
+func (m *Membership) pingIndirect(host string) error {
+	helpers := []string{}
+	for _, peer := range m.Active() {
+		if peer != host && peer != m.host {
+			helpers = append(helpers, peer)
+		}
+	}
+	m.rng.Shuffle(len(helpers), func(i, j int) { helpers[i], helpers[j] = helpers[j], helpers[i] })
+	if len(helpers) > m.cfg.IndirectProbes {
+		helpers = helpers[:m.cfg.IndirectProbes]
+	}
+	if len(helpers) == 0 {
+		return fmt.Errorf("no member to ping %s through", host)
+	}
+
+	reached := make(chan bool, len(helpers))
+	for _, helper := range helpers {
+		go func(helper string) {
+			reached <- m.ping(helper, host) == nil
+		}(helper)
+	}
+	for range helpers {
+		if <-reached {
+			return nil
+		}
+	}
+	return fmt.Errorf("not reached through %v", helpers)
+}
+
+// ping pings host, or target through host if target is set.
+func (m *Membership) ping(host string, target string) error {
+	u := "http://" + host + "/api/v1/namespaces/guest/ping"
+	if target != "" {
+		u += "?target=" + url.QueryEscape(target)
+	}
+	req, err := http.NewRequest(http.MethodGet, u, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("X-Feo-Member", m.host)
+
+	client := m.client
+	if target != "" {
+		// the helper waits for its own ping of target
+		client.Timeout *= 2
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	io.Copy(io.Discard, resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNoContent {
+		return fmt.Errorf("ping returned %s", resp.Status)
+	}
+	return nil
+}
@@ -0,0 +1,154 @@
+package feo
+
+import (
+	"log"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// NodeOptions are the parts of a node that are not configured in YAML.
+type NodeOptions struct {
+	// ConfigPath is re-read by Reload and anchors relative DAG manifests.
+	ConfigPath string
+	// Transport carries the requests of the node to its peers and replicas,
+	// http.DefaultTransport if nil. Harnesses inject network latency here.
+	Transport http.RoundTripper
+	// Clock drives the offloaders and circuit breakers, WallClock if nil.
+	Clock Clock
+}
+
+// Node is a feo node: the request handler and the services enabled in its
+// config. Main runs one, harnesses run several in one process. Note that the
+// local/offload counters in the logs are shared by the nodes of a process.
+type Node struct {
+	handler   *requestHandler
+	server    *http.Server
+	closeOnce sync.Once
+}
+
+// NewNode validates config, starts the services it enables and registers its
+// applications. The node serves once Serve or ListenAndServe is called.
+func NewNode(config FeoConfig, opts NodeOptions) (*Node, error) {
+	if _, err := LoadPolicyParams(OffloadPolicy(config.Policy.Name), config.Policy.Config); err != nil {
+		return nil, err
+	}
+	if err := validateCosts(config.Costs); err != nil {
+		return nil, err
+	}
+	if err := config.Tiering.Validate(); err != nil {
+		return nil, err
+	}
+	if err := config.Membership.Validate(); err != nil {
+		return nil, err
+	}
+
+	handler := &requestHandler{config: config, configPath: opts.ConfigPath, applicationMap: map[string]*Application{}, host: config.Host, dagMap: map[string]*FaasEdgeDag{}, declaredDags: map[string][]byte{}, peers: config.Peers, rng: NewRand(config.Seed)}
+	handler.clock = opts.Clock
+	if handler.clock == nil {
+		handler.clock = WallClock{}
+	}
+	handler.client = &http.Client{Timeout: 20 * time.Second, Transport: opts.Transport}
+	handler.transport = opts.Transport
+	handler.quit = make(chan bool)
+	n := &Node{handler: handler}
+	n.server = &http.Server{
+		Addr:           config.Host,
+		Handler:        handler,
+		ReadTimeout:    10 * time.Second,
+		WriteTimeout:   10 * time.Second,
+		MaxHeaderBytes: 1 << 20,
+	}
+
+	var err error
+	if config.Probe.Enabled {
+		handler.prober = newProber(config.Probe, config.Host, config.Peers)
+		if opts.Transport != nil {
+			handler.prober.client.Transport = opts.Transport
+		}
+		handler.prober.start()
+	}
+	if config.Breaker.Enabled {
+		handler.breakers = newBreakers(config.Breaker, handler.clock)
+	}
+	if config.DecisionLog.Enabled {
+		if handler.decisionLog, err = newDecisionLog(config.DecisionLog); err != nil {
+			n.Close()
+			return nil, err
+		}
+		handler.decisionLog.start()
+	}
+	if config.Membership.Enabled {
+		handler.membership = newMembership(config.Membership, config.Host, config.Peers, handler.setPeers, handler.rng)
+		if opts.Transport != nil {
+			handler.membership.client.Transport = opts.Transport
+		}
+		handler.membership.start()
+	}
+	if config.Gossip.Enabled {
+		handler.gossip = newGossiper(config.Gossip, config.Host, handler.getPeers, handler.localSnapshots, handler.rng)
+		if opts.Transport != nil {
+			handler.gossip.client.Transport = opts.Transport
+		}
+		handler.gossip.start()
+	}
+	if config.DataDir != "" {
+		if handler.store, err = newRegistryStore(config.DataDir); err != nil {
+			n.Close()
+			return nil, err
+		}
+		if err := handler.restoreRegistry(); err != nil {
+			n.Close()
+			return nil, err
+		}
+		go handler.persistRoutine()
+	}
+	if err := handler.reconcile(config); err != nil {
+		n.Close()
+		return nil, err
+	}
+	if config.Steal.Enabled {
+		log.Println("[INFO] Work stealing enabled")
+		go handler.stealRoutine()
+	}
+	return n, nil
+}
+
+// Host is the address the node is known by to its peers.
+func (n *Node) Host() string {
+	return n.handler.host
+}
+
+// ListenAndServe serves on the host of the config until the node is closed.
+func (n *Node) ListenAndServe() error {
+	return n.server.ListenAndServe()
+}
+
+// Serve serves on l until the node is closed.
+func (n *Node) Serve(l net.Listener) error {
+	return n.server.Serve(l)
+}
+
+// Reload re-reads the config file, as done on SIGHUP.
+func (n *Node) Reload() {
+	n.handler.reloadConfig()
+}
+
+// Close persists the offloader state, stops serving and stops the
+// offloaders and services of the node. Serve returns http.ErrServerClosed.
+func (n *Node) Close() {
+	n.closeOnce.Do(func() {
+		r := n.handler
+		r.persistOffloaderState()
+		n.server.Close()
+		close(r.quit)
+		for _, app := range r.getApplications() {
+			app.getOffloader().Close()
+		}
+		r.prober.Close()
+		r.gossip.Close()
+		r.membership.Close()
+		r.decisionLog.Close()
+	})
+}
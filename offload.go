@@ -1,10 +1,11 @@
-package main
+package feo
 
 import (
 	"container/list"
 	"encoding/json"
 	"log"
 	"math"
+	"math/rand"
 	"net/http"
 	"strings"
 	"sync"
@@ -18,18 +19,7 @@ type router struct {
 
 type OffloadPolicy string
 
-const (
-	OffloadBase        = "base"
-	OffloadRoundRobin  = "roundrobin"
-	OffloadRandom      = "random"
-	OffloadFederated   = "federated"
-	OffloadCentral     = "central"
-	OffloadHybrid      = "hybrid"
-	OffloadImpedence   = "impedence"
-	RandomProportional = "randomproportional"
-	RRLatency          = "roundrobinlatency"
-	OffloadEpoch       = "epoch"
-)
+const OffloadBase = "base"
 
 type MetricSMState string
 
@@ -47,45 +37,17 @@ const (
 const (
 	OffloadSuccess = "Offload-Success"
 	NodeStatus     = "Node-Status"
+	// RetryHeader marks errors of a healthy node, e.g. while an app is redeployed
+	RetryHeader = "Feo-Retry"
 )
 
-func OffloadFactory(pol OffloadPolicy, config FeoConfig) OffloaderIntf {
-	base := NewBaseOffloader(config)
-	switch pol {
-	case OffloadRoundRobin:
-		log.Println("[INFO] Selecting RoundRobin Offloader")
-		return NewRoundRobinOffloader(base)
-	case OffloadRandom:
-		log.Println("[INFO] Selecting Random Offloader")
-		return NewRandomOffloader(base)
-	case OffloadFederated:
-		log.Println("[INFO] Selecting Federated Offloader")
-		return NewFederatedOffloader(base)
-	case OffloadHybrid:
-		log.Println("[INFO] Selecting Hybrid Offloader")
-		return NewHybridOffloader(base)
-	case OffloadCentral:
-		log.Println("[INFO] Selecting Central Offloader")
-		return NewCentralizedOffloader(base)
-	case OffloadImpedence:
-		log.Println("[INFO] Selecting Impedence Offloader")
-		return NewImpedenceOffloader(base)
-	case RandomProportional:
-		log.Println("[INFO] Selecting Radnom Proportional Offloader")
-		return NewRandomPropOffloader(base)
-	case RRLatency:
-		log.Println("[INFO] Selecting Round Robin Latency Offloader")
-		return NewRRLatencyOffloader(base)
-	case OffloadEpoch:
-		log.Println("[INFO] Selecting Epoch Offloader")
-		return NewEpochOffloader(base)
-	case OffloadBase:
-		log.Println("[INFO] Selecting Base Offloader")
-		return base
-	default:
-		log.Println("[WARNING] No policy specified. Selecting Base Offloader")
-		return base
-	}
+func init() {
+	RegisterPolicy(PolicyRegistration{
+		Name: OffloadBase,
+		New: func(base *BaseOffloader, params PolicyParams) OffloaderIntf {
+			return base
+		},
+	})
 }
 
 type MetricSM struct {
@@ -106,42 +68,24 @@ type MetricSM struct {
 	local          bool
 	localByDefault bool
 	localAfterFail bool
+	// the invocation was offloaded here by a peer
+	forwarded bool
+	// decision is nil unless the decision log is enabled
+	decision *Decision
 }
 
 func (o *BaseOffloader) update_qlen() {
 
-	window_size_s := 1
-	// pctl := 90.0
-	qlen_timer := time.NewTicker(time.Duration(100) * time.Millisecond)
+	qlen_timer := o.Clock.NewTicker(time.Duration(100) * time.Millisecond)
+	defer qlen_timer.Stop()
 
 	for {
 		select {
 		case <-o.quit:
 			return
-		case qi := <-o.qlen_info_chan:
-			o.qlens_over_time = append(o.qlens_over_time, qi)
-		case <-qlen_timer.C:
-			start := 0
-			var qlen_arr []float64
-			for i, v := range o.qlens_over_time {
-				if time.Since(v.ts) <= time.Duration(window_size_s)*time.Second {
-					start = i
-					break
-				}
-			}
-
-			o.qlens_over_time = o.qlens_over_time[start:]
-			for _, v := range o.qlens_over_time {
-				qlen_arr = append(qlen_arr, float64(v.len))
-			}
-			// res, _ := stats.Percentile(qlen_arr, pctl)
-			//res, _ := stats.Mean(qlen_arr)
-			//if !math.IsNaN(res) {
-			//	o.Finfo.set_historic_qlen(float32(res))
-			//} else {
-			//	o.Finfo.set_historic_qlen(-1)
-			//}
-			o.Finfo.set_historic_qlen(-1)
+		case now := <-qlen_timer.C():
+			// the historic qlen is smoothed by the estimator of the application
+			o.Finfo.update_historic_qlen(now)
 
 		}
 	}
@@ -168,6 +112,30 @@ type FunctionInfo struct {
 	invoke_list   *list.List
 	mu            sync.Mutex
 	historic_qlen float32
+	// historic smooths historic_qlen, guarded by mu
+	historic QlenEstimator
+	// svc survives policy switches along with the queue, as does cost
+	svc  serviceTimeEstimator
+	cost costAccount
+}
+
+// newFunctionInfo creates an empty queue whose historic qlen is smoothed by historic.
+func newFunctionInfo(historic QlenEstimator) *FunctionInfo {
+	return &FunctionInfo{invoke_list: list.New(), historic_qlen: 0.0, historic: historic}
+}
+
+// invocation is an entry of FunctionInfo.invoke_list. An invocation that is
+// still waiting for a local replica can be handed over to an idle peer.
+type invocation struct {
+	ts        time.Time
+	started   bool
+	stealable bool
+	thief     string
+	stolen    chan string
+}
+
+func newInvocation(ts time.Time) *invocation {
+	return &invocation{ts: ts, stolen: make(chan string, 1)}
 }
 
 func (f *FunctionInfo) getSnapshot() Snapshot {
@@ -177,25 +145,50 @@ func (f *FunctionInfo) getSnapshot() Snapshot {
 		Name:         f.name,
 		Qlen:         f.invoke_list.Len(),
 		HistoricQlen: f.historic_qlen,
+		ServiceTime:  f.svc.get(),
 	}
 }
 
-func (f *FunctionInfo) set_historic_qlen(qlen float32) {
+// getName returns the action name learned from the first invocation, set by ForceEnq.
+func (f *FunctionInfo) getName() string {
 	f.mu.Lock()
 	defer f.mu.Unlock()
+	return f.name
+}
 
-	if qlen == -1 {
-		f.historic_qlen = 0.7*f.historic_qlen + 0.3*float32(f.invoke_list.Len())
-	} else {
-		f.historic_qlen = qlen
-	}
+// observeServiceTime records how long an invocation ran on a local replica.
+func (f *FunctionInfo) observeServiceTime(d time.Duration) {
+	f.svc.observe(d)
+}
+
+func (f *FunctionInfo) addCost(node string, cost float64) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.cost.add(node, cost)
+}
+
+// getCost returns what the invocations of the application cost so far.
+func (f *FunctionInfo) getCost() CostStats {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.cost.get()
+}
+
+// update_historic_qlen feeds the current qlen, as of now, to the estimator of the historic qlen.
+func (f *FunctionInfo) update_historic_qlen(now time.Time) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.historic.Observe(float64(f.invoke_list.Len()), now)
+	f.historic_qlen = float32(f.historic.Estimate())
 }
 
 type Snapshot struct {
-	Name         string  `json:"name"`
-	Qlen         int     `json:"qlen"`
-	HasCapacity  bool    `json:"hascapacity"`
-	HistoricQlen float32 `json:"historic_qlen"`
+	Name         string      `json:"name"`
+	Qlen         int         `json:"qlen"`
+	HasCapacity  bool        `json:"hascapacity"`
+	HistoricQlen float32     `json:"historic_qlen"`
+	ServiceTime  ServiceTime `json:"service_time"`
 }
 
 type OffloaderIntf interface {
@@ -214,23 +207,112 @@ type OffloaderIntf interface {
 	MetricSMElapsed(ctx *list.Element) string
 	MetricSMDelete(ctx *list.Element)
 	GetSnapshot(req *http.Request) Snapshot
+	MarkStealable(ctx *list.Element) <-chan string
+	MarkStarted(ctx *list.Element) bool
+	StealQueued(thief string) bool
+	UpdatePeers(peers []string)
+	Base() *BaseOffloader
 }
 
 // TODO: This is single function currently. Provide multi-function support.
 type BaseOffloader struct {
-	Finfo        FunctionInfo
-	Host         string
+	Finfo *FunctionInfo
+	Host  string
+	// RouterList is replaced when peers join or leave, read it through Routers.
 	RouterList   []router
+	routerMu     sync.RWMutex
 	Qlen_max     int32
 	config       FeoConfig
 	MetricSMList *list.List
 	MetricSMMu   sync.Mutex
+	// Prober measures the RTT to the peers. It is nil if probing is disabled.
+	Prober *Prober
+	// Gossip holds the load of the other nodes. It is nil if gossip is disabled.
+	Gossip *Gossiper
+	// Breakers guards the offloads to every peer. It is nil if breakers are disabled.
+	Breakers *Breakers
+	// Replicas is the number of local replicas of the application, SloMs its
+	// latency target or 0.
+	Replicas int
+	SloMs    int
+	// ControllerQlen smooths the qlen reported to the controller
+	ControllerQlen QlenEstimatorConfig
+	// Clock and Rand are the only source of time and randomness of the
+	// policies, so that seeded runs on a manual clock are reproducible.
+	Clock Clock
+	Rand  *rand.Rand
+	// Transport carries the requests of the policy to the peers, nil for http.DefaultTransport
+	Transport http.RoundTripper
 
 	wg   sync.WaitGroup
 	quit chan bool
+}
+
+// Routers returns the current peers. The slice is replaced, never modified, so
+// callers can use it without holding a lock but must not modify it either.
+func (o *BaseOffloader) Routers() []router {
+	o.routerMu.RLock()
+	defer o.routerMu.RUnlock()
+	return o.RouterList
+}
+
+// Candidates returns the peers that can be offloaded to, i.e. the ones whose
+// circuit is not open. Policies pick from these.
+func (o *BaseOffloader) Candidates() []router {
+	routers := o.Routers()
+	if o.Breakers == nil {
+		return routers
+	}
+	candidates := make([]router, 0, len(routers))
+	for _, r := range routers {
+		if o.Available(r.host) {
+			candidates = append(candidates, r)
+		}
+	}
+	return candidates
+}
+
+// Available reports whether node can be offloaded to. This node always can.
+func (o *BaseOffloader) Available(node string) bool {
+	return node == o.Host || o.Breakers.Available(node)
+}
+
+// UpdatePeers replaces the peers when members join, leave or fail. Policies
+// that keep per-peer state override it, call it and then add or drop the state
+// of the peers that changed.
+func (o *BaseOffloader) UpdatePeers(peers []string) {
+	routerList := []router{}
+	for _, ip := range peers {
+		routerList = append(routerList, router{host: ip})
+	}
+	o.routerMu.Lock()
+	defer o.routerMu.Unlock()
+	o.RouterList = routerList
+}
+
+// isMember reports whether node is this node or one of the current peers.
+// Candidates that come from outside, e.g. from the controller, may name peers
+// that left or failed.
+func (o *BaseOffloader) isMember(node string) bool {
+	if node == o.Host {
+		return true
+	}
+	for _, r := range o.Routers() {
+		if r.host == node {
+			return true
+		}
+	}
+	return false
+}
+
+// ServiceTime returns the measured service time of the application on this node.
+func (o *BaseOffloader) ServiceTime() ServiceTime {
+	return o.Finfo.svc.get()
+}
 
-	qlens_over_time []QListInfo
-	qlen_info_chan  chan QListInfo
+// Base returns the BaseOffloader embedded by every policy.
+func (o *BaseOffloader) Base() *BaseOffloader {
+	return o
 }
 
 // GetQlens implements OffloaderIntf.
@@ -239,16 +321,33 @@ func (o *BaseOffloader) GetSnapshot(req *http.Request) Snapshot {
 }
 
 func NewBaseOffloader(config FeoConfig) *BaseOffloader {
+	return newBaseOffloader(config, nil, nil, nil)
+}
+
+// newBaseOffloader creates a base offloader that tracks its queue in finfo. A
+// nil finfo starts with an empty queue; passing the FunctionInfo of another
+// offloader carries its queue over, as done when the policy of an application changes.
+// A nil clock is the wall clock, a nil rng is seeded with config.Seed.
+func newBaseOffloader(config FeoConfig, finfo *FunctionInfo, clock Clock, rng *rand.Rand) *BaseOffloader {
 	routerList := []router{}
 	for _, ip := range config.Peers {
 		routerList = append(routerList, router{host: ip})
 	}
 	o := BaseOffloader{Host: config.Host, RouterList: routerList, Qlen_max: math.MaxInt32, config: config}
-	o.Finfo.invoke_list = list.New()
-	o.Finfo.historic_qlen = 0.0
+	if finfo == nil {
+		finfo = newFunctionInfo(newQlenEstimator(QlenEstimatorConfig{}, DefaultHistoricQlen))
+	}
+	o.Finfo = finfo
 	o.MetricSMList = list.New()
+	if clock == nil {
+		clock = WallClock{}
+	}
+	if rng == nil {
+		rng = NewRand(config.Seed)
+	}
+	o.Clock, o.Rand = clock, rng
 
-	o.qlen_info_chan = make(chan QListInfo, 200)
+	o.quit = make(chan bool)
 	go o.update_qlen()
 	return &o
 }
@@ -264,16 +363,35 @@ func (o *BaseOffloader) CheckAndEnq(req *http.Request) (*list.Element, bool) {
 	log.Println("[DEBUG ]hqlen: ", historic_qlen)
 	log.Println("[DEBUG] qlen_max", int(o.Qlen_max))
 
-	cur_time := time.Now()
-	o.qlen_info_chan <- QListInfo{cur_time, instantaneous_qlen + 1}
+	cur_time := o.Clock.Now()
 	if historic_qlen < float32(o.Qlen_max) {
 		log.Println("[DEBUG] inside if branch", int(o.Qlen_max))
-		return o.Finfo.invoke_list.PushBack(cur_time), true
+		return o.Finfo.invoke_list.PushBack(newInvocation(cur_time)), true
 	} else {
 		return nil, false
 	}
 }
 
+// enqIfOffloaded queues req only if a peer offloaded it here. Invocations
+// received from clients are always offloaded.
+func (o *BaseOffloader) enqIfOffloaded(req *http.Request) (*list.Element, bool) {
+	if o.IsOffloaded(req) {
+		log.Println("[INFO] Already offloaded. Force Enq")
+		return o.ForceEnq(req), true
+	}
+	return nil, false
+}
+
+// enqIf queues an invocation if admit accepts the current queue length.
+func (o *BaseOffloader) enqIf(admit func(qlen int) bool) (*list.Element, bool) {
+	o.Finfo.mu.Lock()
+	defer o.Finfo.mu.Unlock()
+	if !admit(o.Finfo.invoke_list.Len()) {
+		return nil, false
+	}
+	return o.Finfo.invoke_list.PushBack(newInvocation(o.Clock.Now())), true
+}
+
 func (o *BaseOffloader) IsOffloaded(req *http.Request) bool {
 	forwardedField := req.Header.Get("X-Offloaded-For")
 	log.Println("[DEBUG]isOffloaded ", forwardedField)
@@ -285,7 +403,7 @@ func (o *BaseOffloader) ForceEnq(req *http.Request) *list.Element {
 	o.Finfo.mu.Lock()
 	defer o.Finfo.mu.Unlock()
 	o.Finfo.name = strings.Split(req.URL.Path, "/")[5]
-	ctx := o.Finfo.invoke_list.PushBack(time.Now())
+	ctx := o.Finfo.invoke_list.PushBack(newInvocation(o.Clock.Now()))
 	return ctx
 }
 
@@ -295,6 +413,46 @@ func (o *BaseOffloader) Deq(req *http.Request, ctx *list.Element) {
 	o.Finfo.invoke_list.Remove(ctx)
 }
 
+// MarkStealable allows a queued invocation to be stolen by a peer. The returned
+// channel yields the thief's host once the invocation has been stolen.
+func (o *BaseOffloader) MarkStealable(ctx *list.Element) <-chan string {
+	o.Finfo.mu.Lock()
+	defer o.Finfo.mu.Unlock()
+	inv := ctx.Value.(*invocation)
+	inv.stealable = true
+	return inv.stolen
+}
+
+// MarkStarted records that the invocation got a local replica. It returns false
+// if a peer stole the invocation first.
+func (o *BaseOffloader) MarkStarted(ctx *list.Element) bool {
+	o.Finfo.mu.Lock()
+	defer o.Finfo.mu.Unlock()
+	inv := ctx.Value.(*invocation)
+	if inv.thief != "" {
+		return false
+	}
+	inv.started = true
+	return true
+}
+
+// StealQueued hands the oldest stealable invocation that has not started yet over to thief.
+func (o *BaseOffloader) StealQueued(thief string) bool {
+	o.Finfo.mu.Lock()
+	defer o.Finfo.mu.Unlock()
+	for e := o.Finfo.invoke_list.Front(); e != nil; e = e.Next() {
+		inv := e.Value.(*invocation)
+		if !inv.stealable || inv.started || inv.thief != "" {
+			continue
+		}
+		inv.thief = thief
+		inv.stolen <- thief
+		log.Printf("[INFO] queued invocation from %s stolen by %s\n", inv.ts.Format(time.RFC3339Nano), thief)
+		return true
+	}
+	return false
+}
+
 func (o *BaseOffloader) GetOffloadCandidate(req *http.Request) string {
 	return ""
 }
@@ -317,12 +475,13 @@ func (o *BaseOffloader) SetMaxQlen(maxQlen int32) {
 }
 
 func (o *BaseOffloader) Close() {
-
+	close(o.quit)
+	o.wg.Wait()
 }
 
 func (o *BaseOffloader) MetricSMInit() *list.Element {
 	metricSM := &MetricSM{}
-	metricSM.init = time.Now()
+	metricSM.init = o.Clock.Now()
 	metricSM.state = InitState
 	metricSM.candidate = "default"
 	metricSM.local = false
@@ -347,16 +506,16 @@ func (o *BaseOffloader) MetricSMAdvance(ctx *list.Element, state MetricSMState,
 	switch state {
 	case InitState:
 		ctx.Value.(*MetricSM).state = state
-		ctx.Value.(*MetricSM).init = time.Now()
+		ctx.Value.(*MetricSM).init = o.Clock.Now()
 	case PreOffloadSearchState:
 		if ctx.Value.(*MetricSM).state == InitState {
 			ctx.Value.(*MetricSM).state = state
-			ctx.Value.(*MetricSM).preOffloadSearch = time.Now()
+			ctx.Value.(*MetricSM).preOffloadSearch = o.Clock.Now()
 		}
 	case OffloadSearchState:
 		if ctx.Value.(*MetricSM).state == PreOffloadSearchState {
 			ctx.Value.(*MetricSM).state = state
-			ctx.Value.(*MetricSM).offloadSearch = time.Now()
+			ctx.Value.(*MetricSM).offloadSearch = o.Clock.Now()
 		}
 	case PreLocalState:
 		if (ctx.Value.(*MetricSM).state == InitState) || (ctx.Value.(*MetricSM).state == OffloadSearchState) || (ctx.Value.(*MetricSM).state == PreOffloadState) {
@@ -367,29 +526,29 @@ func (o *BaseOffloader) MetricSMAdvance(ctx *list.Element, state MetricSMState,
 				ctx.Value.(*MetricSM).localAfterFail = true
 			}
 			ctx.Value.(*MetricSM).state = state
-			ctx.Value.(*MetricSM).preLocal = time.Now()
+			ctx.Value.(*MetricSM).preLocal = o.Clock.Now()
 		}
 	case PostLocalState:
 		if ctx.Value.(*MetricSM).state == PreLocalState {
 			ctx.Value.(*MetricSM).state = state
 			ctx.Value.(*MetricSM).local = true
-			ctx.Value.(*MetricSM).postLocal = time.Now()
+			ctx.Value.(*MetricSM).postLocal = o.Clock.Now()
 		}
 	case PreOffloadState:
 		if ctx.Value.(*MetricSM).state == OffloadSearchState {
 			ctx.Value.(*MetricSM).state = state
-			ctx.Value.(*MetricSM).preOffload = time.Now()
+			ctx.Value.(*MetricSM).preOffload = o.Clock.Now()
 		}
 	case PostOffloadState:
 		if ctx.Value.(*MetricSM).state == PreOffloadState {
 			ctx.Value.(*MetricSM).state = state
 			ctx.Value.(*MetricSM).local = false
-			ctx.Value.(*MetricSM).postOffload = time.Now()
+			ctx.Value.(*MetricSM).postOffload = o.Clock.Now()
 		}
 	case FinalState:
 		if (ctx.Value.(*MetricSM).state == PostOffloadState) || (ctx.Value.(*MetricSM).state == PostLocalState) {
 			ctx.Value.(*MetricSM).state = state
-			ctx.Value.(*MetricSM).final = time.Now()
+			ctx.Value.(*MetricSM).final = o.Clock.Now()
 		}
 	}
 
@@ -412,16 +571,40 @@ func (o *BaseOffloader) MetricSMAdvance(ctx *list.Element, state MetricSMState,
 	// }
 }
 
+// MetricSMAnalyze records the execution latency of a finished invocation.
+// Policies that learn from it call this first and then read the MetricSM.
 func (o *BaseOffloader) MetricSMAnalyze(ctx *list.Element) {
-	var timeElapsed time.Duration
-	if (ctx.Value.(*MetricSM).state == FinalState) && (ctx.Value.(*MetricSM).candidate != "default") {
-		if ctx.Value.(*MetricSM).local {
-			timeElapsed = ctx.Value.(*MetricSM).postLocal.Sub(ctx.Value.(*MetricSM).preLocal)
-		} else {
-			timeElapsed = ctx.Value.(*MetricSM).postOffload.Sub(ctx.Value.(*MetricSM).preOffload)
-		}
-		ctx.Value.(*MetricSM).elapsed = timeElapsed
+	sm := ctx.Value.(*MetricSM)
+	if !sm.finished() {
+		return
+	}
+	if sm.local {
+		sm.elapsed = sm.postLocal.Sub(sm.preLocal)
+	} else {
+		sm.elapsed = sm.postOffload.Sub(sm.preOffload)
 	}
+	o.accountCost(sm)
+}
+
+// finished reports whether the invocation reached FINAL on some candidate.
+func (m *MetricSM) finished() bool {
+	return m.state == FinalState && m.candidate != "default"
+}
+
+// totalMs is the time from the arrival of the invocation until FINAL.
+func (m *MetricSM) totalMs() float64 {
+	return float64(m.final.Sub(m.init).Microseconds()) / 1000
+}
+
+// chosen reports whether the candidate was picked by GetOffloadCandidate, as
+// opposed to running locally because it was admitted or the offload failed.
+func (m *MetricSM) chosen() bool {
+	return !m.localAfterFail && !m.localByDefault
+}
+
+// elapsedMs is the recorded latency in whole milliseconds.
+func (m *MetricSM) elapsedMs() float64 {
+	return float64(m.elapsed.Microseconds() / 1000)
 }
 
 func (o *BaseOffloader) MetricSMDelete(ctx *list.Element) {
@@ -1,6 +1,6 @@
 // Code generated by protoc-gen-go. DO NOT EDIT.
 // versions:
-// 	protoc-gen-go v1.28.1
+// 	protoc-gen-go v1.31.0
 // 	protoc        v3.12.4
 // source: offloadproto/offload.proto
 
@@ -331,9 +331,10 @@ type FunctionInfo struct {
 	sizeCache     protoimpl.SizeCache
 	unknownFields protoimpl.UnknownFields
 
-	FunctionName  string  `protobuf:"bytes,1,opt,name=function_name,json=functionName,proto3" json:"function_name,omitempty"`
-	InvokeHistory []int64 `protobuf:"varint,2,rep,packed,name=invoke_history,json=invokeHistory,proto3" json:"invoke_history,omitempty"`
-	Qlen          float32 `protobuf:"fixed32,3,opt,name=qlen,proto3" json:"qlen,omitempty"`
+	FunctionName  string       `protobuf:"bytes,1,opt,name=function_name,json=functionName,proto3" json:"function_name,omitempty"`
+	InvokeHistory []int64      `protobuf:"varint,2,rep,packed,name=invoke_history,json=invokeHistory,proto3" json:"invoke_history,omitempty"`
+	Qlen          float32      `protobuf:"fixed32,3,opt,name=qlen,proto3" json:"qlen,omitempty"`
+	SvcTime       *ServiceTime `protobuf:"bytes,4,opt,name=svc_time,json=svcTime,proto3" json:"svc_time,omitempty"`
 }
 
 func (x *FunctionInfo) Reset() {
@@ -389,6 +390,92 @@ func (x *FunctionInfo) GetQlen() float32 {
 	return 0
 }
 
+func (x *FunctionInfo) GetSvcTime() *ServiceTime {
+	if x != nil {
+		return x.SvcTime
+	}
+	return nil
+}
+
+type ServiceTime struct {
+	state         protoimpl.MessageState
+	sizeCache     protoimpl.SizeCache
+	unknownFields protoimpl.UnknownFields
+
+	EwmaMs  float32 `protobuf:"fixed32,1,opt,name=ewma_ms,json=ewmaMs,proto3" json:"ewma_ms,omitempty"`
+	P50Ms   float32 `protobuf:"fixed32,2,opt,name=p50_ms,json=p50Ms,proto3" json:"p50_ms,omitempty"`
+	P95Ms   float32 `protobuf:"fixed32,3,opt,name=p95_ms,json=p95Ms,proto3" json:"p95_ms,omitempty"`
+	P99Ms   float32 `protobuf:"fixed32,4,opt,name=p99_ms,json=p99Ms,proto3" json:"p99_ms,omitempty"`
+	Samples int64   `protobuf:"varint,5,opt,name=samples,proto3" json:"samples,omitempty"`
+}
+
+func (x *ServiceTime) Reset() {
+	*x = ServiceTime{}
+	if protoimpl.UnsafeEnabled {
+		mi := &file_offloadproto_offload_proto_msgTypes[7]
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		ms.StoreMessageInfo(mi)
+	}
+}
+
+func (x *ServiceTime) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*ServiceTime) ProtoMessage() {}
+
+func (x *ServiceTime) ProtoReflect() protoreflect.Message {
+	mi := &file_offloadproto_offload_proto_msgTypes[7]
+	if protoimpl.UnsafeEnabled && x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use ServiceTime.ProtoReflect.Descriptor instead.
+func (*ServiceTime) Descriptor() ([]byte, []int) {
+	return file_offloadproto_offload_proto_rawDescGZIP(), []int{7}
+}
+
+func (x *ServiceTime) GetEwmaMs() float32 {
+	if x != nil {
+		return x.EwmaMs
+	}
+	return 0
+}
+
+func (x *ServiceTime) GetP50Ms() float32 {
+	if x != nil {
+		return x.P50Ms
+	}
+	return 0
+}
+
+func (x *ServiceTime) GetP95Ms() float32 {
+	if x != nil {
+		return x.P95Ms
+	}
+	return 0
+}
+
+func (x *ServiceTime) GetP99Ms() float32 {
+	if x != nil {
+		return x.P99Ms
+	}
+	return 0
+}
+
+func (x *ServiceTime) GetSamples() int64 {
+	if x != nil {
+		return x.Samples
+	}
+	return 0
+}
+
 var File_offloadproto_offload_proto protoreflect.FileDescriptor
 
 var file_offloadproto_offload_proto_rawDesc = []byte{
@@ -419,31 +506,43 @@ var file_offloadproto_offload_proto_rawDesc = []byte{
 	0x09, 0x52, 0x04, 0x6e, 0x61, 0x6d, 0x65, 0x12, 0x34, 0x0a, 0x0a, 0x66, 0x69, 0x6e, 0x66, 0x6f,
 	0x5f, 0x6c, 0x69, 0x73, 0x74, 0x18, 0x02, 0x20, 0x03, 0x28, 0x0b, 0x32, 0x15, 0x2e, 0x6f, 0x66,
 	0x66, 0x6c, 0x6f, 0x61, 0x64, 0x2e, 0x46, 0x75, 0x6e, 0x63, 0x74, 0x69, 0x6f, 0x6e, 0x49, 0x6e,
-	0x66, 0x6f, 0x52, 0x09, 0x66, 0x69, 0x6e, 0x66, 0x6f, 0x4c, 0x69, 0x73, 0x74, 0x22, 0x6e, 0x0a,
-	0x0c, 0x46, 0x75, 0x6e, 0x63, 0x74, 0x69, 0x6f, 0x6e, 0x49, 0x6e, 0x66, 0x6f, 0x12, 0x23, 0x0a,
-	0x0d, 0x66, 0x75, 0x6e, 0x63, 0x74, 0x69, 0x6f, 0x6e, 0x5f, 0x6e, 0x61, 0x6d, 0x65, 0x18, 0x01,
-	0x20, 0x01, 0x28, 0x09, 0x52, 0x0c, 0x66, 0x75, 0x6e, 0x63, 0x74, 0x69, 0x6f, 0x6e, 0x4e, 0x61,
-	0x6d, 0x65, 0x12, 0x25, 0x0a, 0x0e, 0x69, 0x6e, 0x76, 0x6f, 0x6b, 0x65, 0x5f, 0x68, 0x69, 0x73,
-	0x74, 0x6f, 0x72, 0x79, 0x18, 0x02, 0x20, 0x03, 0x28, 0x03, 0x52, 0x0d, 0x69, 0x6e, 0x76, 0x6f,
-	0x6b, 0x65, 0x48, 0x69, 0x73, 0x74, 0x6f, 0x72, 0x79, 0x12, 0x12, 0x0a, 0x04, 0x71, 0x6c, 0x65,
-	0x6e, 0x18, 0x03, 0x20, 0x01, 0x28, 0x02, 0x52, 0x04, 0x71, 0x6c, 0x65, 0x6e, 0x32, 0xd6, 0x01,
-	0x0a, 0x0f, 0x4f, 0x66, 0x66, 0x6c, 0x6f, 0x61, 0x64, 0x53, 0x74, 0x61, 0x74, 0x65, 0x48, 0x75,
-	0x62, 0x12, 0x41, 0x0a, 0x0b, 0x55, 0x70, 0x64, 0x61, 0x74, 0x65, 0x53, 0x74, 0x61, 0x74, 0x65,
-	0x12, 0x12, 0x2e, 0x6f, 0x66, 0x66, 0x6c, 0x6f, 0x61, 0x64, 0x2e, 0x4e, 0x6f, 0x64, 0x65, 0x53,
-	0x74, 0x61, 0x74, 0x65, 0x1a, 0x1c, 0x2e, 0x6f, 0x66, 0x66, 0x6c, 0x6f, 0x61, 0x64, 0x2e, 0x55,
-	0x70, 0x64, 0x61, 0x74, 0x65, 0x53, 0x74, 0x61, 0x74, 0x65, 0x52, 0x65, 0x73, 0x70, 0x6f, 0x6e,
-	0x73, 0x65, 0x22, 0x00, 0x12, 0x45, 0x0a, 0x0c, 0x47, 0x65, 0x74, 0x43, 0x61, 0x6e, 0x64, 0x69,
-	0x64, 0x61, 0x74, 0x65, 0x12, 0x17, 0x2e, 0x6f, 0x66, 0x66, 0x6c, 0x6f, 0x61, 0x64, 0x2e, 0x43,
-	0x61, 0x6e, 0x64, 0x69, 0x64, 0x61, 0x74, 0x65, 0x51, 0x75, 0x65, 0x72, 0x79, 0x1a, 0x1a, 0x2e,
-	0x6f, 0x66, 0x66, 0x6c, 0x6f, 0x61, 0x64, 0x2e, 0x43, 0x61, 0x6e, 0x64, 0x69, 0x64, 0x61, 0x74,
-	0x65, 0x52, 0x65, 0x73, 0x70, 0x6f, 0x6e, 0x73, 0x65, 0x22, 0x00, 0x12, 0x39, 0x0a, 0x08, 0x47,
-	0x65, 0x74, 0x53, 0x74, 0x61, 0x74, 0x65, 0x12, 0x13, 0x2e, 0x6f, 0x66, 0x66, 0x6c, 0x6f, 0x61,
-	0x64, 0x2e, 0x53, 0x74, 0x61, 0x74, 0x65, 0x51, 0x75, 0x65, 0x72, 0x79, 0x1a, 0x16, 0x2e, 0x6f,
-	0x66, 0x66, 0x6c, 0x6f, 0x61, 0x64, 0x2e, 0x53, 0x74, 0x61, 0x74, 0x65, 0x52, 0x65, 0x73, 0x70,
-	0x6f, 0x6e, 0x73, 0x65, 0x22, 0x00, 0x42, 0x2d, 0x5a, 0x2b, 0x67, 0x69, 0x74, 0x68, 0x75, 0x62,
-	0x2e, 0x67, 0x61, 0x74, 0x65, 0x63, 0x68, 0x2e, 0x65, 0x64, 0x75, 0x2f, 0x66, 0x61, 0x61, 0x73,
-	0x65, 0x64, 0x67, 0x65, 0x2f, 0x66, 0x65, 0x6f, 0x2f, 0x6f, 0x66, 0x66, 0x6c, 0x6f, 0x61, 0x64,
-	0x70, 0x72, 0x6f, 0x74, 0x6f, 0x62, 0x06, 0x70, 0x72, 0x6f, 0x74, 0x6f, 0x33,
+	0x66, 0x6f, 0x52, 0x09, 0x66, 0x69, 0x6e, 0x66, 0x6f, 0x4c, 0x69, 0x73, 0x74, 0x22, 0x9f, 0x01,
+	0x0a, 0x0c, 0x46, 0x75, 0x6e, 0x63, 0x74, 0x69, 0x6f, 0x6e, 0x49, 0x6e, 0x66, 0x6f, 0x12, 0x23,
+	0x0a, 0x0d, 0x66, 0x75, 0x6e, 0x63, 0x74, 0x69, 0x6f, 0x6e, 0x5f, 0x6e, 0x61, 0x6d, 0x65, 0x18,
+	0x01, 0x20, 0x01, 0x28, 0x09, 0x52, 0x0c, 0x66, 0x75, 0x6e, 0x63, 0x74, 0x69, 0x6f, 0x6e, 0x4e,
+	0x61, 0x6d, 0x65, 0x12, 0x25, 0x0a, 0x0e, 0x69, 0x6e, 0x76, 0x6f, 0x6b, 0x65, 0x5f, 0x68, 0x69,
+	0x73, 0x74, 0x6f, 0x72, 0x79, 0x18, 0x02, 0x20, 0x03, 0x28, 0x03, 0x52, 0x0d, 0x69, 0x6e, 0x76,
+	0x6f, 0x6b, 0x65, 0x48, 0x69, 0x73, 0x74, 0x6f, 0x72, 0x79, 0x12, 0x12, 0x0a, 0x04, 0x71, 0x6c,
+	0x65, 0x6e, 0x18, 0x03, 0x20, 0x01, 0x28, 0x02, 0x52, 0x04, 0x71, 0x6c, 0x65, 0x6e, 0x12, 0x2f,
+	0x0a, 0x08, 0x73, 0x76, 0x63, 0x5f, 0x74, 0x69, 0x6d, 0x65, 0x18, 0x04, 0x20, 0x01, 0x28, 0x0b,
+	0x32, 0x14, 0x2e, 0x6f, 0x66, 0x66, 0x6c, 0x6f, 0x61, 0x64, 0x2e, 0x53, 0x65, 0x72, 0x76, 0x69,
+	0x63, 0x65, 0x54, 0x69, 0x6d, 0x65, 0x52, 0x07, 0x73, 0x76, 0x63, 0x54, 0x69, 0x6d, 0x65, 0x22,
+	0x85, 0x01, 0x0a, 0x0b, 0x53, 0x65, 0x72, 0x76, 0x69, 0x63, 0x65, 0x54, 0x69, 0x6d, 0x65, 0x12,
+	0x17, 0x0a, 0x07, 0x65, 0x77, 0x6d, 0x61, 0x5f, 0x6d, 0x73, 0x18, 0x01, 0x20, 0x01, 0x28, 0x02,
+	0x52, 0x06, 0x65, 0x77, 0x6d, 0x61, 0x4d, 0x73, 0x12, 0x15, 0x0a, 0x06, 0x70, 0x35, 0x30, 0x5f,
+	0x6d, 0x73, 0x18, 0x02, 0x20, 0x01, 0x28, 0x02, 0x52, 0x05, 0x70, 0x35, 0x30, 0x4d, 0x73, 0x12,
+	0x15, 0x0a, 0x06, 0x70, 0x39, 0x35, 0x5f, 0x6d, 0x73, 0x18, 0x03, 0x20, 0x01, 0x28, 0x02, 0x52,
+	0x05, 0x70, 0x39, 0x35, 0x4d, 0x73, 0x12, 0x15, 0x0a, 0x06, 0x70, 0x39, 0x39, 0x5f, 0x6d, 0x73,
+	0x18, 0x04, 0x20, 0x01, 0x28, 0x02, 0x52, 0x05, 0x70, 0x39, 0x39, 0x4d, 0x73, 0x12, 0x18, 0x0a,
+	0x07, 0x73, 0x61, 0x6d, 0x70, 0x6c, 0x65, 0x73, 0x18, 0x05, 0x20, 0x01, 0x28, 0x03, 0x52, 0x07,
+	0x73, 0x61, 0x6d, 0x70, 0x6c, 0x65, 0x73, 0x32, 0xd6, 0x01, 0x0a, 0x0f, 0x4f, 0x66, 0x66, 0x6c,
+	0x6f, 0x61, 0x64, 0x53, 0x74, 0x61, 0x74, 0x65, 0x48, 0x75, 0x62, 0x12, 0x41, 0x0a, 0x0b, 0x55,
+	0x70, 0x64, 0x61, 0x74, 0x65, 0x53, 0x74, 0x61, 0x74, 0x65, 0x12, 0x12, 0x2e, 0x6f, 0x66, 0x66,
+	0x6c, 0x6f, 0x61, 0x64, 0x2e, 0x4e, 0x6f, 0x64, 0x65, 0x53, 0x74, 0x61, 0x74, 0x65, 0x1a, 0x1c,
+	0x2e, 0x6f, 0x66, 0x66, 0x6c, 0x6f, 0x61, 0x64, 0x2e, 0x55, 0x70, 0x64, 0x61, 0x74, 0x65, 0x53,
+	0x74, 0x61, 0x74, 0x65, 0x52, 0x65, 0x73, 0x70, 0x6f, 0x6e, 0x73, 0x65, 0x22, 0x00, 0x12, 0x45,
+	0x0a, 0x0c, 0x47, 0x65, 0x74, 0x43, 0x61, 0x6e, 0x64, 0x69, 0x64, 0x61, 0x74, 0x65, 0x12, 0x17,
+	0x2e, 0x6f, 0x66, 0x66, 0x6c, 0x6f, 0x61, 0x64, 0x2e, 0x43, 0x61, 0x6e, 0x64, 0x69, 0x64, 0x61,
+	0x74, 0x65, 0x51, 0x75, 0x65, 0x72, 0x79, 0x1a, 0x1a, 0x2e, 0x6f, 0x66, 0x66, 0x6c, 0x6f, 0x61,
+	0x64, 0x2e, 0x43, 0x61, 0x6e, 0x64, 0x69, 0x64, 0x61, 0x74, 0x65, 0x52, 0x65, 0x73, 0x70, 0x6f,
+	0x6e, 0x73, 0x65, 0x22, 0x00, 0x12, 0x39, 0x0a, 0x08, 0x47, 0x65, 0x74, 0x53, 0x74, 0x61, 0x74,
+	0x65, 0x12, 0x13, 0x2e, 0x6f, 0x66, 0x66, 0x6c, 0x6f, 0x61, 0x64, 0x2e, 0x53, 0x74, 0x61, 0x74,
+	0x65, 0x51, 0x75, 0x65, 0x72, 0x79, 0x1a, 0x16, 0x2e, 0x6f, 0x66, 0x66, 0x6c, 0x6f, 0x61, 0x64,
+	0x2e, 0x53, 0x74, 0x61, 0x74, 0x65, 0x52, 0x65, 0x73, 0x70, 0x6f, 0x6e, 0x73, 0x65, 0x22, 0x00,
+	0x42, 0x2d, 0x5a, 0x2b, 0x67, 0x69, 0x74, 0x68, 0x75, 0x62, 0x2e, 0x67, 0x61, 0x74, 0x65, 0x63,
+	0x68, 0x2e, 0x65, 0x64, 0x75, 0x2f, 0x66, 0x61, 0x61, 0x73, 0x65, 0x64, 0x67, 0x65, 0x2f, 0x66,
+	0x65, 0x6f, 0x2f, 0x6f, 0x66, 0x66, 0x6c, 0x6f, 0x61, 0x64, 0x70, 0x72, 0x6f, 0x74, 0x6f, 0x62,
+	0x06, 0x70, 0x72, 0x6f, 0x74, 0x6f, 0x33,
 }
 
 var (
@@ -458,7 +557,7 @@ func file_offloadproto_offload_proto_rawDescGZIP() []byte {
 	return file_offloadproto_offload_proto_rawDescData
 }
 
-var file_offloadproto_offload_proto_msgTypes = make([]protoimpl.MessageInfo, 7)
+var file_offloadproto_offload_proto_msgTypes = make([]protoimpl.MessageInfo, 8)
 var file_offloadproto_offload_proto_goTypes = []interface{}{
 	(*StateQuery)(nil),          // 0: offload.StateQuery
 	(*StateResponse)(nil),       // 1: offload.StateResponse
@@ -467,22 +566,24 @@ var file_offloadproto_offload_proto_goTypes = []interface{}{
 	(*UpdateStateResponse)(nil), // 4: offload.UpdateStateResponse
 	(*NodeState)(nil),           // 5: offload.NodeState
 	(*FunctionInfo)(nil),        // 6: offload.FunctionInfo
+	(*ServiceTime)(nil),         // 7: offload.ServiceTime
 }
 var file_offloadproto_offload_proto_depIdxs = []int32{
 	5, // 0: offload.StateResponse.nodes:type_name -> offload.NodeState
 	6, // 1: offload.CandidateResponse.finfo:type_name -> offload.FunctionInfo
 	6, // 2: offload.NodeState.finfo_list:type_name -> offload.FunctionInfo
-	5, // 3: offload.OffloadStateHub.UpdateState:input_type -> offload.NodeState
-	2, // 4: offload.OffloadStateHub.GetCandidate:input_type -> offload.CandidateQuery
-	0, // 5: offload.OffloadStateHub.GetState:input_type -> offload.StateQuery
-	4, // 6: offload.OffloadStateHub.UpdateState:output_type -> offload.UpdateStateResponse
-	3, // 7: offload.OffloadStateHub.GetCandidate:output_type -> offload.CandidateResponse
-	1, // 8: offload.OffloadStateHub.GetState:output_type -> offload.StateResponse
-	6, // [6:9] is the sub-list for method output_type
-	3, // [3:6] is the sub-list for method input_type
-	3, // [3:3] is the sub-list for extension type_name
-	3, // [3:3] is the sub-list for extension extendee
-	0, // [0:3] is the sub-list for field type_name
+	7, // 3: offload.FunctionInfo.svc_time:type_name -> offload.ServiceTime
+	5, // 4: offload.OffloadStateHub.UpdateState:input_type -> offload.NodeState
+	2, // 5: offload.OffloadStateHub.GetCandidate:input_type -> offload.CandidateQuery
+	0, // 6: offload.OffloadStateHub.GetState:input_type -> offload.StateQuery
+	4, // 7: offload.OffloadStateHub.UpdateState:output_type -> offload.UpdateStateResponse
+	3, // 8: offload.OffloadStateHub.GetCandidate:output_type -> offload.CandidateResponse
+	1, // 9: offload.OffloadStateHub.GetState:output_type -> offload.StateResponse
+	7, // [7:10] is the sub-list for method output_type
+	4, // [4:7] is the sub-list for method input_type
+	4, // [4:4] is the sub-list for extension type_name
+	4, // [4:4] is the sub-list for extension extendee
+	0, // [0:4] is the sub-list for field type_name
 }
 
 func init() { file_offloadproto_offload_proto_init() }
@@ -575,6 +676,18 @@ func file_offloadproto_offload_proto_init() {
 				return nil
 			}
 		}
+		file_offloadproto_offload_proto_msgTypes[7].Exporter = func(v interface{}, i int) interface{} {
+			switch v := v.(*ServiceTime); i {
+			case 0:
+				return &v.state
+			case 1:
+				return &v.sizeCache
+			case 2:
+				return &v.unknownFields
+			default:
+				return nil
+			}
+		}
 	}
 	type x struct{}
 	out := protoimpl.TypeBuilder{
@@ -582,7 +695,7 @@ func file_offloadproto_offload_proto_init() {
 			GoPackagePath: reflect.TypeOf(x{}).PkgPath(),
 			RawDescriptor: file_offloadproto_offload_proto_rawDesc,
 			NumEnums:      0,
-			NumMessages:   7,
+			NumMessages:   8,
 			NumExtensions: 0,
 			NumServices:   1,
 		},
@@ -0,0 +1,68 @@
+package feo
+
+import (
+	"bytes"
+	"fmt"
+
+	"gopkg.in/yaml.v3"
+)
+
+// PolicyParams is the typed parameter struct of an offloading policy. It is
+// decoded from the `config` mapping of a policy block, e.g.
+//
+//	policy:
+//	  name: "impedence"
+//	  config:
+//	    alpha: 0.3
+type PolicyParams interface {
+	Validate() error
+}
+
+// RawPolicyParams holds an undecoded `config` mapping of a policy block.
+type RawPolicyParams map[string]any
+
+func (p *RawPolicyParams) UnmarshalYAML(node *yaml.Node) error {
+	// older configs use `config: ""`
+	if node.Kind == yaml.ScalarNode && node.Value == "" {
+		*p = nil
+		return nil
+	}
+	var m map[string]any
+	if err := node.Decode(&m); err != nil {
+		return err
+	}
+	*p = m
+	return nil
+}
+
+// Has reports whether key was set explicitly.
+func (p RawPolicyParams) Has(key string) bool {
+	_, ok := p[key]
+	return ok
+}
+
+// decode fills params from the raw mapping. Unknown keys are rejected so that typos fail loudly.
+func (p RawPolicyParams) decode(params PolicyParams) error {
+	if len(p) == 0 {
+		return nil
+	}
+	data, err := yaml.Marshal(map[string]any(p))
+	if err != nil {
+		return err
+	}
+	dec := yaml.NewDecoder(bytes.NewReader(data))
+	dec.KnownFields(true)
+	return dec.Decode(params)
+}
+
+// NoParams is used by policies without tunables.
+type NoParams struct{}
+
+func (p *NoParams) Validate() error { return nil }
+
+func validateAlpha(name string, alpha float64) error {
+	if alpha <= 0 || alpha > 1 {
+		return fmt.Errorf("%s must be in (0, 1], got %v", name, alpha)
+	}
+	return nil
+}
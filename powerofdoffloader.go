@@ -0,0 +1,97 @@
+package feo
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+)
+
+const OffloadPowerOfD = "p2c"
+
+func init() {
+	RegisterPolicy(PolicyRegistration{
+		Name:      OffloadPowerOfD,
+		NewParams: func() PolicyParams { return DefaultPowerOfDParams() },
+		New: func(base *BaseOffloader, params PolicyParams) OffloaderIntf {
+			return NewPowerOfDOffloader(base, params.(*PowerOfDParams))
+		},
+	})
+}
+
+type PowerOfDParams struct {
+	QlenMax int32 `yaml:"qlen_max" json:"qlen_max"`
+	// number of random peers compared per offload
+	D int `yaml:"d" json:"d"`
+	// snapshots piggybacked on offload replies or queried less than this long ago are reused
+	SnapshotTTLMs int `yaml:"snapshot_ttl_ms" json:"snapshot_ttl_ms"`
+	// peers that do not answer the snapshot query in time are skipped
+	QueryTimeoutMs int `yaml:"query_timeout_ms" json:"query_timeout_ms"`
+}
+
+func DefaultPowerOfDParams() *PowerOfDParams {
+	return &PowerOfDParams{QlenMax: 10, D: 2, SnapshotTTLMs: 100, QueryTimeoutMs: 200}
+}
+
+func (p *PowerOfDParams) Validate() error {
+	if p.QlenMax <= 0 {
+		return fmt.Errorf("qlen_max must be positive, got %d", p.QlenMax)
+	}
+	if p.D < 1 {
+		return fmt.Errorf("d must be at least 1, got %d", p.D)
+	}
+	if p.SnapshotTTLMs < 0 {
+		return fmt.Errorf("snapshot_ttl_ms must not be negative, got %d", p.SnapshotTTLMs)
+	}
+	if p.QueryTimeoutMs <= 0 {
+		return fmt.Errorf("query_timeout_ms must be positive, got %d", p.QueryTimeoutMs)
+	}
+	return nil
+}
+
+// PowerOfDOffloader admits like the base offloader and offloads to the least
+// loaded of D random peers.
+type PowerOfDOffloader struct {
+	*BaseOffloader
+	params    *PowerOfDParams
+	snapshots *snapshotCache
+}
+
+func NewPowerOfDOffloader(base *BaseOffloader, params *PowerOfDParams) *PowerOfDOffloader {
+	o := &PowerOfDOffloader{BaseOffloader: base, params: params}
+	o.Qlen_max = params.QlenMax
+	o.snapshots = newSnapshotCache(base, params.SnapshotTTLMs, params.QueryTimeoutMs)
+	return o
+}
+
+func (o *PowerOfDOffloader) GetOffloadCandidate(req *http.Request) string {
+	peers := []string{}
+	for _, r := range o.Candidates() {
+		if r.host != o.Host {
+			peers = append(peers, r.host)
+		}
+	}
+	o.Rand.Shuffle(len(peers), func(i, j int) { peers[i], peers[j] = peers[j], peers[i] })
+	if len(peers) > o.params.D {
+		peers = peers[:o.params.D]
+	}
+
+	snaps := o.snapshots.getAll(peers, extractEntityName(req))
+
+	candidate := o.Host
+	minQlen := -1
+	for i, snap := range snaps {
+		if snap == nil {
+			continue
+		}
+		if minQlen < 0 || snap.Qlen < minQlen {
+			candidate, minQlen = peers[i], snap.Qlen
+		}
+	}
+	log.Printf("[DEBUG] p2c sampled %v, picked %s\n", peers, candidate)
+	return candidate
+}
+
+// PostOffloadUpdate caches the snapshot piggybacked on an offload reply.
+func (o *PowerOfDOffloader) PostOffloadUpdate(snap Snapshot, target string) {
+	o.snapshots.put(target, snap)
+}
@@ -0,0 +1,138 @@
+package feo
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+)
+
+// PredictorParams are the parameters of the policies that predict completion
+// times, embedded in their own params.
+type PredictorParams struct {
+	// execution time of one invocation until it was measured
+	ServiceTimeMs float64 `yaml:"service_time_ms" json:"service_time_ms"`
+	// RTT of peers the prober has not measured
+	DefaultRttMs float64 `yaml:"default_rtt_ms" json:"default_rtt_ms"`
+	// peer snapshots younger than this are reused
+	SnapshotTTLMs  int `yaml:"snapshot_ttl_ms" json:"snapshot_ttl_ms"`
+	QueryTimeoutMs int `yaml:"query_timeout_ms" json:"query_timeout_ms"`
+	// invocations offloaded here are rejected once the queue is this long
+	QlenMax int32 `yaml:"qlen_max" json:"qlen_max"`
+}
+
+func DefaultPredictorParams() PredictorParams {
+	return PredictorParams{ServiceTimeMs: 100, DefaultRttMs: 1, SnapshotTTLMs: 100, QueryTimeoutMs: 200, QlenMax: 10}
+}
+
+func (p *PredictorParams) Validate() error {
+	if p.ServiceTimeMs <= 0 {
+		return fmt.Errorf("service_time_ms must be positive, got %v", p.ServiceTimeMs)
+	}
+	if p.DefaultRttMs < 0 {
+		return fmt.Errorf("default_rtt_ms must not be negative, got %v", p.DefaultRttMs)
+	}
+	if p.SnapshotTTLMs < 0 {
+		return fmt.Errorf("snapshot_ttl_ms must not be negative, got %d", p.SnapshotTTLMs)
+	}
+	if p.QueryTimeoutMs <= 0 {
+		return fmt.Errorf("query_timeout_ms must be positive, got %d", p.QueryTimeoutMs)
+	}
+	if p.QlenMax <= 0 {
+		return fmt.Errorf("qlen_max must be positive, got %d", p.QlenMax)
+	}
+	return nil
+}
+
+// predictor predicts when an invocation completes on this node or on a peer.
+//
+// An invocation that finds qlen invocations queued completes after
+// (qlen/replicas + 1) service times. Peers are assumed to run capacity times
+// as many replicas as this node, see NodeCost. Offloading adds the RTT and the
+// time to transfer the request body. Peer qlens and service times are taken
+// from gossip if enabled, from offload replies, or queried. Service times that
+// were not measured yet default to the local one, then to service_time_ms.
+type predictor struct {
+	base         *BaseOffloader
+	defServiceMs float64
+	defaultRttMs float64
+	snapshots    *snapshotCache
+}
+
+func newPredictor(base *BaseOffloader, params PredictorParams) *predictor {
+	return &predictor{base: base, defServiceMs: params.ServiceTimeMs, defaultRttMs: params.DefaultRttMs, snapshots: newSnapshotCache(base, params.SnapshotTTLMs, params.QueryTimeoutMs)}
+}
+
+// serviceTimeMs picks the measured service time of svc, the local one or the default.
+func (p *predictor) serviceTimeMs(svc ServiceTime) float64 {
+	if svc.Known() {
+		return svc.EwmaMs
+	}
+	if local := p.base.ServiceTime(); local.Known() {
+		return local.EwmaMs
+	}
+	return p.defServiceMs
+}
+
+// completionMs predicts the time until an invocation completes on node, whose load is snap.
+func (p *predictor) completionMs(node string, snap Snapshot) float64 {
+	replicas := float64(p.base.Replicas)
+	if replicas < 1 {
+		replicas = 1
+	}
+	if node != p.base.Host {
+		replicas *= p.base.Cost(node).capacity()
+	}
+	return (float64(snap.Qlen)/replicas + 1) * p.serviceTimeMs(snap.ServiceTime)
+}
+
+// networkMs predicts what offloading req to peer adds to its completion.
+func (p *predictor) networkMs(peer string, req *http.Request) float64 {
+	ms, ok := p.base.Prober.RTT(peer)
+	if !ok {
+		ms = p.defaultRttMs
+	}
+	if mbps, ok := p.base.Prober.Bandwidth(peer); ok && req.ContentLength > 0 {
+		ms += float64(8*req.ContentLength) / (mbps * 1000)
+	}
+	return ms
+}
+
+// peerSnapshots returns the load of every candidate peer that is known or
+// could be queried.
+// sortedNodes returns the nodes of m in order, so that ties are broken the
+// same way in every run.
+func sortedNodes[V any](m map[string]V) []string {
+	nodes := make([]string, 0, len(m))
+	for node := range m {
+		nodes = append(nodes, node)
+	}
+	sort.Strings(nodes)
+	return nodes
+}
+
+func (p *predictor) peerSnapshots(req *http.Request) map[string]Snapshot {
+	appName := extractEntityName(req)
+	snaps := map[string]Snapshot{}
+	for peer, snap := range p.base.Gossip.Snapshots(appName) {
+		snaps[peer] = snap
+	}
+
+	peers := map[string]Snapshot{}
+	unknown := []string{}
+	for _, r := range p.base.Candidates() {
+		if r.host == p.base.Host {
+			continue
+		}
+		if snap, ok := snaps[r.host]; ok {
+			peers[r.host] = snap
+		} else {
+			unknown = append(unknown, r.host)
+		}
+	}
+	for i, snap := range p.snapshots.getAll(unknown, appName) {
+		if snap != nil {
+			peers[unknown[i]] = *snap
+		}
+	}
+	return peers
+}
@@ -0,0 +1,267 @@
+package feo
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const (
+	DEFAULT_PROBE_INTERVAL_MS = 1000
+	DEFAULT_PROBE_TIMEOUT_MS  = 1000
+	DEFAULT_PROBE_ALPHA       = 0.5
+)
+
+// ProbeConfig enables the background prober, which measures the RTT and
+// optionally the bandwidth to every peer through the ping endpoint.
+type ProbeConfig struct {
+	Enabled    bool `yaml:"enabled"`
+	IntervalMs int  `yaml:"interval_ms"`
+	TimeoutMs  int  `yaml:"timeout_ms"`
+	// weight of the latest RTT sample in the EWMA. Higher values follow
+	// changes of the network, e.g. by tc netem, faster.
+	Alpha float64 `yaml:"alpha"`
+	// size of the payload posted to measure bandwidth, 0 disables bandwidth probes
+	BandwidthBytes int `yaml:"bandwidth_bytes"`
+}
+
+// PeerLatency is what the prober measured for a peer.
+type PeerLatency struct {
+	RttMs         float64   `json:"rtt_ms"`
+	LastRttMs     float64   `json:"last_rtt_ms"`
+	BandwidthMbps float64   `json:"bandwidth_mbps,omitempty"`
+	Updated       time.Time `json:"updated"`
+	// consecutive failed probes
+	Failures int `json:"failures"`
+}
+
+// Prober periodically pings every peer and keeps a per-peer latency table
+// that policies read through BaseOffloader.Prober. A nil *Prober is valid
+// and knows nothing, which is the case when probing is disabled.
+type Prober struct {
+	host   string
+	cfg    ProbeConfig
+	client http.Client
+
+	mu    sync.RWMutex
+	peers []string
+	table map[string]PeerLatency
+
+	quit chan bool
+	wg   sync.WaitGroup
+}
+
+func newProber(cfg ProbeConfig, host string, peers []string) *Prober {
+	if cfg.IntervalMs <= 0 {
+		cfg.IntervalMs = DEFAULT_PROBE_INTERVAL_MS
+	}
+	if cfg.TimeoutMs <= 0 {
+		cfg.TimeoutMs = DEFAULT_PROBE_TIMEOUT_MS
+	}
+	if cfg.Alpha <= 0 || cfg.Alpha > 1 {
+		cfg.Alpha = DEFAULT_PROBE_ALPHA
+	}
+	p := &Prober{host: host, cfg: cfg, table: map[string]PeerLatency{}, quit: make(chan bool)}
+	// probes get their own connections so that they are not queued behind offloads
+	p.client = http.Client{Timeout: time.Duration(cfg.TimeoutMs) * time.Millisecond, Transport: &http.Transport{}}
+	p.SetPeers(peers)
+	return p
+}
+
+// SetPeers replaces the probed peers. Measurements of removed peers are dropped.
+func (p *Prober) SetPeers(peers []string) {
+	if p == nil {
+		return
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.peers = nil
+	keep := map[string]bool{}
+	for _, peer := range peers {
+		if peer == p.host {
+			continue
+		}
+		p.peers = append(p.peers, peer)
+		keep[peer] = true
+	}
+	for peer := range p.table {
+		if !keep[peer] {
+			delete(p.table, peer)
+		}
+	}
+}
+
+// RTT returns the RTT EWMA of peer in milliseconds. ok is false if the peer was
+// never reached or its last probe failed.
+func (p *Prober) RTT(peer string) (float64, bool) {
+	if p == nil {
+		return 0, false
+	}
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	pl, ok := p.table[peer]
+	if !ok || pl.Failures > 0 {
+		return 0, false
+	}
+	return pl.RttMs, true
+}
+
+// Bandwidth returns the last measured bandwidth to peer in Mbps. ok is false if
+// bandwidth is not probed or the peer was never reached.
+func (p *Prober) Bandwidth(peer string) (float64, bool) {
+	if p == nil {
+		return 0, false
+	}
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	pl, ok := p.table[peer]
+	if !ok || pl.Failures > 0 || pl.BandwidthMbps <= 0 {
+		return 0, false
+	}
+	return pl.BandwidthMbps, true
+}
+
+// Table returns a copy of the latency table.
+func (p *Prober) Table() map[string]PeerLatency {
+	if p == nil {
+		return nil
+	}
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	table := make(map[string]PeerLatency, len(p.table))
+	for peer, pl := range p.table {
+		table[peer] = pl
+	}
+	return table
+}
+
+func (p *Prober) start() {
+	log.Printf("[INFO] Probing peers every %dms\n", p.cfg.IntervalMs)
+	p.wg.Add(1)
+	go p.probeRoutine()
+}
+
+func (p *Prober) Close() {
+	if p == nil {
+		return
+	}
+	close(p.quit)
+	p.wg.Wait()
+}
+
+func (p *Prober) probeRoutine() {
+	defer p.wg.Done()
+
+	probe_timer := time.NewTicker(time.Duration(p.cfg.IntervalMs) * time.Millisecond)
+	defer probe_timer.Stop()
+	for {
+		p.probeAll()
+		select {
+		case <-p.quit:
+			return
+		case <-probe_timer.C:
+		}
+	}
+}
+
+func (p *Prober) probeAll() {
+	p.mu.RLock()
+	peers := append([]string{}, p.peers...)
+	p.mu.RUnlock()
+
+	var wg sync.WaitGroup
+	for _, peer := range peers {
+		wg.Add(1)
+		go func(peer string) {
+			defer wg.Done()
+			p.probe(peer)
+		}(peer)
+	}
+	wg.Wait()
+}
+
+func (p *Prober) probe(peer string) {
+	rtt, err := p.ping(peer, nil)
+	var bw float64
+	if err == nil && p.cfg.BandwidthBytes > 0 {
+		var elapsed time.Duration
+		elapsed, err = p.ping(peer, make([]byte, p.cfg.BandwidthBytes))
+		// the transfer time is what the payload added on top of a round trip
+		if transfer := elapsed - rtt; err == nil && transfer > 0 {
+			bw = float64(8*p.cfg.BandwidthBytes) / transfer.Seconds() / 1e6
+		}
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	pl, known := p.table[peer]
+	if err != nil {
+		pl.Failures++
+		p.table[peer] = pl
+		log.Printf("[DEBUG] probe of %s failed: %v\n", peer, err)
+		return
+	}
+	ms := float64(rtt.Microseconds()) / 1000
+	if !known || pl.Failures > 0 {
+		pl.RttMs = ms
+	} else {
+		pl.RttMs = pl.RttMs*(1-p.cfg.Alpha) + ms*p.cfg.Alpha
+	}
+	pl.LastRttMs = ms
+	if bw > 0 {
+		pl.BandwidthMbps = bw
+	}
+	pl.Failures = 0
+	pl.Updated = time.Now()
+	p.table[peer] = pl
+}
+
+// ping sends payload, if any, to the ping endpoint of peer and returns the time until the reply was read.
+func (p *Prober) ping(peer string, payload []byte) (time.Duration, error) {
+	method := http.MethodGet
+	if payload != nil {
+		method = http.MethodPost
+	}
+	req, err := http.NewRequest(method, "http://"+peer+"/api/v1/namespaces/guest/ping", bytes.NewReader(payload))
+	if err != nil {
+		return 0, err
+	}
+
+	start := time.Now()
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	io.Copy(io.Discard, resp.Body)
+	resp.Body.Close()
+	return time.Since(start), nil
+}
+
+// handlePingRequest answers probes. Bandwidth probes post a payload, which is
+// read and dropped. With a target, the target is pinged on behalf of a member
+// that could not reach it; only members are pinged that way.
+func (r *requestHandler) handlePingRequest(w http.ResponseWriter, req *http.Request) {
+	// curl http://localhost:9696/api/v1/namespaces/guest/ping
+	io.Copy(io.Discard, req.Body)
+	r.membership.seen(req.Header.Get("X-Feo-Member"), req.RemoteAddr)
+
+	if target := req.URL.Query().Get("target"); target != "" {
+		if r.membership == nil {
+			http.Error(w, "membership is disabled", http.StatusNotFound)
+			return
+		}
+		if !r.membership.isMember(target) {
+			http.Error(w, fmt.Sprintf("%s is not a member", target), http.StatusForbidden)
+			return
+		}
+		if err := r.membership.ping(target, ""); err != nil {
+			http.Error(w, err.Error(), http.StatusBadGateway)
+			return
+		}
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,248 @@
+package feo
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"time"
+)
+
+const (
+	QlenEWMA       = "ewma"
+	QlenPercentile = "percentile"
+	QlenDecay      = "decay"
+	QlenHolt       = "holt"
+)
+
+// QlenEstimator smooths the queue length, which is sampled every 100ms. It is
+// not safe for concurrent use, its owner serializes the calls.
+type QlenEstimator interface {
+	Observe(qlen float64, ts time.Time)
+	Estimate() float64
+}
+
+// QlenEstimatorConfig picks an estimator and its parameters. Parameters that
+// are not set take the defaults of the estimator.
+type QlenEstimatorConfig struct {
+	// ewma, percentile, decay or holt
+	Kind string `yaml:"kind" json:"kind"`
+	// weight of the newest sample for ewma, of the newest level for holt
+	Alpha float64 `yaml:"alpha" json:"alpha,omitempty"`
+	// weight of the newest trend for holt
+	Beta float64 `yaml:"beta" json:"beta,omitempty"`
+	// how far ahead holt forecasts
+	HorizonMs int `yaml:"horizon_ms" json:"horizon_ms,omitempty"`
+	// percentile of the samples of the last window_ms
+	Percentile float64 `yaml:"percentile" json:"percentile,omitempty"`
+	WindowMs   int     `yaml:"window_ms" json:"window_ms,omitempty"`
+	// time after which a sample weighs half as much for decay
+	HalfLifeMs int `yaml:"half_life_ms" json:"half_life_ms,omitempty"`
+}
+
+// The defaults are the EWMAs feo used before the estimators were configurable.
+var (
+	DefaultHistoricQlen   = QlenEstimatorConfig{Kind: QlenEWMA, Alpha: 0.3}
+	DefaultControllerQlen = QlenEstimatorConfig{Kind: QlenEWMA, Alpha: 0.8}
+)
+
+// QlenConfig selects the estimators of an application.
+type QlenConfig struct {
+	// HistoricQlen of the snapshots
+	Historic QlenEstimatorConfig `yaml:"historic" json:"historic,omitempty"`
+	// qlen reported to the controller by the hybrid, epoch and central policies
+	Controller QlenEstimatorConfig `yaml:"controller" json:"controller,omitempty"`
+}
+
+func (c QlenConfig) Validate() error {
+	if err := c.Historic.Validate(); err != nil {
+		return fmt.Errorf("historic qlen: %w", err)
+	}
+	if err := c.Controller.Validate(); err != nil {
+		return fmt.Errorf("controller qlen: %w", err)
+	}
+	return nil
+}
+
+var qlenEstimators = map[string]func(cfg QlenEstimatorConfig) QlenEstimator{}
+
+// RegisterQlenEstimator makes an estimator available under kind. It panics if
+// the kind is registered twice.
+func RegisterQlenEstimator(kind string, New func(cfg QlenEstimatorConfig) QlenEstimator) {
+	if _, ok := qlenEstimators[kind]; ok {
+		panic(fmt.Sprintf("qlen estimator %s registered twice", kind))
+	}
+	qlenEstimators[kind] = New
+}
+
+// Validate accepts an empty kind, which stands for the default estimator.
+func (c QlenEstimatorConfig) Validate() error {
+	if c.Kind == "" {
+		return nil
+	}
+	if _, ok := qlenEstimators[c.Kind]; !ok {
+		return fmt.Errorf("unknown estimator %q", c.Kind)
+	}
+	if c.Alpha != 0 {
+		if err := validateAlpha("alpha", c.Alpha); err != nil {
+			return err
+		}
+	}
+	if c.Beta != 0 {
+		if err := validateAlpha("beta", c.Beta); err != nil {
+			return err
+		}
+	}
+	if c.Percentile < 0 || c.Percentile > 100 {
+		return fmt.Errorf("percentile must be in [0, 100], got %v", c.Percentile)
+	}
+	if c.HorizonMs < 0 || c.WindowMs < 0 || c.HalfLifeMs < 0 {
+		return fmt.Errorf("horizon_ms, window_ms and half_life_ms must not be negative")
+	}
+	return nil
+}
+
+// newQlenEstimator builds the estimator of cfg, or of def if cfg has no kind.
+func newQlenEstimator(cfg QlenEstimatorConfig, def QlenEstimatorConfig) QlenEstimator {
+	if cfg.Kind == "" {
+		cfg = def
+	}
+	return qlenEstimators[cfg.Kind](cfg)
+}
+
+func init() {
+	RegisterQlenEstimator(QlenEWMA, func(cfg QlenEstimatorConfig) QlenEstimator {
+		if cfg.Alpha == 0 {
+			cfg.Alpha = 0.3
+		}
+		return &ewmaQlen{alpha: cfg.Alpha}
+	})
+	RegisterQlenEstimator(QlenPercentile, func(cfg QlenEstimatorConfig) QlenEstimator {
+		if cfg.Percentile == 0 {
+			cfg.Percentile = 90
+		}
+		if cfg.WindowMs == 0 {
+			cfg.WindowMs = 1000
+		}
+		return &percentileQlen{p: cfg.Percentile, window: time.Duration(cfg.WindowMs) * time.Millisecond}
+	})
+	RegisterQlenEstimator(QlenDecay, func(cfg QlenEstimatorConfig) QlenEstimator {
+		if cfg.HalfLifeMs == 0 {
+			cfg.HalfLifeMs = 1000
+		}
+		return &decayQlen{halfLife: time.Duration(cfg.HalfLifeMs) * time.Millisecond}
+	})
+	RegisterQlenEstimator(QlenHolt, func(cfg QlenEstimatorConfig) QlenEstimator {
+		if cfg.Alpha == 0 {
+			cfg.Alpha = 0.5
+		}
+		if cfg.Beta == 0 {
+			cfg.Beta = 0.3
+		}
+		return &holtQlen{alpha: cfg.Alpha, beta: cfg.Beta, horizon: time.Duration(cfg.HorizonMs) * time.Millisecond}
+	})
+}
+
+// ewmaQlen starts at 0, like the historic qlen always did.
+type ewmaQlen struct {
+	alpha float64
+	est   float64
+}
+
+func (e *ewmaQlen) Observe(qlen float64, ts time.Time) {
+	e.est = (1-e.alpha)*e.est + e.alpha*qlen
+}
+
+func (e *ewmaQlen) Estimate() float64 {
+	return e.est
+}
+
+type qlenSample struct {
+	ts   time.Time
+	qlen float64
+}
+
+// percentileQlen is the percentile of the samples in a sliding window.
+type percentileQlen struct {
+	p       float64
+	window  time.Duration
+	samples []qlenSample
+}
+
+func (e *percentileQlen) Observe(qlen float64, ts time.Time) {
+	e.samples = append(e.samples, qlenSample{ts: ts, qlen: qlen})
+	start := 0
+	for start < len(e.samples)-1 && ts.Sub(e.samples[start].ts) > e.window {
+		start++
+	}
+	e.samples = e.samples[start:]
+}
+
+func (e *percentileQlen) Estimate() float64 {
+	if len(e.samples) == 0 {
+		return 0
+	}
+	sorted := make([]float64, len(e.samples))
+	for i, s := range e.samples {
+		sorted[i] = s.qlen
+	}
+	sort.Float64s(sorted)
+	return percentile(sorted, e.p)
+}
+
+// decayQlen is a mean in which a sample weighs half as much every half life.
+type decayQlen struct {
+	halfLife time.Duration
+	sum      float64
+	weight   float64
+	last     time.Time
+}
+
+func (e *decayQlen) Observe(qlen float64, ts time.Time) {
+	if !e.last.IsZero() {
+		decay := math.Exp2(-float64(ts.Sub(e.last)) / float64(e.halfLife))
+		e.sum *= decay
+		e.weight *= decay
+	}
+	e.sum += qlen
+	e.weight++
+	e.last = ts
+}
+
+func (e *decayQlen) Estimate() float64 {
+	if e.weight == 0 {
+		return 0
+	}
+	return e.sum / e.weight
+}
+
+// holtQlen is Holt's linear trend method. It forecasts horizon ahead, so a
+// growing queue is seen before it is long.
+type holtQlen struct {
+	alpha, beta float64
+	horizon     time.Duration
+
+	level, trend float64
+	// time between samples, the unit of the trend
+	step time.Duration
+	last time.Time
+}
+
+func (e *holtQlen) Observe(qlen float64, ts time.Time) {
+	if e.last.IsZero() {
+		e.level, e.last = qlen, ts
+		return
+	}
+	e.step = ts.Sub(e.last)
+	e.last = ts
+	prev := e.level
+	e.level = e.alpha*qlen + (1-e.alpha)*(e.level+e.trend)
+	e.trend = e.beta*(e.level-prev) + (1-e.beta)*e.trend
+}
+
+func (e *holtQlen) Estimate() float64 {
+	steps := 0.0
+	if e.step > 0 {
+		steps = float64(e.horizon) / float64(e.step)
+	}
+	return math.Max(0, e.level+steps*e.trend)
+}
@@ -1,17 +1,26 @@
-package main
+package feo
 
 import (
 	"container/list"
-	"log"
 	"net/http"
-
+	"sync"
 	// Should we use crypto/rand instead? Latency will probably be higher.
-	"math/rand"
-	"time"
 )
 
+const OffloadRandom = "random"
+
+func init() {
+	RegisterPolicy(PolicyRegistration{
+		Name: OffloadRandom,
+		New: func(base *BaseOffloader, params PolicyParams) OffloaderIntf {
+			return NewRandomOffloader(base)
+		},
+	})
+}
+
 type RandomOffloader struct {
 	*BaseOffloader //hacky embedding, because you cannot override methods of an embedding
+	mu             sync.Mutex
 	cur_idx        int
 }
 
@@ -20,33 +29,18 @@ func NewRandomOffloader(base *BaseOffloader) *RandomOffloader {
 }
 
 func (o *RandomOffloader) CheckAndEnq(req *http.Request) (*list.Element, bool) {
-	//NOTE: in round robin checkAndEnq returns true AND does a forceenq IF it is an offloaded request.
-	var ctx *list.Element
-	enq_success := false
-	if o.IsOffloaded(req) {
-		log.Println("[INFO] Already offloaded. Force Enq")
-		ctx = o.ForceEnq(req)
-		enq_success = true
-	}
-	return ctx, enq_success
+	return o.enqIfOffloaded(req)
 }
 
 func (o *RandomOffloader) GetOffloadCandidate(req *http.Request) string {
-	total_nodes := len(o.RouterList)
-	o.cur_idx = rand.Intn(100) % total_nodes
-	candidate := o.RouterList[o.cur_idx].host
-	return candidate
-}
-
-func (o *RandomOffloader) MetricSMAnalyze(ctx *list.Element) {
-
-	var timeElapsed time.Duration
-	if (ctx.Value.(*MetricSM).state == FinalState) && (ctx.Value.(*MetricSM).candidate != "default") {
-		if ctx.Value.(*MetricSM).local {
-			timeElapsed = ctx.Value.(*MetricSM).postLocal.Sub(ctx.Value.(*MetricSM).preLocal)
-		} else {
-			timeElapsed = ctx.Value.(*MetricSM).postOffload.Sub(ctx.Value.(*MetricSM).preOffload)
-		}
-		ctx.Value.(*MetricSM).elapsed = timeElapsed
+	routers := o.Candidates()
+	total_nodes := len(routers)
+	if total_nodes == 0 {
+		return o.Host
 	}
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.cur_idx = o.Rand.Intn(100) % total_nodes
+	candidate := routers[o.cur_idx].host
+	return candidate
 }
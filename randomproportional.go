@@ -1,14 +1,27 @@
-package main
+package feo
 
 import (
 	"container/list"
+	"encoding/json"
+	"fmt"
 	"log"
 	"math"
 	"net/http"
 	"sync"
-	"time"
 )
 
+const RandomProportional = "randomproportional"
+
+func init() {
+	RegisterPolicy(PolicyRegistration{
+		Name:      RandomProportional,
+		NewParams: func() PolicyParams { return DefaultRandomPropParams() },
+		New: func(base *BaseOffloader, params PolicyParams) OffloaderIntf {
+			return NewRandomPropOffloader(base, params.(*RandomPropParams))
+		},
+	})
+}
+
 // Already defined in impedenceoffload.go
 // type extendRouter struct {
 // 	routerInfo		router
@@ -16,6 +29,27 @@ import (
 // 	lastResponse	time.Time
 // }
 
+type RandomPropParams struct {
+	// weight of the latest latency sample in the EWMA
+	Alpha           float64 `yaml:"alpha" json:"alpha"`
+	RandompropAlpha float64 `yaml:"randomprop_alpha" json:"randomprop_alpha"`
+	RandompropBeta  float64 `yaml:"randomprop_beta" json:"randomprop_beta"`
+}
+
+func DefaultRandomPropParams() *RandomPropParams {
+	return &RandomPropParams{Alpha: 1.0, RandompropAlpha: 0.99, RandompropBeta: 0.99}
+}
+
+func (p *RandomPropParams) Validate() error {
+	if err := validateAlpha("alpha", p.Alpha); err != nil {
+		return err
+	}
+	if p.RandompropAlpha < 0 || p.RandompropBeta < 0 {
+		return fmt.Errorf("randomprop_alpha and randomprop_beta must not be negative")
+	}
+	return nil
+}
+
 type RandomPropOffloader struct {
 	*BaseOffloader   //hacky embedding, because you cannot override methods of an embedding
 	alpha            float64
@@ -26,41 +60,52 @@ type RandomPropOffloader struct {
 	ExtendRouterList []extendRouter
 }
 
-func NewRandomPropOffloader(base *BaseOffloader) *RandomPropOffloader {
+func NewRandomPropOffloader(base *BaseOffloader, params *RandomPropParams) *RandomPropOffloader {
 
 	// NOTE: According to the serverlessonedge implementation, the alpha: 1, randompropAlpha: 1, randomPropBeta: 1
 	// These numbers can be connfigured and compared if needed.
 
-	randomPropOffloader := &RandomPropOffloader{alpha: 1.0, randompropAlpha: 0.99, randompropBeta: 0.99, BaseOffloader: base}
-	randomPropOffloader.candidateToIndex = make(map[string]int)
+	randomPropOffloader := &RandomPropOffloader{alpha: params.Alpha, randompropAlpha: params.RandompropAlpha, randompropBeta: params.RandompropBeta, BaseOffloader: base}
+	randomPropOffloader.setRouters(base.Routers())
+	return randomPropOffloader
+}
 
-	curTime := time.Now()
+// setRouters rebuilds ExtendRouterList, keeping the state of the peers that stay. Must be called with o.mu held.
+func (o *RandomPropOffloader) setRouters(routers []router) {
+	known := map[string]extendRouter{}
+	for _, er := range o.ExtendRouterList {
+		known[er.routerInfo.host] = er
+	}
+
+	curTime := o.Clock.Now()
 
-	for idx, router := range base.RouterList {
-		randomPropOffloader.candidateToIndex[router.host] = idx
+	o.candidateToIndex = make(map[string]int)
+	o.ExtendRouterList = nil
+	for idx, router := range routers {
+		o.candidateToIndex[router.host] = idx
 
-		var newExtendRouter extendRouter
-		newExtendRouter.routerInfo = router
-		newExtendRouter.lambdasServed = 0
-		newExtendRouter.lastResponse = curTime
-		newExtendRouter.weight = 0
+		newExtendRouter, ok := known[router.host]
+		if !ok {
+			newExtendRouter.routerInfo = router
+			newExtendRouter.lambdasServed = 0
+			newExtendRouter.lastResponse = curTime
+			newExtendRouter.weight = 0
+		}
 
-		randomPropOffloader.ExtendRouterList = append(randomPropOffloader.ExtendRouterList, newExtendRouter)
+		o.ExtendRouterList = append(o.ExtendRouterList, newExtendRouter)
 	}
+}
 
-	return randomPropOffloader
+func (o *RandomPropOffloader) UpdatePeers(peers []string) {
+	o.BaseOffloader.UpdatePeers(peers)
+
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.setRouters(o.Routers())
 }
 
 func (o *RandomPropOffloader) CheckAndEnq(req *http.Request) (*list.Element, bool) {
-	//NOTE: in round robin checkAndEnq returns true AND does a forceenq IF it is an offloaded request.
-	var ctx *list.Element
-	enq_success := false
-	if o.IsOffloaded(req) {
-		log.Println("[INFO] Already offloaded. Force Enq")
-		ctx = o.ForceEnq(req)
-		enq_success = true
-	}
-	return ctx, enq_success
+	return o.enqIfOffloaded(req)
 }
 
 func (o *RandomPropOffloader) GetOffloadCandidate(req *http.Request) string {
@@ -72,9 +117,12 @@ func (o *RandomPropOffloader) GetOffloadCandidate(req *http.Request) string {
 	maxWeight := -1.0
 	maxIndex := -1
 
-	curTime := time.Now()
+	curTime := o.Clock.Now()
 
 	for i := 0; i < total_nodes; i++ {
+		if !o.Available(o.ExtendRouterList[i].routerInfo.host) {
+			continue
+		}
 		latency := o.ExtendRouterList[i].weight
 		lambdasServed := o.ExtendRouterList[i].lambdasServed
 		timeSinceLastResponse := float64(curTime.Sub(o.ExtendRouterList[i].lastResponse).Microseconds()) / 1000
@@ -101,37 +149,77 @@ func (o *RandomPropOffloader) GetOffloadCandidate(req *http.Request) string {
 	if maxIndex == -1 {
 		return o.Host
 	} else {
-		return o.RouterList[maxIndex].host
+		return o.ExtendRouterList[maxIndex].routerInfo.host
 	}
 }
 
-func (o *RandomPropOffloader) MetricSMAnalyze(ctx *list.Element) {
+type randomPropState struct {
+	Weight        float64 `json:"weight"`
+	LambdasServed int64   `json:"lambdas_served"`
+}
 
-	var timeElapsed time.Duration
-	if (ctx.Value.(*MetricSM).state == FinalState) && (ctx.Value.(*MetricSM).candidate != "default") {
-		if ctx.Value.(*MetricSM).local {
-			timeElapsed = ctx.Value.(*MetricSM).postLocal.Sub(ctx.Value.(*MetricSM).preLocal)
-		} else {
-			timeElapsed = ctx.Value.(*MetricSM).postOffload.Sub(ctx.Value.(*MetricSM).preOffload)
-		}
-		ctx.Value.(*MetricSM).elapsed = timeElapsed
+// SaveState stores the latency estimate and the number of served lambdas of every peer.
+func (o *RandomPropOffloader) SaveState() ([]byte, error) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	state := map[string]randomPropState{}
+	for _, er := range o.ExtendRouterList {
+		state[er.routerInfo.host] = randomPropState{Weight: er.weight, LambdasServed: er.lambdasServed}
+	}
+	return json.Marshal(state)
+}
+
+// PolicyState reports the latency estimate and the number of served lambdas of every peer.
+func (o *RandomPropOffloader) PolicyState() any {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	state := map[string]randomPropState{}
+	for _, er := range o.ExtendRouterList {
+		state[er.routerInfo.host] = randomPropState{Weight: er.weight, LambdasServed: er.lambdasServed}
+	}
+	return state
+}
+
+func (o *RandomPropOffloader) LoadState(data []byte) error {
+	state := map[string]randomPropState{}
+	if err := json.Unmarshal(data, &state); err != nil {
+		return fmt.Errorf("randomproportional state: %w", err)
+	}
 
-		if ctx.Value.(*MetricSM).localAfterFail || ctx.Value.(*MetricSM).localByDefault {
-			log.Println("[DEBUG] Local candidate not chosen by GetOffloadCandidate, no further analysis.")
-			return
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	for i := range o.ExtendRouterList {
+		if st, ok := state[o.ExtendRouterList[i].routerInfo.host]; ok {
+			o.ExtendRouterList[i].weight = st.Weight
+			o.ExtendRouterList[i].lambdasServed = st.LambdasServed
 		}
+	}
+	return nil
+}
 
-		if ctx.Value.(*MetricSM).candidate != "default" {
-			candidateIdx := o.candidateToIndex[ctx.Value.(*MetricSM).candidate]
+func (o *RandomPropOffloader) MetricSMAnalyze(ctx *list.Element) {
+	o.BaseOffloader.MetricSMAnalyze(ctx)
 
-			o.mu.Lock()
-			defer o.mu.Unlock()
+	sm := ctx.Value.(*MetricSM)
+	if !sm.finished() {
+		return
+	}
+	if !sm.chosen() {
+		log.Println("[DEBUG] Local candidate not chosen by GetOffloadCandidate, no further analysis.")
+		return
+	}
 
-			prevRouterWeight := o.ExtendRouterList[candidateIdx].weight
-			o.ExtendRouterList[candidateIdx].weight = prevRouterWeight*(1-o.alpha) + float64(timeElapsed.Microseconds()/1000)*o.alpha
+	o.mu.Lock()
+	defer o.mu.Unlock()
 
-			o.ExtendRouterList[candidateIdx].lambdasServed += 1
-			o.ExtendRouterList[candidateIdx].lastResponse = time.Now()
-		}
+	candidateIdx, ok := o.candidateToIndex[sm.candidate]
+	if !ok {
+		// the peer left while the invocation ran
+		return
 	}
+	prevRouterWeight := o.ExtendRouterList[candidateIdx].weight
+	o.ExtendRouterList[candidateIdx].weight = prevRouterWeight*(1-o.alpha) + sm.elapsedMs()*o.alpha
+
+	o.ExtendRouterList[candidateIdx].lambdasServed += 1
+	o.ExtendRouterList[candidateIdx].lastResponse = o.Clock.Now()
 }
@@ -0,0 +1,125 @@
+package feo
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"reflect"
+)
+
+// reloadConfig re-reads the config file, applies changes of the peers and
+// reconciles the declared applications and DAGs. Other settings only take
+// effect after a restart.
+func (r *requestHandler) reloadConfig() {
+	log.Printf("[INFO] Reloading config %s", r.configPath)
+	config, err := loadConfig(r.configPath)
+	if err != nil {
+		log.Printf("[WARNING] could not reload config: %v", err)
+		return
+	}
+	if r.membership != nil {
+		r.membership.sync(config.Peers)
+	} else if !reflect.DeepEqual(config.Peers, r.getPeers()) {
+		r.setPeers(config.Peers)
+	}
+	if err := r.reconcile(config); err != nil {
+		log.Printf("[WARNING] could not reconcile config: %v", err)
+	}
+}
+
+// reconcile brings the declared applications and DAGs in line with config.
+// Applications and DAGs registered over HTTP are left untouched. Nothing is
+// changed unless every declared application and DAG is valid.
+func (r *requestHandler) reconcile(config FeoConfig) error {
+	manifests := map[string][]byte{}
+	for _, dc := range config.Dags {
+		path := dc.Manifest
+		if !filepath.IsAbs(path) {
+			path = filepath.Join(filepath.Dir(r.configPath), path)
+		}
+		manifest, err := os.ReadFile(path)
+		if err != nil {
+			return fmt.Errorf("dag manifest: %w", err)
+		}
+		if _, err := parseDagManifest(manifest); err != nil {
+			return fmt.Errorf("dag %s: %w", path, err)
+		}
+		manifests[path] = manifest
+	}
+	for _, spec := range config.Applications {
+		if spec.Name == "" || spec.NumReplicas <= 0 {
+			return fmt.Errorf("application %q needs a name and at least one replica", spec.Name)
+		}
+		if err := r.validateApplication(spec); err != nil {
+			return fmt.Errorf("application %s: %w", spec.Name, err)
+		}
+	}
+
+	declared := map[string]bool{}
+	for _, spec := range config.Applications {
+		declared[spec.Name] = true
+
+		app, ok := r.getApplication(spec.Name)
+		if ok && app.declared && reflect.DeepEqual(app.spec, spec) {
+			continue
+		}
+		if err := r.registerApplication(spec, true); err != nil {
+			return fmt.Errorf("application %s: %w", spec.Name, err)
+		}
+	}
+
+	for appName, app := range r.getApplications() {
+		if app.declared && !declared[appName] {
+			r.removeApplication(appName)
+		}
+	}
+
+	dagNames := map[string]bool{}
+	for path, manifest := range manifests {
+		r.dagMu.RLock()
+		var unchanged bool
+		for name, old := range r.declaredDags {
+			if bytes.Equal(old, manifest) {
+				dagNames[name] = true
+				unchanged = true
+			}
+		}
+		r.dagMu.RUnlock()
+		if unchanged {
+			continue
+		}
+
+		dag, err := r.registerDag(manifest)
+		if err != nil {
+			return fmt.Errorf("dag %s: %w", path, err)
+		}
+		dagNames[dag.Name] = true
+		r.dagMu.Lock()
+		r.declaredDags[dag.Name] = manifest
+		r.dagMu.Unlock()
+	}
+
+	r.dagMu.Lock()
+	for name := range r.declaredDags {
+		if !dagNames[name] {
+			delete(r.declaredDags, name)
+			delete(r.dagMap, name)
+			log.Printf("[INFO] Removed DAG %s", name)
+		}
+	}
+	r.dagMu.Unlock()
+	return nil
+}
+
+func (r *requestHandler) removeApplication(appName string) {
+	r.appMu.Lock()
+	app, ok := r.applicationMap[appName]
+	delete(r.applicationMap, appName)
+	r.appMu.Unlock()
+	if ok {
+		app.retire()
+		log.Printf("[INFO] Removed application %s", appName)
+	}
+}
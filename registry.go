@@ -0,0 +1,100 @@
+package feo
+
+import (
+	"fmt"
+	"log"
+	"sort"
+	"sync"
+)
+
+// PolicyRegistration describes an offloading policy. Policies register
+// themselves from an init function; programs embedding feo can register their
+// own policies the same way before calling Main.
+type PolicyRegistration struct {
+	Name OffloadPolicy
+	// NewParams returns the default parameters of the policy. The yaml tags of the
+	// returned struct are the schema of the policy's `config` block. Policies
+	// without tunables leave it nil.
+	NewParams func() PolicyParams
+	// New creates the offloader. params is the value returned by NewParams after
+	// the `config` block was decoded into it and validated.
+	New func(base *BaseOffloader, params PolicyParams) OffloaderIntf
+}
+
+var (
+	policyRegistry   = map[OffloadPolicy]PolicyRegistration{}
+	policyRegistryMu sync.RWMutex
+)
+
+// RegisterPolicy makes a policy available by name. It panics if the name is
+// empty or already registered.
+func RegisterPolicy(reg PolicyRegistration) {
+	if reg.Name == "" || reg.New == nil {
+		panic("feo: policy registration needs a name and a constructor")
+	}
+	if reg.NewParams == nil {
+		reg.NewParams = func() PolicyParams { return &NoParams{} }
+	}
+
+	policyRegistryMu.Lock()
+	defer policyRegistryMu.Unlock()
+	if _, dup := policyRegistry[reg.Name]; dup {
+		panic(fmt.Sprintf("feo: policy %s registered twice", reg.Name))
+	}
+	policyRegistry[reg.Name] = reg
+}
+
+func lookupPolicy(pol OffloadPolicy) (PolicyRegistration, error) {
+	policyRegistryMu.RLock()
+	defer policyRegistryMu.RUnlock()
+	reg, ok := policyRegistry[pol]
+	if !ok {
+		return reg, fmt.Errorf("unknown policy %q, registered policies are %v", pol, registeredPolicies())
+	}
+	return reg, nil
+}
+
+// registeredPolicies must be called with policyRegistryMu held.
+func registeredPolicies() []OffloadPolicy {
+	names := make([]OffloadPolicy, 0, len(policyRegistry))
+	for name := range policyRegistry {
+		names = append(names, name)
+	}
+	sort.Slice(names, func(i, j int) bool { return names[i] < names[j] })
+	return names
+}
+
+// RegisteredPolicies returns the names of all registered policies.
+func RegisteredPolicies() []OffloadPolicy {
+	policyRegistryMu.RLock()
+	defer policyRegistryMu.RUnlock()
+	return registeredPolicies()
+}
+
+// LoadPolicyParams returns the validated parameters of policy pol, starting
+// from the policy's defaults.
+func LoadPolicyParams(pol OffloadPolicy, raw RawPolicyParams) (PolicyParams, error) {
+	reg, err := lookupPolicy(pol)
+	if err != nil {
+		return nil, err
+	}
+
+	params := reg.NewParams()
+	if err := raw.decode(params); err != nil {
+		return nil, fmt.Errorf("policy %s: %w", pol, err)
+	}
+	if err := params.Validate(); err != nil {
+		return nil, fmt.Errorf("policy %s: %w", pol, err)
+	}
+	return params, nil
+}
+
+// OffloadFactory creates the offloader of policy pol on top of base. params must come from LoadPolicyParams(pol, ...).
+func OffloadFactory(pol OffloadPolicy, params PolicyParams, base *BaseOffloader) (OffloaderIntf, error) {
+	reg, err := lookupPolicy(pol)
+	if err != nil {
+		return nil, err
+	}
+	log.Printf("[INFO] Selecting %s Offloader", pol)
+	return reg.New(base, params), nil
+}
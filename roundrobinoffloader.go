@@ -1,14 +1,25 @@
-package main
+package feo
 
 import (
 	"container/list"
-	"log"
 	"net/http"
-	"time"
+	"sync"
 )
 
+const OffloadRoundRobin = "roundrobin"
+
+func init() {
+	RegisterPolicy(PolicyRegistration{
+		Name: OffloadRoundRobin,
+		New: func(base *BaseOffloader, params PolicyParams) OffloaderIntf {
+			return NewRoundRobinOffloader(base)
+		},
+	})
+}
+
 type RoundRobinOffloader struct {
 	*BaseOffloader
+	mu      sync.Mutex
 	cur_idx int
 }
 
@@ -17,33 +28,19 @@ func NewRoundRobinOffloader(base *BaseOffloader) *RoundRobinOffloader {
 }
 
 func (o *RoundRobinOffloader) CheckAndEnq(req *http.Request) (*list.Element, bool) {
-	//NOTE: in round robin checkAndEnq returns true AND does a forceenq IF it is an offloaded request.
-	var ctx *list.Element
-	enq_success := false
-	if o.IsOffloaded(req) {
-		log.Println("[INFO] Already offloaded. Force Enq")
-		ctx = o.ForceEnq(req)
-		enq_success = true
-	}
-	return ctx, enq_success
+	return o.enqIfOffloaded(req)
 }
 
 func (o *RoundRobinOffloader) GetOffloadCandidate(req *http.Request) string {
-	candidate := o.RouterList[o.cur_idx].host
-	total_nodes := len(o.RouterList)
+	routers := o.Candidates()
+	total_nodes := len(routers)
+	if total_nodes == 0 {
+		return o.Host
+	}
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.cur_idx = o.cur_idx % total_nodes
+	candidate := routers[o.cur_idx].host
 	o.cur_idx = (o.cur_idx + 1) % total_nodes
 	return candidate
 }
-
-func (o *RoundRobinOffloader) MetricSMAnalyze(ctx *list.Element) {
-
-	var timeElapsed time.Duration
-	if (ctx.Value.(*MetricSM).state == FinalState) && (ctx.Value.(*MetricSM).candidate != "default") {
-		if ctx.Value.(*MetricSM).local {
-			timeElapsed = ctx.Value.(*MetricSM).postLocal.Sub(ctx.Value.(*MetricSM).preLocal)
-		} else {
-			timeElapsed = ctx.Value.(*MetricSM).postOffload.Sub(ctx.Value.(*MetricSM).preOffload)
-		}
-		ctx.Value.(*MetricSM).elapsed = timeElapsed
-	}
-}
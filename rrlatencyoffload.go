@@ -1,16 +1,28 @@
-package main
+package feo
 
 import (
 	"container/heap"
 	"container/list"
+	"fmt"
 	"log"
 	"math"
-	"math/rand"
 	"net/http"
 	"sync"
 	"time"
 )
 
+const RRLatency = "roundrobinlatency"
+
+func init() {
+	RegisterPolicy(PolicyRegistration{
+		Name:      RRLatency,
+		NewParams: func() PolicyParams { return DefaultRRLatencyParams() },
+		New: func(base *BaseOffloader, params PolicyParams) OffloaderIntf {
+			return NewRRLatencyOffloader(base, params.(*RRLatencyParams))
+		},
+	})
+}
+
 // The priority queue taken from go docs: https://pkg.go.dev/container/heap
 
 type CacheElement struct {
@@ -66,9 +78,9 @@ func (pq *PriorityQueue) update(item *Item, deficit float64) {
 	heap.Fix(pq, item.index)
 }
 
-func NewCacheElement(weight float64, deficit float64, initStalePeriod float64, hostName string) *CacheElement {
+func NewCacheElement(weight float64, deficit float64, initStalePeriod float64, hostName string, now time.Time) *CacheElement {
 	cacheElement := &CacheElement{weight: weight, deficit: deficit, stalePeriod: time.Duration(initStalePeriod) * time.Second, candidate: hostName}
-	cacheElement.lastUpdated = time.Now()
+	cacheElement.lastUpdated = now
 	cacheElement.active = true
 	cacheElement.probing = false
 
@@ -90,6 +102,35 @@ func (c *CacheElement) UpdateStalePeriod(maxStalePeriod float64, backoffCoeffici
 	}
 }
 
+type RRLatencyParams struct {
+	// weight of the latest latency sample in the EWMA
+	Alpha float64 `yaml:"alpha" json:"alpha"`
+	// inactive peers are probed again after their stale period, which backs off on every failed probe
+	InitStalePeriodS   float64 `yaml:"init_stale_period_s" json:"init_stale_period_s"`
+	BackoffCoefficient float64 `yaml:"backoff_coefficient" json:"backoff_coefficient"`
+	MaxStalePeriodS    float64 `yaml:"max_stale_period_s" json:"max_stale_period_s"`
+}
+
+func DefaultRRLatencyParams() *RRLatencyParams {
+	return &RRLatencyParams{Alpha: 0.2, InitStalePeriodS: 1.0, BackoffCoefficient: 2.0, MaxStalePeriodS: 30.0}
+}
+
+func (p *RRLatencyParams) Validate() error {
+	if err := validateAlpha("alpha", p.Alpha); err != nil {
+		return err
+	}
+	if p.InitStalePeriodS <= 0 {
+		return fmt.Errorf("init_stale_period_s must be positive, got %v", p.InitStalePeriodS)
+	}
+	if p.BackoffCoefficient < 1 {
+		return fmt.Errorf("backoff_coefficient must be at least 1, got %v", p.BackoffCoefficient)
+	}
+	if p.MaxStalePeriodS < p.InitStalePeriodS {
+		return fmt.Errorf("max_stale_period_s (%v) must not be below init_stale_period_s (%v)", p.MaxStalePeriodS, p.InitStalePeriodS)
+	}
+	return nil
+}
+
 type RRLatencyOffloader struct {
 	*BaseOffloader     //hacky embedding, because you cannot override methods of an embedding
 	mu                 sync.Mutex
@@ -100,11 +141,10 @@ type RRLatencyOffloader struct {
 	initStalePeriod    float64
 	backoffCoefficient float64
 	maxStalePeriod     float64
-	randUtil           *rand.Rand
 }
 
-func NewRRLatencyOffloader(base *BaseOffloader) *RRLatencyOffloader {
-	rrLatencyOffloader := &RRLatencyOffloader{BaseOffloader: base, alpha: 0.2, initStalePeriod: 1.0, backoffCoefficient: 2.0, maxStalePeriod: 30.0}
+func NewRRLatencyOffloader(base *BaseOffloader, params *RRLatencyParams) *RRLatencyOffloader {
+	rrLatencyOffloader := &RRLatencyOffloader{BaseOffloader: base, alpha: params.Alpha, initStalePeriod: params.InitStalePeriodS, backoffCoefficient: params.BackoffCoefficient, maxStalePeriod: params.MaxStalePeriodS}
 	// rrLatencyOffloader.candidateToIndex = make(map[string]int)
 
 	// NOTE: According to the serverlessonedge implementation, the alpha: 1, randompropAlpha: 1, randomPropBeta: 1
@@ -116,10 +156,10 @@ func NewRRLatencyOffloader(base *BaseOffloader) *RRLatencyOffloader {
 	rrLatencyOffloader.pq = make(PriorityQueue, 0)
 	heap.Init(&rrLatencyOffloader.pq)
 
-	for idx, router := range base.RouterList {
+	for idx, router := range base.Routers() {
 		// rrLatencyOffloader.candidateToIndex[router.host] = idx
 
-		newCacheElement := NewCacheElement(0.0, 0.0, rrLatencyOffloader.initStalePeriod, router.host)
+		newCacheElement := NewCacheElement(0.0, 0.0, rrLatencyOffloader.initStalePeriod, router.host, base.Clock.Now())
 		newItem := &Item{ce: newCacheElement, index: idx}
 
 		rrLatencyOffloader.candidateToItem[router.host] = newItem
@@ -129,38 +169,59 @@ func NewRRLatencyOffloader(base *BaseOffloader) *RRLatencyOffloader {
 		rrLatencyOffloader.pq.Push(newItem)
 	}
 
-	// Src: https://gobyexample.com/random-numbers
-	s1 := rand.NewSource(time.Now().UnixNano())
-	rrLatencyOffloader.randUtil = rand.New(s1)
-
 	return rrLatencyOffloader
 }
 
-func (o *RRLatencyOffloader) CheckAndEnq(req *http.Request) (*list.Element, bool) {
-	//NOTE: in round robin latency checkAndEnq returns true AND does a forceenq IF it is an offloaded request.
-	var ctx *list.Element
-	enq_success := false
-	if o.IsOffloaded(req) {
-		log.Println("[INFO] Already offloaded. Force Enq")
-		ctx = o.ForceEnq(req)
-		enq_success = true
+// UpdatePeers adds joined peers as active candidates without a weight and
+// removes the ones that left from the queue.
+func (o *RRLatencyOffloader) UpdatePeers(peers []string) {
+	o.BaseOffloader.UpdatePeers(peers)
+
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	keep := map[string]bool{}
+	itemArray := make([]*Item, 0)
+	for _, host := range peers {
+		keep[host] = true
+		item, ok := o.candidateToItem[host]
+		if !ok {
+			item = &Item{ce: NewCacheElement(0.0, 0.0, o.initStalePeriod, host, o.Clock.Now())}
+			o.candidateToItem[host] = item
+			o.pq.Push(item)
+		}
+		itemArray = append(itemArray, item)
+	}
+	for host, item := range o.candidateToItem {
+		if keep[host] {
+			continue
+		}
+		// inactive items were already popped
+		if item.index >= 0 && item.index < len(o.pq) && o.pq[item.index] == item {
+			heap.Remove(&o.pq, item.index)
+		}
+		delete(o.candidateToItem, host)
 	}
-	return ctx, enq_success
+	o.itemArray = itemArray
+}
+
+func (o *RRLatencyOffloader) CheckAndEnq(req *http.Request) (*list.Element, bool) {
+	return o.enqIfOffloaded(req)
 }
 
 func (o *RRLatencyOffloader) GetOffloadCandidate(req *http.Request) string {
 	log.Println("[INFO] Selecting Candidate.")
-	total_nodes := len(o.itemArray)
-
-	curTime := time.Now()
+	curTime := o.Clock.Now()
 
 	o.mu.Lock()
 	defer o.mu.Unlock()
 
+	total_nodes := len(o.itemArray)
+
 	var indexArr []int
 	// O(n) -> n is the number of nodes.
 	for i := 0; i < total_nodes; i++ {
-		if !o.itemArray[i].ce.active && !o.itemArray[i].ce.probing && curTime.After(o.itemArray[i].ce.lastUpdated.Add(o.itemArray[i].ce.stalePeriod)) {
+		if !o.itemArray[i].ce.active && !o.itemArray[i].ce.probing && curTime.After(o.itemArray[i].ce.lastUpdated.Add(o.itemArray[i].ce.stalePeriod)) && o.Available(o.itemArray[i].ce.candidate) {
 			indexArr = append(indexArr, i)
 		}
 	}
@@ -168,15 +229,19 @@ func (o *RRLatencyOffloader) GetOffloadCandidate(req *http.Request) string {
 	idx := -1
 	if len(indexArr) != 0 {
 		// fmt.Println("Choosing random router to probe.")
-		idx = indexArr[o.randUtil.Intn(len(indexArr))]
+		idx = indexArr[o.Rand.Intn(len(indexArr))]
 		o.itemArray[idx].ce.probing = true
 
 		return o.itemArray[idx].ce.candidate
 	} else {
-		if o.pq[len(o.pq)-1].ce.active {
+		idx = len(o.pq) - 1
+		// peers whose circuit is open are passed over
+		for idx >= 0 && !o.Available(o.pq[idx].ce.candidate) {
+			idx--
+		}
+		if idx >= 0 && o.pq[idx].ce.active {
 			// log.Println("[DEBUG] Lowest weight:", o.pq[len(o.pq)-1].ce.weight)
 			// log.Println("[DEBUG] Priority queue", o.pq[0].ce.weight)
-			idx = len(o.pq) - 1
 
 			o.pq.update(o.pq[idx], o.pq[idx].ce.deficit+o.pq[idx].ce.weight)
 
@@ -190,25 +255,26 @@ func (o *RRLatencyOffloader) GetOffloadCandidate(req *http.Request) string {
 
 func (o *RRLatencyOffloader) MetricSMAnalyze(ctx *list.Element) {
 	log.Println("[INFO] Analyzing Metrics.")
-	var timeElapsed time.Duration
-	if (ctx.Value.(*MetricSM).state == FinalState) && (ctx.Value.(*MetricSM).candidate != "default") {
-		if ctx.Value.(*MetricSM).local {
-			timeElapsed = ctx.Value.(*MetricSM).postLocal.Sub(ctx.Value.(*MetricSM).preLocal)
-		} else {
-			timeElapsed = ctx.Value.(*MetricSM).postOffload.Sub(ctx.Value.(*MetricSM).preOffload)
-		}
-		ctx.Value.(*MetricSM).elapsed = timeElapsed
+	o.BaseOffloader.MetricSMAnalyze(ctx)
 
-		if ctx.Value.(*MetricSM).localAfterFail || ctx.Value.(*MetricSM).localByDefault {
+	sm := ctx.Value.(*MetricSM)
+	if sm.finished() {
+		elapsedMs := sm.elapsedMs()
+
+		if !sm.chosen() {
 			log.Println("[DEBUG] Local candidate not chosen by GetOffloadCandidate, no further analysis.")
 			return
 		}
 
-		candidateItem := o.candidateToItem[ctx.Value.(*MetricSM).candidate]
-
 		o.mu.Lock()
 		defer o.mu.Unlock()
 
+		candidateItem, ok := o.candidateToItem[sm.candidate]
+		if !ok {
+			// the peer left while the invocation ran
+			return
+		}
+
 		// o.ExtendRouterList[candidateIdx].lambdasServed += 1
 		// o.ExtendRouterList[candidateIdx].lastResponse = time.Now()
 
@@ -220,8 +286,11 @@ func (o *RRLatencyOffloader) MetricSMAnalyze(ctx *list.Element) {
 			lowestWtItem := o.lowestWeightItem()
 			// lowestWtItem := o.pq[0]
 
-			if float64(timeElapsed.Microseconds()/1000) <= 2*lowestWtItem.ce.weight {
-				lowestDeficit := o.pq[len(o.pq)-1].ce.deficit
+			if lowestWtItem == nil || elapsedMs <= 2*lowestWtItem.ce.weight {
+				lowestDeficit := 0.0
+				if len(o.pq) != 0 {
+					lowestDeficit = o.pq[len(o.pq)-1].ce.deficit
+				}
 
 				// O(nlogn) -> where n is the number of routers
 				for _, item := range o.itemArray {
@@ -229,8 +298,8 @@ func (o *RRLatencyOffloader) MetricSMAnalyze(ctx *list.Element) {
 						o.pq.update(item, item.ce.deficit-lowestDeficit)
 					}
 				}
-				candidateItem.ce.deficit = float64(timeElapsed.Microseconds() / 1000)
-				candidateItem.ce.weight = float64(timeElapsed.Microseconds() / 1000)
+				candidateItem.ce.deficit = elapsedMs
+				candidateItem.ce.weight = elapsedMs
 				candidateItem.ce.ResetStalePeriod(o.initStalePeriod)
 				candidateItem.ce.active = true
 
@@ -241,7 +310,7 @@ func (o *RRLatencyOffloader) MetricSMAnalyze(ctx *list.Element) {
 			}
 		} else {
 			prevRouterWeight := candidateItem.ce.weight
-			candidateItem.ce.weight = prevRouterWeight*(1-o.alpha) + float64(timeElapsed.Microseconds()/1000)*o.alpha
+			candidateItem.ce.weight = prevRouterWeight*(1-o.alpha) + elapsedMs*o.alpha
 
 			if candidateItem.ce.active {
 
@@ -282,18 +351,21 @@ func (o *RRLatencyOffloader) MetricSMAnalyze(ctx *list.Element) {
 			}
 
 		}
-		candidateItem.ce.lastUpdated = time.Now()
+		candidateItem.ce.lastUpdated = o.Clock.Now()
 	} else {
 		// The call failed, we need to do some cleanup so that this router can be picked again and tried.
 
 		// ADDED based on intuition.
 
-		if ctx.Value.(*MetricSM).candidate != "default" {
+		if sm.candidate != "default" {
 
 			o.mu.Lock()
 			defer o.mu.Unlock()
 
-			candidateItem := o.candidateToItem[ctx.Value.(*MetricSM).candidate]
+			candidateItem, ok := o.candidateToItem[sm.candidate]
+			if !ok {
+				return
+			}
 
 			if candidateItem.ce.probing {
 				candidateItem.ce.probing = false
@@ -308,7 +380,11 @@ func (o *RRLatencyOffloader) MetricSMAnalyze(ctx *list.Element) {
 	}
 }
 
+// lowestWeightItem returns nil if no candidate is active.
 func (o *RRLatencyOffloader) lowestWeightItem() *Item {
+	if len(o.pq) == 0 {
+		return nil
+	}
 
 	lowestWtItem := o.pq[0]
 
@@ -320,3 +396,24 @@ func (o *RRLatencyOffloader) lowestWeightItem() *Item {
 
 	return lowestWtItem
 }
+
+// rrLatencyState is what the offloader knows about one peer.
+type rrLatencyState struct {
+	Weight       float64 `json:"weight"`
+	Deficit      float64 `json:"deficit"`
+	Active       bool    `json:"active"`
+	Probing      bool    `json:"probing"`
+	StalePeriodS float64 `json:"stale_period_s"`
+}
+
+// PolicyState reports the weight and deficit of every peer.
+func (o *RRLatencyOffloader) PolicyState() any {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	state := map[string]rrLatencyState{}
+	for host, item := range o.candidateToItem {
+		ce := item.ce
+		state[host] = rrLatencyState{Weight: ce.weight, Deficit: ce.deficit, Active: ce.active, Probing: ce.probing, StalePeriodS: ce.stalePeriod.Seconds()}
+	}
+	return state
+}
@@ -0,0 +1,819 @@
+package feo
+
+import (
+	"bufio"
+	"container/heap"
+	"container/list"
+	"encoding/csv"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"math/rand"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// SimConfig describes a simulated cluster and its workload for feo-sim.
+type SimConfig struct {
+	Seed      int64   `yaml:"seed"`
+	DurationS float64 `yaml:"duration_s"`
+	// Policy of every node that does not set its own
+	Policy PolicyConfig `yaml:"policy"`
+	// RTT between nodes that are not linked explicitly
+	RttMs         float64   `yaml:"rtt_ms"`
+	BandwidthMbps float64   `yaml:"bandwidth_mbps"`
+	Links         []SimLink `yaml:"links"`
+	// Gossip and Probe give every node an exact and instant view of the load
+	// of the others and of the RTTs
+	Gossip bool      `yaml:"gossip"`
+	Probe  bool      `yaml:"probe"`
+	Apps   []SimApp  `yaml:"apps"`
+	Nodes  []SimNode `yaml:"nodes"`
+	// Trace replaces the synthetic arrivals of the nodes, see SimRequest.
+	Trace string `yaml:"trace"`
+}
+
+// SimLink overrides the network between two nodes, in both directions.
+type SimLink struct {
+	A             string  `yaml:"a"`
+	B             string  `yaml:"b"`
+	RttMs         float64 `yaml:"rtt_ms"`
+	BandwidthMbps float64 `yaml:"bandwidth_mbps"`
+}
+
+type SimApp struct {
+	Name    string            `yaml:"name"`
+	Service SimDist           `yaml:"service"`
+	Bytes   int64             `yaml:"bytes"`
+	Limits  ApplicationLimits `yaml:"limits"`
+	Qlen    QlenConfig        `yaml:"qlen"`
+}
+
+// SimDist is a distribution of durations.
+type SimDist struct {
+	// const, exp or lognormal
+	Dist     string  `yaml:"dist"`
+	MeanMs   float64 `yaml:"mean_ms"`
+	StddevMs float64 `yaml:"stddev_ms"`
+}
+
+type SimNode struct {
+	Host string `yaml:"host"`
+	// replicas of every app
+	Replicas int `yaml:"replicas"`
+	// Poisson arrivals per second of every app
+	Rate   float64       `yaml:"rate"`
+	Policy *PolicyConfig `yaml:"policy"`
+	Cost   NodeCost      `yaml:"cost"`
+}
+
+// SimRequest is one line of a trace file.
+type SimRequest struct {
+	TsMs float64 `json:"ts_ms"`
+	Node string  `json:"node"`
+	App  string  `json:"app"`
+	// drawn from the service distribution of the app if 0
+	ServiceMs float64 `json:"service_ms"`
+	// the bytes of the app if 0
+	Bytes int64 `json:"bytes"`
+}
+
+// policies that need a controller cannot be simulated
+var simUnsupported = map[OffloadPolicy]bool{OffloadHybrid: true, OffloadEpoch: true, OffloadCentral: true}
+
+// virtual time starts here, so that MetricSM timestamps are never zero
+var simEpoch = time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+
+const SIM_TICK = 100 * time.Millisecond
+
+type simEventKind int
+
+const (
+	simArrival simEventKind = iota
+	// an offloaded invocation reaches its peer
+	simEnter
+	simComplete
+	// the reply of an offloaded invocation reaches its origin
+	simReply
+	// the 100ms tick of the historic qlen
+	simTick
+)
+
+type simEvent struct {
+	at   time.Duration
+	seq  int
+	kind simEventKind
+	job  *simJob
+}
+
+type simEvents []*simEvent
+
+func (q simEvents) Len() int { return len(q) }
+func (q simEvents) Less(i, j int) bool {
+	if q[i].at != q[j].at {
+		return q[i].at < q[j].at
+	}
+	return q[i].seq < q[j].seq
+}
+func (q simEvents) Swap(i, j int) { q[i], q[j] = q[j], q[i] }
+func (q *simEvents) Push(x any)   { *q = append(*q, x.(*simEvent)) }
+func (q *simEvents) Pop() any {
+	old := *q
+	e := old[len(old)-1]
+	*q = old[:len(old)-1]
+	return e
+}
+
+// simPool hands the replicas of an app on a node to queued invocations in FIFO order.
+type simPool struct {
+	free    int
+	waiting []*simJob
+}
+
+type simNode struct {
+	host       string
+	cfg        SimNode
+	offloaders map[string]OffloaderIntf
+	pools      map[string]*simPool
+	gossip     *Gossiper
+	// rng is shared by the offloaders of the node, as in the handler
+	rng *rand.Rand
+}
+
+// simJob is one invocation.
+type simJob struct {
+	id      int
+	req     SimRequest
+	httpReq *http.Request
+	svc     time.Duration
+	origin  *simNode
+	exec    *simNode
+	// MetricSM at the origin and at the node that ran the invocation
+	originCtx *list.Element
+	execCtx   *list.Element
+	// queue entry at the node that ran the invocation
+	elem      *list.Element
+	offloaded bool
+	fallback  bool
+	attempts  int
+
+	arrival, enter, start time.Duration
+	// the synthetic arrivals of origin continue after this one
+	synthetic bool
+}
+
+// SimResult is the outcome of one simulated invocation.
+type SimResult struct {
+	ID     int
+	App    string
+	Origin string
+	Node   string
+	// local, offload or fallback, i.e. run locally after a rejected offload
+	Placement string
+	ArrivalMs float64
+	LatencyMs float64
+	WaitMs    float64
+	ServiceMs float64
+	Attempts  int
+}
+
+// Simulation runs the registered offloaders against simulated nodes, replicas
+// and links on a virtual clock. Invocations are admitted by their origin,
+// offloaded to the candidate of its policy, and rejected offloads run locally,
+// as in the handler. Offloads reach the peer for admission at once; the
+// invocation and its reply then take half the RTT and the transfer time each.
+// The offloaders run on the virtual clock and on random numbers drawn from
+// the seed, so runs of the same configuration are identical.
+type Simulation struct {
+	cfg     SimConfig
+	rng     *rand.Rand
+	apps    map[string]SimApp
+	nodes   map[string]*simNode
+	order   []string
+	events  simEvents
+	seq     int
+	now     time.Duration
+	end     time.Duration
+	nextID  int
+	results []SimResult
+}
+
+func loadSimConfig(path string) (SimConfig, error) {
+	var cfg SimConfig
+	f, err := os.ReadFile(path)
+	if err != nil {
+		return cfg, err
+	}
+	if err := yaml.Unmarshal(f, &cfg); err != nil {
+		return cfg, err
+	}
+	if cfg.Trace != "" && !filepath.IsAbs(cfg.Trace) {
+		cfg.Trace = filepath.Join(filepath.Dir(path), cfg.Trace)
+	}
+	return cfg, nil
+}
+
+func newSimulation(cfg SimConfig) (*Simulation, error) {
+	if len(cfg.Nodes) == 0 || len(cfg.Apps) == 0 {
+		return nil, fmt.Errorf("a simulation needs nodes and apps")
+	}
+	if cfg.Trace == "" && cfg.DurationS <= 0 {
+		return nil, fmt.Errorf("duration_s must be positive without a trace")
+	}
+	s := &Simulation{cfg: cfg, rng: rand.New(rand.NewSource(cfg.Seed)), apps: map[string]SimApp{}, nodes: map[string]*simNode{}}
+	s.end = time.Duration(cfg.DurationS * float64(time.Second))
+	for _, app := range cfg.Apps {
+		if err := app.Service.Validate(); err != nil {
+			return nil, fmt.Errorf("app %s: %w", app.Name, err)
+		}
+		s.apps[app.Name] = app
+	}
+
+	costs := map[string]NodeCost{}
+	for _, n := range cfg.Nodes {
+		if n.Host == "" || n.Replicas <= 0 {
+			return nil, fmt.Errorf("node %q needs a host and at least one replica", n.Host)
+		}
+		if _, ok := s.nodes[n.Host]; ok {
+			return nil, fmt.Errorf("node %s is declared twice", n.Host)
+		}
+		s.nodes[n.Host] = &simNode{host: n.Host, cfg: n, offloaders: map[string]OffloaderIntf{}, pools: map[string]*simPool{}, rng: NewRand(s.rng.Int63())}
+		s.order = append(s.order, n.Host)
+		costs[n.Host] = n.Cost
+	}
+
+	for _, host := range s.order {
+		node := s.nodes[host]
+		peers := []string{}
+		for _, peer := range s.order {
+			if peer != host {
+				peers = append(peers, peer)
+			}
+		}
+		policyConfig := cfg.Policy
+		if node.cfg.Policy != nil {
+			policyConfig = *node.cfg.Policy
+		}
+		policy := OffloadPolicy(policyConfig.Name)
+		if simUnsupported[policy] {
+			return nil, fmt.Errorf("policy %s needs a controller and cannot be simulated", policy)
+		}
+		if cfg.Gossip {
+			node.gossip = newGossiper(GossipConfig{}, host, nil, nil, node.rng)
+		}
+		var prober *Prober
+		if cfg.Probe {
+			prober = newProber(ProbeConfig{}, host, peers)
+			for _, peer := range peers {
+				rtt, mbps := s.link(host, peer)
+				prober.table[peer] = PeerLatency{RttMs: rtt, LastRttMs: rtt, BandwidthMbps: mbps, Updated: time.Now()}
+			}
+		}
+
+		for _, app := range cfg.Apps {
+			params, err := LoadPolicyParams(policy, policyConfig.Config)
+			if err != nil {
+				return nil, fmt.Errorf("node %s: %w", host, err)
+			}
+			spec := ApplicationSpec{Name: app.Name, NumReplicas: node.cfg.Replicas, Limits: app.Limits, Qlen: app.Qlen}
+			if err := spec.Qlen.Validate(); err != nil {
+				return nil, fmt.Errorf("app %s: %w", app.Name, err)
+			}
+			config := FeoConfig{Host: host, Policy: policyConfig, Peers: peers, Costs: costs}
+			base := newBaseOffloader(config, newFunctionInfo(newQlenEstimator(spec.Qlen.Historic, DefaultHistoricQlen)), simClock{s}, node.rng)
+			base.Prober = prober
+			base.Gossip = node.gossip
+			base.Replicas = spec.NumReplicas
+			base.SloMs = spec.Limits.SloMs
+			base.ControllerQlen = spec.Qlen.Controller
+			base.Transport = simTransport{s}
+			offloader, err := newOffloader(spec, policyConfig, params, base)
+			if err != nil {
+				return nil, fmt.Errorf("node %s: %w", host, err)
+			}
+			node.offloaders[app.Name] = offloader
+			node.pools[app.Name] = &simPool{free: node.cfg.Replicas}
+		}
+	}
+	return s, nil
+}
+
+func (d SimDist) Validate() error {
+	switch d.Dist {
+	case "const", "exp", "lognormal":
+	default:
+		return fmt.Errorf("dist must be const, exp or lognormal, got %q", d.Dist)
+	}
+	if d.MeanMs <= 0 {
+		return fmt.Errorf("mean_ms must be positive, got %v", d.MeanMs)
+	}
+	if d.StddevMs < 0 {
+		return fmt.Errorf("stddev_ms must not be negative, got %v", d.StddevMs)
+	}
+	return nil
+}
+
+// Sample draws a duration from d.
+func (d SimDist) Sample(rng *rand.Rand) time.Duration {
+	ms := d.MeanMs
+	switch d.Dist {
+	case "exp":
+		ms = rng.ExpFloat64() * d.MeanMs
+	case "lognormal":
+		sigma2 := math.Log(1 + d.StddevMs*d.StddevMs/(d.MeanMs*d.MeanMs))
+		ms = math.Exp(math.Log(d.MeanMs) - sigma2/2 + math.Sqrt(sigma2)*rng.NormFloat64())
+	}
+	return time.Duration(ms * float64(time.Millisecond))
+}
+
+// link returns the RTT and bandwidth between two nodes.
+func (s *Simulation) link(a, b string) (float64, float64) {
+	for _, l := range s.cfg.Links {
+		if (l.A == a && l.B == b) || (l.A == b && l.B == a) {
+			mbps := l.BandwidthMbps
+			if mbps == 0 {
+				mbps = s.cfg.BandwidthMbps
+			}
+			return l.RttMs, mbps
+		}
+	}
+	return s.cfg.RttMs, s.cfg.BandwidthMbps
+}
+
+// oneWay is the time bytes take from a to b.
+func (s *Simulation) oneWay(a, b string, bytes int64) time.Duration {
+	rtt, mbps := s.link(a, b)
+	ms := rtt / 2
+	if mbps > 0 && bytes > 0 {
+		ms += float64(8*bytes) / (mbps * 1000)
+	}
+	return time.Duration(ms * float64(time.Millisecond))
+}
+
+func (s *Simulation) schedule(at time.Duration, kind simEventKind, job *simJob) {
+	s.seq++
+	heap.Push(&s.events, &simEvent{at: at, seq: s.seq, kind: kind, job: job})
+}
+
+// simClock is the virtual clock of a Simulation. Its tickers never fire, the
+// simulation runs the periodic work of the offloaders itself.
+type simClock struct {
+	s *Simulation
+}
+
+func (c simClock) Now() time.Time                   { return simEpoch.Add(c.s.now) }
+func (c simClock) Since(t time.Time) time.Duration  { return c.Now().Sub(t) }
+func (c simClock) NewTicker(d time.Duration) Ticker { return simTicker{} }
+
+type simTicker struct{}
+
+func (simTicker) C() <-chan time.Time { return nil }
+func (simTicker) Stop()               {}
+
+func (s *Simulation) advance(o OffloaderIntf, ctx *list.Element, state MetricSMState, candidate ...string) {
+	o.MetricSMAdvance(ctx, state, candidate...)
+}
+
+func (s *Simulation) initMetric(o OffloaderIntf, req *http.Request) *list.Element {
+	ctx := o.MetricSMInit()
+	ctx.Value.(*MetricSM).forwarded = o.IsOffloaded(req)
+	return ctx
+}
+
+func (s *Simulation) httpRequest(job *simJob, node string, offloadedFor string) *http.Request {
+	req, _ := http.NewRequest(http.MethodPost, "http://"+node+"/api/v1/namespaces/guest/actions/"+job.req.App, nil)
+	req.ContentLength = job.req.Bytes
+	if offloadedFor != "" {
+		req.Header.Set("X-Offloaded-For", offloadedFor)
+	}
+	return req
+}
+
+// refreshGossip gives every node the current load of all the others.
+func (s *Simulation) refreshGossip() {
+	if !s.cfg.Gossip {
+		return
+	}
+	view := map[string]NodeDigest{}
+	for _, host := range s.order {
+		node := s.nodes[host]
+		d := NodeDigest{Host: host, Version: uint64(s.seq), Apps: map[string]Snapshot{}, received: time.Now()}
+		for app, o := range node.offloaders {
+			d.Apps[app] = o.Base().Finfo.getSnapshot()
+		}
+		view[host] = d
+	}
+	for _, node := range s.nodes {
+		node.gossip.mu.Lock()
+		node.gossip.view = view
+		node.gossip.mu.Unlock()
+	}
+}
+
+func (s *Simulation) arrive(job *simJob) {
+	if job.synthetic {
+		s.nextArrival(job.origin, job.req.App)
+	}
+	s.refreshGossip()
+	origin := job.origin
+	o := origin.offloaders[job.req.App]
+	job.arrival = s.now
+	job.httpReq = s.httpRequest(job, origin.host, "")
+	job.originCtx = s.initMetric(o, job.httpReq)
+
+	elem, admitted := o.CheckAndEnq(job.httpReq)
+	if !admitted {
+		s.advance(o, job.originCtx, PreOffloadSearchState)
+		candidate := o.GetOffloadCandidate(job.httpReq)
+		s.advance(o, job.originCtx, OffloadSearchState)
+		if peer, ok := s.nodes[candidate]; ok && candidate != origin.host {
+			if s.offload(job, peer) {
+				return
+			}
+			job.fallback = true
+		}
+		elem = o.ForceEnq(job.httpReq)
+	}
+	job.exec, job.execCtx, job.elem = origin, job.originCtx, elem
+	s.advance(o, job.originCtx, PreLocalState, origin.host)
+	s.enter(job)
+}
+
+// offload asks peer to admit job, as the handler does with X-Offloaded-For.
+func (s *Simulation) offload(job *simJob, peer *simNode) bool {
+	o := job.origin.offloaders[job.req.App]
+	job.attempts++
+	s.advance(o, job.originCtx, PreOffloadState, peer.host)
+
+	po := peer.offloaders[job.req.App]
+	req := s.httpRequest(job, peer.host, job.origin.host)
+	ctx := s.initMetric(po, req)
+	elem, admitted := po.CheckAndEnq(req)
+	if !admitted {
+		po.MetricSMDelete(ctx)
+		snap := Snapshot{}
+		json.Unmarshal([]byte(po.GetStatusStr()), &snap)
+		o.PostOffloadUpdate(snap, peer.host)
+		return false
+	}
+	job.exec, job.execCtx, job.elem, job.offloaded = peer, ctx, elem, true
+	s.schedule(s.now+s.oneWay(job.origin.host, peer.host, job.req.Bytes), simEnter, job)
+	return true
+}
+
+// enter queues job for a replica of the node that runs it.
+func (s *Simulation) enter(job *simJob) {
+	if job.offloaded {
+		s.advance(job.exec.offloaders[job.req.App], job.execCtx, PreLocalState, job.exec.host)
+	}
+	job.enter = s.now
+	pool := job.exec.pools[job.req.App]
+	if pool.free > 0 {
+		pool.free--
+		s.run(job)
+		return
+	}
+	pool.waiting = append(pool.waiting, job)
+}
+
+func (s *Simulation) run(job *simJob) {
+	job.start = s.now
+	s.schedule(s.now+job.svc, simComplete, job)
+}
+
+func (s *Simulation) complete(job *simJob) {
+	pool := job.exec.pools[job.req.App]
+	if len(pool.waiting) > 0 {
+		next := pool.waiting[0]
+		pool.waiting = pool.waiting[1:]
+		s.run(next)
+	} else {
+		pool.free++
+	}
+
+	eo := job.exec.offloaders[job.req.App]
+	eo.Deq(job.httpReq, job.elem)
+	eo.Base().Finfo.observeServiceTime(job.svc)
+	s.advance(eo, job.execCtx, PostLocalState)
+	s.advance(eo, job.execCtx, FinalState)
+	eo.MetricSMAnalyze(job.execCtx)
+	eo.MetricSMDelete(job.execCtx)
+
+	if job.offloaded {
+		s.schedule(s.now+s.oneWay(job.exec.host, job.origin.host, 0), simReply, job)
+		return
+	}
+	s.finish(job)
+}
+
+func (s *Simulation) reply(job *simJob) {
+	o := job.origin.offloaders[job.req.App]
+	s.advance(o, job.originCtx, PostOffloadState)
+	s.advance(o, job.originCtx, FinalState)
+	o.MetricSMAnalyze(job.originCtx)
+	o.MetricSMDelete(job.originCtx)
+	s.finish(job)
+}
+
+func (s *Simulation) finish(job *simJob) {
+	placement := "local"
+	if job.offloaded {
+		placement = "offload"
+	} else if job.fallback {
+		placement = "fallback"
+	}
+	ms := func(d time.Duration) float64 { return float64(d.Microseconds()) / 1000 }
+	s.results = append(s.results, SimResult{
+		ID: job.id, App: job.req.App, Origin: job.origin.host, Node: job.exec.host, Placement: placement,
+		ArrivalMs: ms(job.arrival), LatencyMs: ms(s.now - job.arrival), WaitMs: ms(job.start - job.enter),
+		ServiceMs: ms(job.svc), Attempts: job.attempts,
+	})
+}
+
+// submit schedules the arrival of req.
+func (s *Simulation) submit(req SimRequest, synthetic bool) error {
+	origin, ok := s.nodes[req.Node]
+	if !ok {
+		return fmt.Errorf("request %d: unknown node %q", s.nextID, req.Node)
+	}
+	app, ok := s.apps[req.App]
+	if !ok {
+		return fmt.Errorf("request %d: unknown app %q", s.nextID, req.App)
+	}
+	job := &simJob{id: s.nextID, req: req, origin: origin, synthetic: synthetic}
+	s.nextID++
+	if req.Bytes == 0 {
+		job.req.Bytes = app.Bytes
+	}
+	job.svc = time.Duration(req.ServiceMs * float64(time.Millisecond))
+	if req.ServiceMs <= 0 {
+		job.svc = app.Service.Sample(s.rng)
+	}
+	s.schedule(time.Duration(req.TsMs*float64(time.Millisecond)), simArrival, job)
+	return nil
+}
+
+// nextArrival schedules the next Poisson arrival of app at node, if any before the end.
+func (s *Simulation) nextArrival(node *simNode, app string) {
+	if node.cfg.Rate <= 0 {
+		return
+	}
+	at := s.now + time.Duration(s.rng.ExpFloat64()/node.cfg.Rate*float64(time.Second))
+	if at >= s.end {
+		return
+	}
+	s.submit(SimRequest{TsMs: float64(at.Microseconds()) / 1000, Node: node.host, App: app}, true)
+}
+
+func (s *Simulation) loadTrace(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	reqs := []SimRequest{}
+	scanner := bufio.NewScanner(f)
+	for line := 1; scanner.Scan(); line++ {
+		if strings.TrimSpace(scanner.Text()) == "" {
+			continue
+		}
+		var req SimRequest
+		if err := json.Unmarshal(scanner.Bytes(), &req); err != nil {
+			return fmt.Errorf("%s:%d: %w", path, line, err)
+		}
+		reqs = append(reqs, req)
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+	sort.SliceStable(reqs, func(i, j int) bool { return reqs[i].TsMs < reqs[j].TsMs })
+	for _, req := range reqs {
+		if err := s.submit(req, false); err != nil {
+			return err
+		}
+		if end := time.Duration(req.TsMs * float64(time.Millisecond)); end > s.end {
+			s.end = end
+		}
+	}
+	return nil
+}
+
+// Run simulates the workload until every invocation completed.
+func (s *Simulation) Run() ([]SimResult, error) {
+	if s.cfg.Trace != "" {
+		s.end = 0
+		if err := s.loadTrace(s.cfg.Trace); err != nil {
+			return nil, err
+		}
+	} else {
+		for _, host := range s.order {
+			for _, app := range s.cfg.Apps {
+				s.nextArrival(s.nodes[host], app.Name)
+			}
+		}
+	}
+	s.schedule(SIM_TICK, simTick, nil)
+
+	for s.events.Len() > 0 {
+		e := heap.Pop(&s.events).(*simEvent)
+		s.now = e.at
+		switch e.kind {
+		case simArrival:
+			s.arrive(e.job)
+		case simEnter:
+			s.enter(e.job)
+		case simComplete:
+			s.complete(e.job)
+		case simReply:
+			s.reply(e.job)
+		case simTick:
+			for _, node := range s.nodes {
+				for _, o := range node.offloaders {
+					o.Base().Finfo.update_historic_qlen(simEpoch.Add(s.now))
+				}
+			}
+			// keep ticking while invocations are in flight
+			if s.now < s.end || len(s.results) < s.nextID {
+				s.schedule(s.now+SIM_TICK, simTick, nil)
+			}
+		}
+	}
+	sort.Slice(s.results, func(i, j int) bool { return s.results[i].ID < s.results[j].ID })
+	return s.results, nil
+}
+
+// Close stops the offloaders of every node.
+func (s *Simulation) Close() {
+	for _, node := range s.nodes {
+		for _, o := range node.offloaders {
+			o.Close()
+		}
+	}
+}
+
+// simTransport answers the snapshot queries of the offloaders from the
+// simulated nodes, so that policies that query their peers run unchanged.
+type simTransport struct {
+	s *Simulation
+}
+
+func (t simTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	node, ok := t.s.nodes[req.URL.Host]
+	if !ok || !strings.Contains(req.URL.Path, "/snapshot/") {
+		return nil, fmt.Errorf("feo-sim: %s %s is not simulated", req.Method, req.URL)
+	}
+	resp := &http.Response{Header: http.Header{}, Request: req, StatusCode: http.StatusOK, Status: "200 OK"}
+	o, ok := node.offloaders[extractEntityName(req)]
+	if !ok {
+		resp.StatusCode, resp.Status = http.StatusNotFound, "404 Not Found"
+		resp.Body = io.NopCloser(strings.NewReader(""))
+		return resp, nil
+	}
+	resp.Body = io.NopCloser(strings.NewReader(o.GetStatusStr()))
+	return resp, nil
+}
+
+func writeSimResults(path string, results []SimResult) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	w := csv.NewWriter(f)
+	w.Write([]string{"id", "app", "origin", "node", "placement", "arrival_ms", "latency_ms", "wait_ms", "service_ms", "attempts"})
+	ftoa := func(v float64) string { return strconv.FormatFloat(v, 'f', 3, 64) }
+	for _, r := range results {
+		w.Write([]string{strconv.Itoa(r.ID), r.App, r.Origin, r.Node, r.Placement, ftoa(r.ArrivalMs), ftoa(r.LatencyMs), ftoa(r.WaitMs), ftoa(r.ServiceMs), strconv.Itoa(r.Attempts)})
+	}
+	w.Flush()
+	return w.Error()
+}
+
+// simSummary aggregates the invocations that arrived at a node, or at any node if the key is "all".
+type simSummary struct {
+	invocations, local, offload, fallback, served int
+	latencies                                     []float64
+}
+
+func summarizeSim(order []string, results []SimResult) map[string]*simSummary {
+	summaries := map[string]*simSummary{"all": {}}
+	for _, host := range order {
+		summaries[host] = &simSummary{}
+	}
+	for _, r := range results {
+		for _, sum := range []*simSummary{summaries[r.Origin], summaries["all"]} {
+			sum.invocations++
+			sum.latencies = append(sum.latencies, r.LatencyMs)
+			switch r.Placement {
+			case "local":
+				sum.local++
+			case "offload":
+				sum.offload++
+			case "fallback":
+				sum.fallback++
+			}
+		}
+		if r.Placement == "offload" {
+			summaries[r.Node].served++
+			summaries["all"].served++
+		}
+	}
+	for _, sum := range summaries {
+		sort.Float64s(sum.latencies)
+	}
+	return summaries
+}
+
+func (sum *simSummary) row(name string) []string {
+	mean, p50, p95, p99 := 0.0, 0.0, 0.0, 0.0
+	if len(sum.latencies) > 0 {
+		for _, l := range sum.latencies {
+			mean += l
+		}
+		mean /= float64(len(sum.latencies))
+		p50, p95, p99 = percentile(sum.latencies, 50), percentile(sum.latencies, 95), percentile(sum.latencies, 99)
+	}
+	ftoa := func(v float64) string { return strconv.FormatFloat(v, 'f', 3, 64) }
+	return []string{name, strconv.Itoa(sum.invocations), strconv.Itoa(sum.local), strconv.Itoa(sum.offload), strconv.Itoa(sum.fallback), strconv.Itoa(sum.served), ftoa(mean), ftoa(p50), ftoa(p95), ftoa(p99)}
+}
+
+var simSummaryHeader = []string{"node", "invocations", "local", "offload", "fallback", "served_for_peers", "mean_ms", "p50_ms", "p95_ms", "p99_ms"}
+
+func writeSimSummary(path string, order []string, results []SimResult) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	w := csv.NewWriter(f)
+	w.Write(simSummaryHeader)
+	summaries := summarizeSim(order, results)
+	for _, host := range order {
+		w.Write(summaries[host].row(host))
+	}
+	w.Write(summaries["all"].row("all"))
+	w.Flush()
+	return w.Error()
+}
+
+// SimMain is the entry point of feo-sim. It simulates the cluster described
+// by -config and writes requests.csv, one line per invocation, and nodes.csv,
+// the placement and latency per node, to -out.
+func SimMain() {
+	log.SetFlags(log.LstdFlags | log.Lshortfile)
+	var configPath = flag.String("config", "sim.yml", "YML description of the simulated cluster and workload")
+	var outDir = flag.String("out", ".", "directory the CSVs are written to")
+	var policyName = flag.String("policy", "", "run every node with this policy and its default parameters")
+	var trace = flag.String("trace", "", "JSONL trace that replaces the synthetic arrivals")
+	var verbose = flag.Bool("v", false, "keep the logs of the offloaders")
+	flag.Parse()
+
+	cfg, err := loadSimConfig(*configPath)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if *policyName != "" {
+		cfg.Policy = PolicyConfig{Name: *policyName}
+		for i := range cfg.Nodes {
+			cfg.Nodes[i].Policy = nil
+		}
+	}
+	if *trace != "" {
+		cfg.Trace = *trace
+	}
+
+	if !*verbose {
+		log.SetOutput(io.Discard)
+	}
+	sim, err := newSimulation(cfg)
+	start := time.Now()
+	var results []SimResult
+	if err == nil {
+		results, err = sim.Run()
+		sim.Close()
+	}
+	log.SetOutput(os.Stderr)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	if err := writeSimResults(filepath.Join(*outDir, "requests.csv"), results); err != nil {
+		log.Fatal(err)
+	}
+	if err := writeSimSummary(filepath.Join(*outDir, "nodes.csv"), sim.order, results); err != nil {
+		log.Fatal(err)
+	}
+	all := summarizeSim(sim.order, results)["all"].row("all")
+	fmt.Printf("policy=%s invocations=%s local=%s offload=%s fallback=%s mean=%sms p95=%sms p99=%sms (simulated %s in %s)\n",
+		cfg.Policy.Name, all[1], all[2], all[3], all[4], all[6], all[8], all[9], sim.now.Round(time.Millisecond), time.Since(start).Round(time.Millisecond))
+}
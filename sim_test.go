@@ -0,0 +1,70 @@
+package feo
+
+import (
+	"io"
+	"log"
+	"os"
+	"reflect"
+	"testing"
+)
+
+func TestMain(m *testing.M) {
+	log.SetOutput(io.Discard)
+	os.Exit(m.Run())
+}
+
+// symmetricSim overloads node a while its peers are idle and alike, so that
+// policies have to break ties between them.
+func symmetricSim(policy OffloadPolicy) SimConfig {
+	return SimConfig{
+		Seed:          3,
+		DurationS:     10,
+		Policy:        PolicyConfig{Name: string(policy)},
+		RttMs:         2,
+		BandwidthMbps: 1000,
+		Gossip:        true,
+		Probe:         true,
+		Apps:          []SimApp{{Name: "copy", Service: SimDist{Dist: "const", MeanMs: 100}, Limits: ApplicationLimits{SloMs: 150}}},
+		Nodes: []SimNode{
+			{Host: "a", Replicas: 2, Rate: 30},
+			{Host: "b", Replicas: 2, Rate: 1},
+			{Host: "c", Replicas: 2, Rate: 1},
+			{Host: "d", Replicas: 2, Rate: 1},
+		},
+	}
+}
+
+func runSim(t *testing.T, cfg SimConfig) []SimResult {
+	t.Helper()
+	sim, err := newSimulation(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sim.Close()
+	results, err := sim.Run()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return results
+}
+
+// Seeded simulations must be reproducible for every policy that can be simulated.
+func TestSimDeterministic(t *testing.T) {
+	for _, policy := range RegisteredPolicies() {
+		if simUnsupported[policy] {
+			continue
+		}
+		policy := policy
+		t.Run(string(policy), func(t *testing.T) {
+			first := runSim(t, symmetricSim(policy))
+			if len(first) == 0 {
+				t.Fatal("no invocation was simulated")
+			}
+			for run := 2; run <= 3; run++ {
+				if again := runSim(t, symmetricSim(policy)); !reflect.DeepEqual(first, again) {
+					t.Fatalf("run %d differs from the first one with the same seed", run)
+				}
+			}
+		})
+	}
+}
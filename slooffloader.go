@@ -0,0 +1,157 @@
+package feo
+
+import (
+	"container/list"
+	"fmt"
+	"log"
+	"net/http"
+	"sync"
+)
+
+const OffloadSLO = "slo"
+
+func init() {
+	RegisterPolicy(PolicyRegistration{
+		Name:      OffloadSLO,
+		NewParams: func() PolicyParams { return DefaultSLOParams() },
+		New: func(base *BaseOffloader, params PolicyParams) OffloaderIntf {
+			return NewSLOOffloader(base, params.(*SLOParams))
+		},
+	})
+}
+
+type SLOParams struct {
+	PredictorParams `yaml:",inline"`
+	// latency target of applications that do not set limits.slo_ms, 0 for none
+	SloMs int `yaml:"slo_ms" json:"slo_ms"`
+}
+
+func DefaultSLOParams() *SLOParams {
+	return &SLOParams{PredictorParams: DefaultPredictorParams()}
+}
+
+func (p *SLOParams) Validate() error {
+	if p.SloMs < 0 {
+		return fmt.Errorf("slo_ms must not be negative, got %d", p.SloMs)
+	}
+	return p.PredictorParams.Validate()
+}
+
+// SLOStats counts the invocations that arrived at this node and finished, and
+// how many of them met the SLO end to end.
+type SLOStats struct {
+	SloMs       int     `json:"slo_ms"`
+	Invocations int64   `json:"invocations"`
+	Met         int64   `json:"met"`
+	HitRate     float64 `json:"hit_rate"`
+	Local       int64   `json:"local"`
+	Offloaded   int64   `json:"offloaded"`
+}
+
+// SLOOffloader predicts when an invocation would complete locally and on every
+// peer, and offloads it only if it would miss the SLO locally and a peer is
+// predicted to complete it sooner. Without an SLO, it offloads whenever a
+// peer is predicted to be faster. See predictor for how completion is predicted.
+type SLOOffloader struct {
+	*BaseOffloader
+	params *SLOParams
+	pred   *predictor
+
+	mu    sync.Mutex
+	stats SLOStats
+}
+
+func NewSLOOffloader(base *BaseOffloader, params *SLOParams) *SLOOffloader {
+	o := &SLOOffloader{BaseOffloader: base, params: params}
+	o.Qlen_max = params.QlenMax
+	o.pred = newPredictor(base, params.PredictorParams)
+	o.stats.SloMs = o.slo()
+	return o
+}
+
+// slo is the SLO of the application, or the one of the policy if it has none.
+func (o *SLOOffloader) slo() int {
+	if o.SloMs > 0 {
+		return o.SloMs
+	}
+	return o.params.SloMs
+}
+
+// bestPeer returns the peer predicted to complete req first, or "" if no peer's load is known.
+func (o *SLOOffloader) bestPeer(req *http.Request) (string, float64) {
+	best, bestMs := "", 0.0
+	snaps := o.pred.peerSnapshots(req)
+	// ties go to the first peer by name
+	for _, peer := range sortedNodes(snaps) {
+		ms := o.pred.completionMs(peer, snaps[peer]) + o.pred.networkMs(peer, req)
+		if best == "" || ms < bestMs {
+			best, bestMs = peer, ms
+		}
+	}
+	return best, bestMs
+}
+
+func (o *SLOOffloader) CheckAndEnq(req *http.Request) (*list.Element, bool) {
+	if o.IsOffloaded(req) {
+		return o.enqIf(func(qlen int) bool { return qlen < int(o.Qlen_max) })
+	}
+	always := func(qlen int) bool { return true }
+
+	snap := o.Finfo.getSnapshot()
+	localMs := o.pred.completionMs(o.Host, snap)
+	slo := o.slo()
+	if slo > 0 && localMs <= float64(slo) {
+		return o.enqIf(always)
+	}
+	peer, peerMs := o.bestPeer(req)
+	log.Printf("[DEBUG] predicted %.1fms locally, %.1fms on %q, slo %dms\n", localMs, peerMs, peer, slo)
+	if peer != "" && peerMs < localMs {
+		return nil, false
+	}
+	return o.enqIf(always)
+}
+
+func (o *SLOOffloader) GetOffloadCandidate(req *http.Request) string {
+	peer, _ := o.bestPeer(req)
+	if peer == "" {
+		return o.Host
+	}
+	return peer
+}
+
+// PostOffloadUpdate caches the snapshot piggybacked on an offload reply.
+func (o *SLOOffloader) PostOffloadUpdate(snap Snapshot, target string) {
+	o.pred.snapshots.put(target, snap)
+}
+
+func (o *SLOOffloader) MetricSMAnalyze(ctx *list.Element) {
+	o.BaseOffloader.MetricSMAnalyze(ctx)
+
+	sm := ctx.Value.(*MetricSM)
+	// invocations offloaded here count at the node they arrived at
+	if !sm.finished() || sm.forwarded {
+		return
+	}
+	slo := o.slo()
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.stats.Invocations++
+	if sm.local {
+		o.stats.Local++
+	} else {
+		o.stats.Offloaded++
+	}
+	if slo > 0 && sm.totalMs() <= float64(slo) {
+		o.stats.Met++
+	}
+	if slo > 0 {
+		o.stats.HitRate = float64(o.stats.Met) / float64(o.stats.Invocations)
+	}
+}
+
+// PolicyState reports how often the SLO was met.
+func (o *SLOOffloader) PolicyState() any {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	return o.stats
+}
@@ -0,0 +1,438 @@
+package feo
+
+import (
+	"container/list"
+	"fmt"
+	"log"
+	"math/rand"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/mroth/weightedrand"
+)
+
+// The composed policy is assembled from three kinds of stages, picked by name
+// in its config block:
+//
+//   - an AdmissionStage decides whether an invocation received by this node
+//     is queued locally or offloaded,
+//   - a CandidateSelector picks the peer to offload to,
+//   - FeedbackUpdaters learn from the outcome of every invocation and keep
+//     the PeerStats the other stages read.
+//
+// Stages with the same name as a kind of data, like the "latency" selector and
+// the "latency" feedback, are meant to be used together; Validate rejects
+// combinations where a stage reads data no configured feedback produces.
+
+type AdmissionStage interface {
+	// Admit queues req locally and returns its queue entry, or returns false if
+	// req should be offloaded.
+	Admit(o *BaseOffloader, req *http.Request) (*list.Element, bool)
+}
+
+type CandidateSelector interface {
+	// Select returns the peer to offload req to, or o.Host to run it locally.
+	Select(o *BaseOffloader, req *http.Request) string
+}
+
+type FeedbackUpdater interface {
+	// Observe is called with every invocation that finished.
+	Observe(o *BaseOffloader, s Sample)
+	// PostOffloadUpdate is called with the status a peer sent when it rejected an offload.
+	PostOffloadUpdate(snap Snapshot, target string)
+}
+
+// Sample is the outcome of a finished invocation.
+type Sample struct {
+	// Candidate is the peer the invocation was offloaded to, or the host if it ran locally.
+	Candidate string
+	Elapsed   time.Duration
+	Local     bool
+	// Chosen is false if the invocation ran locally without the selector picking this node,
+	// i.e. it was admitted or every offload attempt failed.
+	Chosen bool
+}
+
+// PeerStats is what the feedback of a composed policy learned about the peers
+// and this node.
+type PeerStats struct {
+	mu        sync.Mutex
+	alpha     float64
+	latencyMs map[string]float64
+	qlen      map[string]float32
+	localMs   float64
+}
+
+func newPeerStats(alpha float64) *PeerStats {
+	return &PeerStats{alpha: alpha, latencyMs: map[string]float64{}, qlen: map[string]float32{}}
+}
+
+// Latency returns the latency EWMA of host in milliseconds.
+func (s *PeerStats) Latency(host string) (float64, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	ms, ok := s.latencyMs[host]
+	return ms, ok
+}
+
+// ObserveLatency folds a latency sample of host into its EWMA.
+func (s *PeerStats) ObserveLatency(host string, ms float64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	prev, ok := s.latencyMs[host]
+	if !ok {
+		s.latencyMs[host] = ms
+		return
+	}
+	s.latencyMs[host] = prev*(1-s.alpha) + ms*s.alpha
+}
+
+// LocalLatency returns the EWMA of local executions in milliseconds, 0 before the first one.
+func (s *PeerStats) LocalLatency() float64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.localMs
+}
+
+func (s *PeerStats) ObserveLocal(ms float64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.localMs == 0 {
+		s.localMs = ms
+		return
+	}
+	s.localMs = s.localMs*(1-s.alpha) + ms*s.alpha
+}
+
+// Qlens returns a copy of the last queue length reported by every peer.
+func (s *PeerStats) Qlens() map[string]float32 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	qlens := make(map[string]float32, len(s.qlen))
+	for host, qlen := range s.qlen {
+		qlens[host] = qlen
+	}
+	return qlens
+}
+
+func (s *PeerStats) SetQlen(host string, qlen float32) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.qlen[host] = qlen
+}
+
+// StageRegistration describes a stage of the composed policy. Requires names
+// the feedback updater whose data the stage reads, if any.
+type StageRegistration[T any] struct {
+	Name     string
+	Requires string
+	New      func(base *BaseOffloader, params *ComposedParams, stats *PeerStats) T
+}
+
+type stageRegistry[T any] struct {
+	kind   string
+	mu     sync.RWMutex
+	stages map[string]StageRegistration[T]
+}
+
+func newStageRegistry[T any](kind string) *stageRegistry[T] {
+	return &stageRegistry[T]{kind: kind, stages: map[string]StageRegistration[T]{}}
+}
+
+func (r *stageRegistry[T]) register(reg StageRegistration[T]) {
+	if reg.Name == "" || reg.New == nil {
+		panic(fmt.Sprintf("feo: %s stage registration needs a name and a constructor", r.kind))
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if _, dup := r.stages[reg.Name]; dup {
+		panic(fmt.Sprintf("feo: %s stage %s registered twice", r.kind, reg.Name))
+	}
+	r.stages[reg.Name] = reg
+}
+
+func (r *stageRegistry[T]) lookup(name string) (StageRegistration[T], error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	reg, ok := r.stages[name]
+	if !ok {
+		names := make([]string, 0, len(r.stages))
+		for n := range r.stages {
+			names = append(names, n)
+		}
+		sort.Strings(names)
+		return reg, fmt.Errorf("unknown %s stage %q, registered stages are %v", r.kind, name, names)
+	}
+	return reg, nil
+}
+
+var (
+	admissionStages = newStageRegistry[AdmissionStage]("admission")
+	selectorStages  = newStageRegistry[CandidateSelector]("selector")
+	feedbackStages  = newStageRegistry[FeedbackUpdater]("feedback")
+)
+
+// RegisterAdmission, RegisterSelector and RegisterFeedback make a stage
+// available to the composed policy. They panic if the name is empty or
+// already registered.
+func RegisterAdmission(reg StageRegistration[AdmissionStage]) { admissionStages.register(reg) }
+
+func RegisterSelector(reg StageRegistration[CandidateSelector]) { selectorStages.register(reg) }
+
+func RegisterFeedback(reg StageRegistration[FeedbackUpdater]) { feedbackStages.register(reg) }
+
+const (
+	AdmitAlwaysOffload = "always_offload"
+	AdmitQlen          = "qlen"
+	AdmitHistoricQlen  = "historic_qlen"
+	AdmitPredictedWait = "predicted_wait"
+
+	SelectRoundRobin = "roundrobin"
+	SelectRandom     = "random"
+	SelectWeighted   = "weighted"
+	SelectLatency    = "latency"
+	SelectController = "controller"
+	SelectRTT        = "rtt"
+
+	FeedbackLatency = "latency"
+	FeedbackQlen    = "qlen"
+)
+
+func init() {
+	RegisterAdmission(StageRegistration[AdmissionStage]{
+		Name: AdmitAlwaysOffload,
+		New: func(base *BaseOffloader, params *ComposedParams, stats *PeerStats) AdmissionStage {
+			return admitFunc(func(o *BaseOffloader, req *http.Request) (*list.Element, bool) {
+				return o.enqIfOffloaded(req)
+			})
+		},
+	})
+	RegisterAdmission(StageRegistration[AdmissionStage]{
+		Name: AdmitQlen,
+		New: func(base *BaseOffloader, params *ComposedParams, stats *PeerStats) AdmissionStage {
+			return admitFunc(func(o *BaseOffloader, req *http.Request) (*list.Element, bool) {
+				return o.enqIf(func(qlen int) bool { return qlen < int(o.Qlen_max) })
+			})
+		},
+	})
+	RegisterAdmission(StageRegistration[AdmissionStage]{
+		Name: AdmitHistoricQlen,
+		New: func(base *BaseOffloader, params *ComposedParams, stats *PeerStats) AdmissionStage {
+			return admitFunc(func(o *BaseOffloader, req *http.Request) (*list.Element, bool) {
+				return o.CheckAndEnq(req)
+			})
+		},
+	})
+	RegisterAdmission(StageRegistration[AdmissionStage]{
+		Name:     AdmitPredictedWait,
+		Requires: FeedbackLatency,
+		New: func(base *BaseOffloader, params *ComposedParams, stats *PeerStats) AdmissionStage {
+			return admitFunc(func(o *BaseOffloader, req *http.Request) (*list.Element, bool) {
+				// Qlen_max replicas drain the queue in parallel, which is the
+				// number of replicas unless qlen_max is configured. The local
+				// latency stands in for the service time until it was measured.
+				svcMs := stats.LocalLatency()
+				if svc := o.ServiceTime(); svc.Known() {
+					svcMs = svc.EwmaMs
+				}
+				return o.enqIf(func(qlen int) bool {
+					waitMs := float64(qlen) / float64(o.Qlen_max) * svcMs
+					return waitMs < params.MaxWaitMs
+				})
+			})
+		},
+	})
+
+	RegisterSelector(StageRegistration[CandidateSelector]{
+		Name: SelectRoundRobin,
+		New: func(base *BaseOffloader, params *ComposedParams, stats *PeerStats) CandidateSelector {
+			return &roundRobinSelector{}
+		},
+	})
+	RegisterSelector(StageRegistration[CandidateSelector]{
+		Name: SelectRandom,
+		New: func(base *BaseOffloader, params *ComposedParams, stats *PeerStats) CandidateSelector {
+			return selectFunc(func(o *BaseOffloader, req *http.Request) string {
+				routers := o.Candidates()
+				if len(routers) == 0 {
+					return o.Host
+				}
+				return routers[o.Rand.Intn(len(routers))].host
+			})
+		},
+	})
+	RegisterSelector(StageRegistration[CandidateSelector]{
+		Name:     SelectWeighted,
+		Requires: FeedbackQlen,
+		New: func(base *BaseOffloader, params *ComposedParams, stats *PeerStats) CandidateSelector {
+			return selectFunc(func(o *BaseOffloader, req *http.Request) string {
+				// peers without a known qlen count as empty
+				known := stats.Qlens()
+				qlens := map[string]float32{}
+				for _, r := range o.Candidates() {
+					qlens[r.host] = known[r.host]
+				}
+				return pickByQlen(o.Rand, o.Host, qlens, params.PeerQlenMax)
+			})
+		},
+	})
+	RegisterSelector(StageRegistration[CandidateSelector]{
+		Name:     SelectLatency,
+		Requires: FeedbackLatency,
+		New: func(base *BaseOffloader, params *ComposedParams, stats *PeerStats) CandidateSelector {
+			return selectFunc(func(o *BaseOffloader, req *http.Request) string {
+				// peers without a sample yet count as 0ms so every peer is tried once
+				candidate := o.Host
+				minMs := -1.0
+				for _, r := range o.Candidates() {
+					ms, _ := stats.Latency(r.host)
+					if minMs < 0 || ms < minMs {
+						candidate, minMs = r.host, ms
+					}
+				}
+				return candidate
+			})
+		},
+	})
+	RegisterSelector(StageRegistration[CandidateSelector]{
+		Name: SelectRTT,
+		New: func(base *BaseOffloader, params *ComposedParams, stats *PeerStats) CandidateSelector {
+			return selectFunc(func(o *BaseOffloader, req *http.Request) string {
+				// only peers that answered their last probe are candidates
+				candidate := o.Host
+				minMs := -1.0
+				for _, r := range o.Candidates() {
+					ms, ok := o.Prober.RTT(r.host)
+					if ok && (minMs < 0 || ms < minMs) {
+						candidate, minMs = r.host, ms
+					}
+				}
+				return candidate
+			})
+		},
+	})
+	RegisterSelector(StageRegistration[CandidateSelector]{
+		Name: SelectController,
+		New: func(base *BaseOffloader, params *ComposedParams, stats *PeerStats) CandidateSelector {
+			return &controllerSelector{ctrl: newControllerLink(base, params.GapMs)}
+		},
+	})
+
+	RegisterFeedback(StageRegistration[FeedbackUpdater]{
+		Name: FeedbackLatency,
+		New: func(base *BaseOffloader, params *ComposedParams, stats *PeerStats) FeedbackUpdater {
+			return &latencyFeedback{stats: stats}
+		},
+	})
+	RegisterFeedback(StageRegistration[FeedbackUpdater]{
+		Name: FeedbackQlen,
+		New: func(base *BaseOffloader, params *ComposedParams, stats *PeerStats) FeedbackUpdater {
+			return &qlenFeedback{stats: stats}
+		},
+	})
+}
+
+type admitFunc func(o *BaseOffloader, req *http.Request) (*list.Element, bool)
+
+func (f admitFunc) Admit(o *BaseOffloader, req *http.Request) (*list.Element, bool) {
+	return f(o, req)
+}
+
+type selectFunc func(o *BaseOffloader, req *http.Request) string
+
+func (f selectFunc) Select(o *BaseOffloader, req *http.Request) string {
+	return f(o, req)
+}
+
+type roundRobinSelector struct {
+	mu      sync.Mutex
+	cur_idx int
+}
+
+func (s *roundRobinSelector) Select(o *BaseOffloader, req *http.Request) string {
+	routers := o.Candidates()
+	if len(routers) == 0 {
+		return o.Host
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.cur_idx = s.cur_idx % len(routers)
+	candidate := routers[s.cur_idx].host
+	s.cur_idx++
+	return candidate
+}
+
+type controllerSelector struct {
+	ctrl *controllerLink
+}
+
+func (s *controllerSelector) Select(o *BaseOffloader, req *http.Request) string {
+	return s.ctrl.getCandidate()
+}
+
+// recordInvocation reports every invocation received by this node to the controller.
+func (s *controllerSelector) recordInvocation() {
+	s.ctrl.recordInvocation()
+}
+
+func (s *controllerSelector) Close() {
+	s.ctrl.close()
+}
+
+type latencyFeedback struct {
+	stats *PeerStats
+}
+
+func (f *latencyFeedback) Observe(o *BaseOffloader, s Sample) {
+	ms := float64(s.Elapsed.Microseconds() / 1000)
+	if s.Local {
+		f.stats.ObserveLocal(ms)
+		return
+	}
+	f.stats.ObserveLatency(s.Candidate, ms)
+}
+
+func (f *latencyFeedback) PostOffloadUpdate(snap Snapshot, target string) {}
+
+type qlenFeedback struct {
+	stats *PeerStats
+}
+
+func (f *qlenFeedback) Observe(o *BaseOffloader, s Sample) {}
+
+func (f *qlenFeedback) PostOffloadUpdate(snap Snapshot, target string) {
+	f.stats.SetQlen(target, float32(snap.Qlen))
+}
+
+// pickByQlen picks a peer at random, weighting each by how far its queue
+// length is below peerQlenMax. Peers at or above the limit are skipped; if
+// none is left, host is returned. Peers are weighed in the order of their
+// names, so the pick only depends on rng.
+func pickByQlen(rng *rand.Rand, host string, qlens map[string]float32, peerQlenMax float32) string {
+	nodes := make([]string, 0, len(qlens))
+	for node := range qlens {
+		nodes = append(nodes, node)
+	}
+	sort.Strings(nodes)
+	wts := []weightedrand.Choice{}
+	for _, node := range nodes {
+		node_qlen := qlens[node]
+		if node == host {
+			continue
+		}
+		if node_qlen > peerQlenMax {
+			continue
+		}
+		// the randomized pickers expects nonnegative ints. So bound it to [0,1000]
+		wt := uint(1000 * (1 - node_qlen/peerQlenMax))
+		wts = append(wts, weightedrand.NewChoice(node, wt))
+	}
+	chooser, err := weightedrand.NewChooser(wts...)
+	if err != nil {
+		log.Println("Unable to select chooser: ", err)
+		return host
+	}
+	return chooser.PickSource(rng).(string)
+}
@@ -0,0 +1,178 @@
+package feo
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+)
+
+type PolicyStatus struct {
+	Name   OffloadPolicy `json:"name"`
+	Params PolicyParams  `json:"params"`
+	// QlenMax is the admission limit in effect, which the number of replicas or
+	// limits.max_qlen override unless params set qlen_max
+	QlenMax int32 `json:"qlen_max_effective"`
+}
+
+type ApplicationStatus struct {
+	Policy   PolicyStatus `json:"policy"`
+	Snapshot Snapshot     `json:"snapshot"`
+	// what the policy learned, if it reports it
+	State any `json:"state,omitempty"`
+	// what the invocations cost, if costs are configured
+	Cost *CostStats `json:"cost,omitempty"`
+}
+
+// PolicyStateReporter is implemented by offloaders that expose what they
+// learned in the status API.
+type PolicyStateReporter interface {
+	PolicyState() any
+}
+
+type NodeStatusReport struct {
+	Host         string                       `json:"host"`
+	Applications map[string]ApplicationStatus `json:"applications"`
+	Probes       map[string]PeerLatency       `json:"probes,omitempty"`
+	Gossip       map[string]NodeDigest        `json:"gossip,omitempty"`
+	Members      []Member                     `json:"members,omitempty"`
+	Circuits     map[string]Circuit           `json:"circuits,omitempty"`
+}
+
+// handlePoliciesRequest lists the registered policies along with their default parameters.
+func (r *requestHandler) handlePoliciesRequest(w http.ResponseWriter, req *http.Request) {
+	// curl http://localhost:9696/api/v1/namespaces/guest/policies
+	policies := map[OffloadPolicy]PolicyParams{}
+	for _, name := range RegisteredPolicies() {
+		reg, _ := lookupPolicy(name)
+		policies[name] = reg.NewParams()
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	enc.Encode(policies)
+}
+
+// handleStatusRequest reports the policy and parameters in effect for every application.
+func (r *requestHandler) handleStatusRequest(w http.ResponseWriter, req *http.Request) {
+	// curl http://localhost:9696/api/v1/namespaces/guest/status
+	report := NodeStatusReport{Host: r.host, Applications: map[string]ApplicationStatus{}, Probes: r.prober.Table(), Gossip: r.gossip.View(), Members: r.membership.Members(), Circuits: r.breakers.Table()}
+	for appName, app := range r.getApplications() {
+		policy, params := app.getPolicy()
+		offloader := app.getOffloader()
+		status := ApplicationStatus{
+			Policy:   PolicyStatus{Name: policy, Params: params, QlenMax: offloader.Base().Qlen_max},
+			Snapshot: offloader.GetSnapshot(req),
+		}
+		if reporter, ok := offloader.(PolicyStateReporter); ok {
+			status.State = reporter.PolicyState()
+		}
+		if len(r.config.Costs) > 0 {
+			cost := offloader.Base().Finfo.getCost()
+			status.Cost = &cost
+		}
+		report.Applications[appName] = status
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	enc.Encode(report)
+}
+
+// querySnapshot asks peer for the Snapshot of an application without sending an invocation.
+func querySnapshot(client *http.Client, peer string, appName string) (*Snapshot, error) {
+	resp, err := client.Get("http://" + peer + "/api/v1/namespaces/guest/snapshot/" + appName)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("snapshot query returned %s", resp.Status)
+	}
+	snap := &Snapshot{}
+	if err := json.NewDecoder(resp.Body).Decode(snap); err != nil {
+		return nil, err
+	}
+	return snap, nil
+}
+
+type cachedSnapshot struct {
+	snap Snapshot
+	ts   time.Time
+}
+
+// snapshotCache keeps the last known Snapshot of every peer for ttl, and queries
+// peers whose snapshot is missing or too old.
+type snapshotCache struct {
+	client http.Client
+	clock  Clock
+	ttl    time.Duration
+
+	mu    sync.Mutex
+	snaps map[string]cachedSnapshot
+}
+
+func newSnapshotCache(base *BaseOffloader, ttlMs int, queryTimeoutMs int) *snapshotCache {
+	c := &snapshotCache{clock: base.Clock, ttl: time.Duration(ttlMs) * time.Millisecond, snaps: map[string]cachedSnapshot{}}
+	c.client = http.Client{Timeout: time.Duration(queryTimeoutMs) * time.Millisecond, Transport: base.Transport}
+	return c
+}
+
+// put records snap, e.g. as piggybacked on an offload reply.
+func (c *snapshotCache) put(peer string, snap Snapshot) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.snaps[peer] = cachedSnapshot{snap: snap, ts: c.clock.Now()}
+}
+
+// get returns a fresh snapshot of peer, querying it if the cached one is too
+// old. It returns nil if the peer could not be queried.
+func (c *snapshotCache) get(peer string, appName string) *Snapshot {
+	c.mu.Lock()
+	cached, ok := c.snaps[peer]
+	c.mu.Unlock()
+	if ok && c.clock.Since(cached.ts) < c.ttl {
+		return &cached.snap
+	}
+
+	snap, err := querySnapshot(&c.client, peer, appName)
+	if err != nil {
+		log.Printf("[DEBUG] snapshot query to %s failed: %v\n", peer, err)
+		return nil
+	}
+	c.put(peer, *snap)
+	return snap
+}
+
+// getAll queries the peers in parallel. Peers that could not be queried are nil.
+func (c *snapshotCache) getAll(peers []string, appName string) []*Snapshot {
+	snaps := make([]*Snapshot, len(peers))
+	var wg sync.WaitGroup
+	for i, peer := range peers {
+		wg.Add(1)
+		go func(i int, peer string) {
+			defer wg.Done()
+			snaps[i] = c.get(peer, appName)
+		}(i, peer)
+	}
+	wg.Wait()
+	return snaps
+}
+
+// handleSnapshotRequest answers peers asking for the load of an application, as
+// reported in the Node-Status header of offload replies.
+func (r *requestHandler) handleSnapshotRequest(w http.ResponseWriter, req *http.Request) {
+	// curl http://localhost:9696/api/v1/namespaces/guest/snapshot/copy
+	appName := extractEntityName(req)
+	app, ok := r.getApplication(appName)
+	if !ok {
+		http.Error(w, fmt.Sprintf("Application %s does not exist", appName), http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	fmt.Fprint(w, app.getOffloader().GetStatusStr())
+}
@@ -0,0 +1,157 @@
+package feo
+
+import (
+	"container/list"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+const (
+	StealerHeader    = "X-Stealer"
+	StolenFromHeader = "X-Stolen-From"
+	StolenByHeader   = "Stolen-By"
+)
+
+const DEFAULT_STEAL_INTERVAL_MS = 100
+
+type StealResponse struct {
+	Granted bool `json:"granted"`
+}
+
+func isStolen(req *http.Request) bool {
+	return req.Header.Get(StolenFromHeader) != ""
+}
+
+// handleStealRequest is the peer endpoint used by idle nodes. If the application
+// has an invocation waiting for a replica, it is marked as stolen and its handler
+// forwards the request to the thief.
+func (r *requestHandler) handleStealRequest(w http.ResponseWriter, req *http.Request) {
+	// curl -X POST -H "X-Stealer: 192.168.10.11:9696" http://localhost:9696/api/v1/namespaces/guest/steal/test
+	appName := extractEntityName(req)
+	thief := req.Header.Get(StealerHeader)
+	if thief == "" {
+		http.Error(w, fmt.Sprintf("%s header missing", StealerHeader), http.StatusBadRequest)
+		return
+	}
+
+	app, ok := r.getApplication(appName)
+	if !ok {
+		http.Error(w, fmt.Sprintf("Application %s does not exist", appName), http.StatusNotFound)
+		return
+	}
+
+	resp := StealResponse{Granted: app.getOffloader().StealQueued(thief)}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
+
+// waitForReplica blocks until a local replica is free and returns its port. While
+// it waits, the invocation can be stolen by an idle peer, in which case the
+// thief's host is returned instead.
+func (r *requestHandler) waitForReplica(app *Application, offloader OffloaderIntf, req *http.Request, ctx *list.Element) (string, string) {
+	if !r.config.Steal.Enabled || offloader.IsOffloaded(req) {
+		return <-app.portChan, ""
+	}
+
+	stolen := offloader.MarkStealable(ctx)
+	select {
+	case port := <-app.portChan:
+		if offloader.MarkStarted(ctx) {
+			return port, ""
+		}
+		// a thief won the race for this invocation
+		app.portChan <- port
+		return "", <-stolen
+	case thief := <-stolen:
+		return "", thief
+	}
+}
+
+// forwardStolen sends a stolen invocation to the thief, which executes it on one
+// of its idle replicas. The response is proxied back by the caller.
+func (r *requestHandler) forwardStolen(req *http.Request, thief string) (*http.Response, error) {
+	proxyReq := r.createProxyReq(req, thief, true, "0" /*Doesn't matter in the case of offload*/)
+	proxyReq.Header.Set(StolenFromHeader, r.host)
+
+	resp, err := r.breakers.Do(r.client, thief, proxyReq)
+	if err != nil {
+		return nil, err
+	}
+	if success, _ := strconv.ParseBool(resp.Header.Get(OffloadSuccess)); !success {
+		resp.Body.Close()
+		return nil, fmt.Errorf("thief %s did not accept the invocation", thief)
+	}
+	return resp, nil
+}
+
+// stealRoutine periodically asks peers for queued invocations of every application
+// that has idle replicas on this node.
+func (r *requestHandler) stealRoutine() {
+	interval := r.config.Steal.IntervalMs
+	if interval <= 0 {
+		interval = DEFAULT_STEAL_INTERVAL_MS
+	}
+	steal_timer := time.NewTicker(time.Duration(interval) * time.Millisecond)
+	defer steal_timer.Stop()
+
+	for {
+		select {
+		case <-r.quit:
+			return
+		case <-steal_timer.C:
+		}
+		for appName, app := range r.getApplications() {
+			idle := len(app.portChan)
+			if idle == 0 {
+				continue
+			}
+			peers := r.getPeers()
+			for _, idx := range r.rng.Perm(len(peers)) {
+				if idle == 0 {
+					break
+				}
+				peer := peers[idx]
+				if peer == r.host {
+					continue
+				}
+				if r.requestSteal(peer, appName) {
+					idle--
+				}
+			}
+		}
+	}
+}
+
+func (r *requestHandler) requestSteal(peer, appName string) bool {
+	url := fmt.Sprintf("http://%s/api/v1/namespaces/guest/steal/%s", peer, appName)
+	stealReq, err := http.NewRequest("POST", url, nil)
+	if err != nil {
+		log.Println("[WARNING] could not create steal request: ", err)
+		return false
+	}
+	stealReq.Header.Set(StealerHeader, r.host)
+
+	resp, err := r.breakers.Do(r.client, peer, stealReq)
+	if err != nil {
+		log.Println("[WARNING] steal request failed: ", err)
+		return false
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return false
+	}
+
+	var stealResp StealResponse
+	if err := json.NewDecoder(resp.Body).Decode(&stealResp); err != nil {
+		log.Println("[WARNING] could not parse steal response: ", err)
+		return false
+	}
+	if stealResp.Granted {
+		log.Printf("[INFO] stole an invocation of %s from %s\n", appName, peer)
+	}
+	return stealResp.Granted
+}
@@ -0,0 +1,208 @@
+package feo
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+const STATE_PERSIST_INTERVAL = 10 * time.Second
+
+// StatefulOffloader is implemented by offloaders whose learned state is worth
+// keeping across restarts.
+type StatefulOffloader interface {
+	SaveState() ([]byte, error)
+	LoadState(data []byte) error
+}
+
+// registryStore keeps action registrations, DAG manifests and offloader state
+// under the configured data directory:
+//
+//	<data_dir>/actions/<app>.json
+//	<data_dir>/dags/<dag>.yml
+//	<data_dir>/state/<app>.json
+type registryStore struct {
+	dir string
+}
+
+func newRegistryStore(dir string) (*registryStore, error) {
+	s := &registryStore{dir: dir}
+	for _, sub := range []string{"actions", "dags", "state"} {
+		if err := os.MkdirAll(filepath.Join(dir, sub), 0755); err != nil {
+			return nil, err
+		}
+	}
+	return s, nil
+}
+
+// writeFile replaces path atomically so that a crash never leaves a truncated file behind.
+func (s *registryStore) writeFile(path string, data []byte) error {
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+func (s *registryStore) SaveAction(spec ApplicationSpec) error {
+	if s == nil {
+		return nil
+	}
+	data, err := json.Marshal(spec)
+	if err != nil {
+		return err
+	}
+	return s.writeFile(filepath.Join(s.dir, "actions", spec.Name+".json"), data)
+}
+
+func (s *registryStore) LoadActions() ([]ApplicationSpec, error) {
+	if s == nil {
+		return nil, nil
+	}
+	var specs []ApplicationSpec
+	err := s.walk("actions", ".json", func(name string, data []byte) error {
+		var spec ApplicationSpec
+		if err := json.Unmarshal(data, &spec); err != nil {
+			return fmt.Errorf("action %s: %w", name, err)
+		}
+		specs = append(specs, spec)
+		return nil
+	})
+	return specs, err
+}
+
+func (s *registryStore) SaveDag(name string, manifest []byte) error {
+	if s == nil {
+		return nil
+	}
+	return s.writeFile(filepath.Join(s.dir, "dags", name+".yml"), manifest)
+}
+
+func (s *registryStore) LoadDags() (map[string][]byte, error) {
+	if s == nil {
+		return nil, nil
+	}
+	manifests := map[string][]byte{}
+	err := s.walk("dags", ".yml", func(name string, data []byte) error {
+		manifests[name] = data
+		return nil
+	})
+	return manifests, err
+}
+
+func (s *registryStore) SaveOffloaderState(appName string, data []byte) error {
+	if s == nil {
+		return nil
+	}
+	return s.writeFile(filepath.Join(s.dir, "state", appName+".json"), data)
+}
+
+// LoadOffloaderState returns nil if no state was saved for the application.
+func (s *registryStore) LoadOffloaderState(appName string) ([]byte, error) {
+	if s == nil {
+		return nil, nil
+	}
+	data, err := os.ReadFile(filepath.Join(s.dir, "state", appName+".json"))
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	}
+	return data, err
+}
+
+func (s *registryStore) walk(sub, ext string, fn func(name string, data []byte) error) error {
+	entries, err := os.ReadDir(filepath.Join(s.dir, sub))
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		if entry.IsDir() || filepath.Ext(entry.Name()) != ext {
+			continue
+		}
+		data, err := os.ReadFile(filepath.Join(s.dir, sub, entry.Name()))
+		if err != nil {
+			return err
+		}
+		if err := fn(strings.TrimSuffix(entry.Name(), ext), data); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// restoreRegistry recreates the applications and DAGs saved by a previous run.
+func (r *requestHandler) restoreRegistry() error {
+	specs, err := r.store.LoadActions()
+	if err != nil {
+		return err
+	}
+	for _, spec := range specs {
+		if err := r.registerApplication(spec, false); err != nil {
+			return fmt.Errorf("application %s: %w", spec.Name, err)
+		}
+		log.Printf("[INFO] Restored application %s", spec.Name)
+	}
+
+	manifests, err := r.store.LoadDags()
+	if err != nil {
+		return err
+	}
+	for name, manifest := range manifests {
+		if _, err := r.registerDag(manifest); err != nil {
+			return fmt.Errorf("dag %s: %w", name, err)
+		}
+		log.Printf("[INFO] Restored DAG %s", name)
+	}
+	return nil
+}
+
+func (r *requestHandler) restoreOffloaderState(appName string, offloader OffloaderIntf) {
+	stateful, ok := offloader.(StatefulOffloader)
+	if !ok {
+		return
+	}
+	data, err := r.store.LoadOffloaderState(appName)
+	if err != nil || data == nil {
+		if err != nil {
+			log.Printf("[WARNING] could not read offloader state of %s: %v", appName, err)
+		}
+		return
+	}
+	if err := stateful.LoadState(data); err != nil {
+		log.Printf("[WARNING] could not restore offloader state of %s: %v", appName, err)
+	}
+}
+
+func (r *requestHandler) persistOffloaderState() {
+	for appName, app := range r.getApplications() {
+		stateful, ok := app.getOffloader().(StatefulOffloader)
+		if !ok {
+			continue
+		}
+		data, err := stateful.SaveState()
+		if err == nil {
+			err = r.store.SaveOffloaderState(appName, data)
+		}
+		if err != nil {
+			log.Printf("[WARNING] could not persist offloader state of %s: %v", appName, err)
+		}
+	}
+}
+
+func (r *requestHandler) persistRoutine() {
+	persist_timer := time.NewTicker(STATE_PERSIST_INTERVAL)
+	defer persist_timer.Stop()
+	for {
+		select {
+		case <-r.quit:
+			return
+		case <-persist_timer.C:
+			r.persistOffloaderState()
+		}
+	}
+}
@@ -0,0 +1,85 @@
+package feo
+
+import (
+	"math"
+	"sort"
+	"sync"
+	"time"
+
+	pb "github.gatech.edu/faasedge/feo/offloadproto"
+)
+
+const (
+	SVCTIME_ALPHA = 0.2
+	// number of recent samples the percentiles are taken over
+	SVCTIME_WINDOW = 256
+)
+
+// ServiceTime is how long invocations of an application take on a replica,
+// without the time they waited for it.
+type ServiceTime struct {
+	EwmaMs  float64 `json:"ewma_ms"`
+	P50Ms   float64 `json:"p50_ms"`
+	P95Ms   float64 `json:"p95_ms"`
+	P99Ms   float64 `json:"p99_ms"`
+	Samples int64   `json:"samples"`
+}
+
+// Known reports whether any invocation was measured.
+func (s ServiceTime) Known() bool {
+	return s.Samples > 0
+}
+
+// Proto converts s for the controller.
+func (s ServiceTime) Proto() *pb.ServiceTime {
+	return &pb.ServiceTime{EwmaMs: float32(s.EwmaMs), P50Ms: float32(s.P50Ms), P95Ms: float32(s.P95Ms), P99Ms: float32(s.P99Ms), Samples: s.Samples}
+}
+
+// serviceTimeEstimator tracks the service time of an application. The zero
+// value is ready to use.
+type serviceTimeEstimator struct {
+	mu     sync.Mutex
+	window []float64
+	next   int
+	est    ServiceTime
+}
+
+func (e *serviceTimeEstimator) observe(d time.Duration) {
+	ms := float64(d.Microseconds()) / 1000
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.est.Samples == 0 {
+		e.est.EwmaMs = ms
+	} else {
+		e.est.EwmaMs = (1-SVCTIME_ALPHA)*e.est.EwmaMs + SVCTIME_ALPHA*ms
+	}
+	e.est.Samples++
+
+	if len(e.window) < SVCTIME_WINDOW {
+		e.window = append(e.window, ms)
+	} else {
+		e.window[e.next] = ms
+		e.next = (e.next + 1) % SVCTIME_WINDOW
+	}
+	sorted := append([]float64{}, e.window...)
+	sort.Float64s(sorted)
+	e.est.P50Ms = percentile(sorted, 50)
+	e.est.P95Ms = percentile(sorted, 95)
+	e.est.P99Ms = percentile(sorted, 99)
+}
+
+func (e *serviceTimeEstimator) get() ServiceTime {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return e.est
+}
+
+// percentile returns the nearest-rank percentile p of sorted, which must not be empty.
+func percentile(sorted []float64, p float64) float64 {
+	rank := int(math.Ceil(p/100*float64(len(sorted)))) - 1
+	if rank < 0 {
+		rank = 0
+	}
+	return sorted[rank]
+}
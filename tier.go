@@ -0,0 +1,116 @@
+package feo
+
+import (
+	"container/list"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+)
+
+// TierHopsHeader reports how many peers of every tier an invocation was
+// offloaded to, e.g. "edge=2,regional=1,cloud=0".
+const TierHopsHeader = "Tier-Hops"
+
+// Tier is a group of feo nodes, e.g. a regional cluster or a cloud endpoint.
+type Tier struct {
+	Name  string   `yaml:"name"`
+	Peers []string `yaml:"peers"`
+}
+
+// TieringConfig places this node and its peers in a tier below others. The
+// peers of the tiers above are only offloaded to in escalation mode.
+type TieringConfig struct {
+	// Escalate offloads to the tiers above once this tier is saturated.
+	Escalate bool `yaml:"escalate"`
+	// Name of the tier of this node and its peers, "edge" if empty.
+	Name string `yaml:"name"`
+	// Up are the tiers above this one, nearest first.
+	Up []Tier `yaml:"up"`
+}
+
+func (c TieringConfig) name() string {
+	if c.Name == "" {
+		return "edge"
+	}
+	return c.Name
+}
+
+// Validate requires the tiers to have distinct names.
+func (c TieringConfig) Validate() error {
+	names := map[string]bool{c.name(): true}
+	for _, tier := range c.Up {
+		if tier.Name == "" || names[tier.Name] {
+			return fmt.Errorf("tier names must be set and distinct, got %q", tier.Name)
+		}
+		names[tier.Name] = true
+	}
+	return nil
+}
+
+// tierOf returns the tier of peer. Peers that are not in a tier above are in
+// the tier of this node.
+func (c TieringConfig) tierOf(peer string) string {
+	for _, tier := range c.Up {
+		for _, p := range tier.Peers {
+			if p == peer {
+				return tier.Name
+			}
+		}
+	}
+	return c.name()
+}
+
+// tierHops counts the peers of every tier an invocation was offloaded to.
+type tierHops struct {
+	names  []string
+	counts map[string]int
+}
+
+func newTierHops(cfg TieringConfig) *tierHops {
+	h := &tierHops{names: []string{cfg.name()}, counts: map[string]int{}}
+	for _, tier := range cfg.Up {
+		h.names = append(h.names, tier.Name)
+	}
+	return h
+}
+
+func (h *tierHops) add(tier string) {
+	h.counts[tier]++
+}
+
+func (h *tierHops) String() string {
+	hops := make([]string, len(h.names))
+	for i, name := range h.names {
+		hops[i] = fmt.Sprintf("%s=%d", name, h.counts[name])
+	}
+	return strings.Join(hops, ",")
+}
+
+// escalate is called once this node and the peers its policy picked rejected
+// req. The tier is saturated when every other peer of it rejects req as well,
+// then the tiers above are tried in turn, every peer of a tier before the
+// next. It returns the reply of the first peer that accepted req. Peers in
+// tried were offloaded to already and are skipped.
+func (r *requestHandler) escalate(req *http.Request, offloader OffloaderIntf, metricCtx *list.Element, hops *tierHops, tried map[string]bool) (*http.Response, bool) {
+	own := Tier{Name: r.config.Tiering.name()}
+	for _, router := range offloader.Base().Candidates() {
+		own.Peers = append(own.Peers, router.host)
+	}
+
+	for _, tier := range append([]Tier{own}, r.config.Tiering.Up...) {
+		for _, peer := range tier.Peers {
+			if peer == r.host || tried[peer] || !offloader.Base().Available(peer) {
+				continue
+			}
+			tried[peer] = true
+			hops.add(tier.Name)
+			log.Printf("[INFO] escalating to %s in tier %s\n", peer, tier.Name)
+			if resp, accepted := r.offloadTo(req, offloader, metricCtx, peer); accepted {
+				return resp, true
+			}
+		}
+		log.Printf("[DEBUG] tier %s is saturated\n", tier.Name)
+	}
+	return nil, false
+}
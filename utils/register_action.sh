@@ -2,5 +2,12 @@ appName="$1"
 initPort="$2"
 numReplicas="$3"
 feoIp="$4"
+# optional: offloading policy of this action and its parameters as JSON, e.g. impedence '{"alpha": 0.3}'
+policy="$5"
+policyConfig="$6"
 
-curl -X PUT "http://$feoIp/api/v1/namespaces/guest/actions/$appName?initPort=$initPort&numReplicas=$numReplicas"
+if [ -z "$policy" ]; then
+  curl -X PUT "http://$feoIp/api/v1/namespaces/guest/actions/$appName?initPort=$initPort&numReplicas=$numReplicas"
+else
+  curl -X PUT "http://$feoIp/api/v1/namespaces/guest/actions/$appName?initPort=$initPort&numReplicas=$numReplicas&policy=$policy" -d "$policyConfig"
+fi
@@ -57,7 +57,7 @@ FEO_DIR="$SCRIPT_DIR/../"
 #export PATH=$PATH:/usr/local/go/bin
 echo "[+] build feo"
 cd $FEO_DIR
-GO build
+GO build -o feo ./cmd/feo
 
 echo "[+] build central_server"
 cd central_server